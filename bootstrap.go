@@ -0,0 +1,281 @@
+package main
+
+// Bootstrapping for upstreams configured by hostname.  Looking them up through the system
+// resolver can end up asking funkyd itself, which can't answer until it can reach its upstreams,
+// so their addresses can come from the configuration or from plain DNS resolvers instead.  The
+// addresses are looked back up on an interval and connections are spread across all of them.
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how long a dial to one of an upstream's addresses gets before the next address is dialed as well
+const bootstrapDialStagger = time.Duration(250) * time.Millisecond
+
+// Keeps track of the addresses a single upstream resolves to
+type upstreamBootstrap struct {
+	// the upstream's configured address, used for metrics and logging
+	address string
+
+	// the hostname to look up
+	host string
+
+	// the port to connect to on every address
+	port string
+
+	// addresses that come straight from the configuration
+	staticIps []string
+
+	// resolvers to look the hostname up with, as ip:port
+	resolvers []string
+
+	// sends the lookups
+	client *dns.Client
+
+	// guards addrs and next
+	lock sync.Mutex
+
+	// every address to connect to, as ip:port
+	addrs []string
+
+	// where the next dial starts in addrs
+	next int
+}
+
+// whether an upstream is configured by hostname and has something to look it up with
+func (u UpstreamConfig) needsBootstrap() bool {
+	return net.ParseIP(u.Upstream().host()) == nil && (len(u.BootstrapIps) > 0 || len(u.bootstrapResolvers()) > 0)
+}
+
+// the upstream's own resolvers, or the global ones if it doesn't have any
+func (u UpstreamConfig) bootstrapResolvers() []string {
+	if len(u.BootstrapResolvers) > 0 {
+		return u.BootstrapResolvers
+	}
+	return GetConfiguration().BootstrapResolvers
+}
+
+// sets up bootstrapping for an upstream, returns nil if it doesn't need any
+func newUpstreamBootstrap(u UpstreamConfig) (*upstreamBootstrap, error) {
+	if !u.needsBootstrap() {
+		return nil, nil
+	}
+
+	address := u.Upstream().GetAddress()
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse address [%s] of upstream [%s]: %s", address, u.Address, err)
+	}
+
+	for _, ip := range u.BootstrapIps {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("bootstrap IP [%s] for upstream [%s] is not an IP", ip, u.Address)
+		}
+	}
+
+	var resolvers []string
+	for _, resolver := range u.bootstrapResolvers() {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		resolvers = append(resolvers, resolver)
+	}
+
+	config := GetConfiguration()
+	b := &upstreamBootstrap{
+		address:   address,
+		host:      u.Upstream().host(),
+		port:      port,
+		staticIps: u.BootstrapIps,
+		resolvers: resolvers,
+		client:    &dns.Client{Net: "udp", Timeout: config.Timeout * time.Millisecond},
+	}
+	b.setAddrs(nil)
+	return b, nil
+}
+
+// replaces the addresses with the static IPs plus whatever the resolvers found
+func (b *upstreamBootstrap) setAddrs(resolved []string) {
+	seen := map[string]bool{}
+	var addrs []string
+	for _, ip := range append(append([]string{}, b.staticIps...), resolved...) {
+		if addr := net.JoinHostPort(ip, b.port); !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	b.lock.Lock()
+	b.addrs = addrs
+	b.next = 0
+	b.lock.Unlock()
+	BootstrapAddressesGauge.WithLabelValues(b.address).Set(float64(len(addrs)))
+}
+
+// Looks the upstream back up with the first resolver that answers.  If none of them do, the
+// upstream keeps the addresses it already had.
+func (b *upstreamBootstrap) Resolve() error {
+	if len(b.resolvers) == 0 {
+		return nil
+	}
+
+	var err error
+	for _, resolver := range b.resolvers {
+		var ips []string
+		if ips, err = b.lookup(resolver); err == nil {
+			BootstrapLookupsCounter.WithLabelValues(b.address, "success").Inc()
+			b.setAddrs(ips)
+			return nil
+		}
+		Logger.Log(NewLogMessage(
+			WARNING,
+			LogContext{
+				"what":     "could not look up upstream with bootstrap resolver",
+				"address":  b.address,
+				"resolver": resolver,
+				"error":    err.Error(),
+				"next":     "trying the next resolver",
+			},
+			nil,
+		))
+	}
+	BootstrapLookupsCounter.WithLabelValues(b.address, "failure").Inc()
+	return fmt.Errorf("none of the bootstrap resolvers could look up [%s], last error: %s", b.host, err)
+}
+
+// Looks up every A and AAAA record for the upstream's hostname.  One of the queries failing doesn't
+// throw away what the other one found, the lookup only fails if neither of them turns up an address.
+func (b *upstreamBootstrap) lookup(resolver string) (ips []string, err error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(b.host), qtype)
+		r, _, exchangeErr := b.client.Exchange(m, resolver)
+		if exchangeErr != nil {
+			err = exchangeErr
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("got [%s] looking up [%s] [%s]", dns.RcodeToString[r.Rcode], b.host, dns.TypeToString[qtype])
+			continue
+		}
+		// any CNAMEs along the way don't matter, only where they end up
+		for _, rr := range r.Answer {
+			switch record := rr.(type) {
+			case *dns.A:
+				ips = append(ips, record.A.String())
+			case *dns.AAAA:
+				ips = append(ips, record.AAAA.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no addresses found for [%s]", b.host)
+	}
+	return ips, nil
+}
+
+// Returns every address to try for a dial.  The starting point moves along with every call
+// so that the pool's connections end up spread across all of them.
+func (b *upstreamBootstrap) Targets() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	targets := make([]string, 0, len(b.addrs))
+	for i := range b.addrs {
+		targets = append(targets, b.addrs[(b.next+i)%len(b.addrs)])
+	}
+	if len(b.addrs) > 0 {
+		b.next = (b.next + 1) % len(b.addrs)
+	}
+	return targets
+}
+
+// Looks the bootstrapped upstreams back up in the background
+type upstreamBootstrapper struct {
+	bootstraps []*upstreamBootstrap
+
+	interval time.Duration
+
+	Cancel chan bool
+}
+
+// builds a bootstrapper for a client's upstreams, returns nil if there's nothing to look back up
+func NewUpstreamBootstrapper(client Client) *upstreamBootstrapper {
+	cl, ok := client.(*tlsClient)
+	if !ok {
+		return nil
+	}
+
+	config := GetConfiguration()
+	if config.BootstrapInterval < 0 {
+		return nil
+	}
+	interval := time.Duration(300000) * time.Millisecond
+	if config.BootstrapInterval != 0 {
+		interval = config.BootstrapInterval * time.Millisecond
+	}
+
+	b := &upstreamBootstrapper{interval: interval}
+	for _, bootstrap := range cl.bootstraps {
+		// static IPs never change
+		if len(bootstrap.resolvers) > 0 {
+			b.bootstraps = append(b.bootstraps, bootstrap)
+		}
+	}
+	if len(b.bootstraps) == 0 {
+		return nil
+	}
+	return b
+}
+
+func (b *upstreamBootstrapper) ResolveAll() {
+	for _, bootstrap := range b.bootstraps {
+		if err := bootstrap.Resolve(); err != nil {
+			Logger.Log(NewLogMessage(
+				ERROR,
+				LogContext{
+					"what":    "could not look upstream back up",
+					"address": bootstrap.address,
+					"error":   err.Error(),
+					"next":    "keeping the addresses from the last lookup",
+				},
+				nil,
+			))
+		}
+	}
+}
+
+func (b *upstreamBootstrapper) Start() {
+	b.Cancel = make(chan bool)
+	go func() {
+		t := time.NewTicker(b.interval)
+		defer t.Stop()
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":      "starting upstream re-resolution",
+				"upstreams": strconv.Itoa(len(b.bootstraps)),
+				"interval":  fmt.Sprintf("%s", b.interval),
+			},
+			nil,
+		))
+		for {
+			select {
+			case _ = <-t.C:
+				b.ResolveAll()
+			case _ = <-b.Cancel:
+				return
+			}
+		}
+	}()
+}
+
+func (b *upstreamBootstrapper) Stop() {
+	close(b.Cancel)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// starts a plain DNS resolver on a local port that answers every A and AAAA query with the given IPs,
+// except for queries of the failing type, which get SERVFAIL
+func startTestResolver(t *testing.T, ips *[]string, lock *sync.Mutex, failing uint16) (address string, shutdown func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if req.Question[0].Qtype == failing {
+				m.Rcode = dns.RcodeServerFailure
+				w.WriteMsg(m)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, ip := range *ips {
+				parsed := net.ParseIP(ip)
+				hdr := dns.RR_Header{Name: req.Question[0].Name, Rrtype: req.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+				if v4 := parsed.To4(); v4 != nil && req.Question[0].Qtype == dns.TypeA {
+					m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: v4})
+				} else if v4 == nil && req.Question[0].Qtype == dns.TypeAAAA {
+					m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: parsed})
+				}
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestBootstrapStaticIps(t *testing.T) {
+	u := UpstreamConfig{Address: "dns.example.com", BootstrapIps: []string{"192.0.2.1", "2001:db8::1"}}
+	bootstrap, err := newUpstreamBootstrap(u)
+	if err != nil || bootstrap == nil {
+		t.Fatalf("could not set up bootstrapping for [%v]: %s", u, err)
+	}
+
+	// every dial starts one address further along
+	first, second := bootstrap.Targets(), bootstrap.Targets()
+	if len(first) != 2 || first[0] != "192.0.2.1:853" || second[0] != "[2001:db8::1]:853" {
+		t.Fatalf("dials weren't spread across the addresses: [%v] then [%v]", first, second)
+	}
+
+	tlsConf, err := u.TlsConfig()
+	if err != nil {
+		t.Fatalf("could not build TLS config for [%v]: %s", u, err)
+	}
+	if tlsConf.ServerName != "dns.example.com" {
+		t.Fatalf("expected the hostname to stay the TLS server name, got [%s]", tlsConf.ServerName)
+	}
+
+	for _, bad := range []UpstreamConfig{
+		{Address: "dns.example.com", BootstrapIps: []string{"dns.example.net"}},
+	} {
+		if _, err := newUpstreamBootstrap(bad); err == nil {
+			t.Errorf("invalid bootstrap config [%v] was accepted", bad)
+		}
+	}
+
+	if bootstrap, _ := newUpstreamBootstrap(UpstreamConfig{Address: "192.0.2.1", BootstrapIps: []string{"192.0.2.2"}}); bootstrap != nil {
+		t.Fatalf("bootstrapped an upstream that was configured by IP")
+	}
+	if bootstrap, _ := newUpstreamBootstrap(UpstreamConfig{Address: "[2001:db8::2]", BootstrapIps: []string{"192.0.2.2"}}); bootstrap != nil {
+		t.Fatalf("bootstrapped an upstream that was configured by bracketed IPv6 literal")
+	}
+}
+
+func TestBootstrapResolvers(t *testing.T) {
+	var lock sync.Mutex
+	ips := []string{"192.0.2.10", "2001:db8::10"}
+	resolver, shutdown := startTestResolver(t, &ips, &lock, 0)
+
+	u := UpstreamConfig{Address: "dns.example.com", BootstrapResolvers: []string{resolver}}
+	bootstrap, err := newUpstreamBootstrap(u)
+	if err != nil {
+		t.Fatalf("could not set up bootstrapping for [%v]: %s", u, err)
+	}
+	if err := bootstrap.Resolve(); err != nil {
+		t.Fatalf("could not look up [%v]: %s", u, err)
+	}
+	if targets := bootstrap.Targets(); len(targets) != 2 {
+		t.Fatalf("expected both the A and the AAAA record, got [%v]", targets)
+	}
+
+	// the upstream moved
+	lock.Lock()
+	ips = []string{"192.0.2.20"}
+	lock.Unlock()
+	if err := bootstrap.Resolve(); err != nil {
+		t.Fatalf("could not look [%v] back up: %s", u, err)
+	}
+	if targets := bootstrap.Targets(); len(targets) != 1 || targets[0] != "192.0.2.20:853" {
+		t.Fatalf("new address wasn't picked up, got [%v]", targets)
+	}
+
+	// a failed lookup doesn't leave the upstream with nowhere to go
+	shutdown()
+	bootstrap.client.Timeout = 100 * time.Millisecond
+	if err := bootstrap.Resolve(); err == nil {
+		t.Fatalf("lookup succeeded without a resolver")
+	}
+	if targets := bootstrap.Targets(); len(targets) != 1 {
+		t.Fatalf("failed lookup threw away the old addresses, got [%v]", targets)
+	}
+}
+
+func TestBootstrapResolversPartialFailure(t *testing.T) {
+	var lock sync.Mutex
+	ips := []string{"192.0.2.10", "2001:db8::10"}
+	resolver, shutdown := startTestResolver(t, &ips, &lock, dns.TypeAAAA)
+	defer shutdown()
+
+	u := UpstreamConfig{Address: "dns.example.com", BootstrapResolvers: []string{resolver}}
+	bootstrap, err := newUpstreamBootstrap(u)
+	if err != nil {
+		t.Fatalf("could not set up bootstrapping for [%v]: %s", u, err)
+	}
+	if err := bootstrap.Resolve(); err != nil {
+		t.Fatalf("failed AAAA lookup threw away the A records: %s", err)
+	}
+	if targets := bootstrap.Targets(); len(targets) != 1 || targets[0] != "192.0.2.10:853" {
+		t.Fatalf("expected just the A record, got [%v]", targets)
+	}
+
+	// with neither query answering, there's nothing to use
+	lock.Lock()
+	ips = []string{"2001:db8::10"}
+	lock.Unlock()
+	if err := bootstrap.Resolve(); err == nil || !strings.Contains(err.Error(), "SERVFAIL") {
+		t.Fatalf("expected the AAAA failure to be reported, got [%v]", err)
+	}
+}
+
+func TestBootstrapDial(t *testing.T) {
+	port, shutdown := startTlsBlackhole(t)
+	defer shutdown()
+
+	config := GetConfiguration()
+	config.SkipUpstreamVerification = true
+	config.Upstreams = []UpstreamConfig{{Address: "bootstrap.invalid", Port: port, BootstrapIps: []string{"127.0.0.1"}}}
+	defer func() {
+		config.SkipUpstreamVerification = false
+		config.Upstreams = nil
+	}()
+
+	client, err := BuildClient()
+	if err != nil {
+		t.Fatalf("could not build client: %s", err)
+	}
+
+	upstream := config.Upstreams[0].Upstream()
+	conn, err := client.Dial(upstream.GetAddress())
+	if err != nil {
+		t.Fatalf("could not dial bootstrapped upstream: %s", err)
+	}
+	defer conn.Close()
+
+	if name := conn.Conn.(*tls.Conn).ConnectionState().ServerName; name != "bootstrap.invalid" {
+		t.Fatalf("expected the hostname to be sent as the server name, got [%s]", name)
+	}
+
+	if NewUpstreamBootstrapper(client) != nil {
+		t.Fatalf("built a re-resolver for an upstream with only static IPs")
+	}
+}
+
+func TestBootstrapDialStaggered(t *testing.T) {
+	port, shutdown := startTlsBlackhole(t)
+	defer shutdown()
+
+	// accepts connections but never finishes a handshake on them
+	hole, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("could not listen on a second loopback address: %s", err)
+	}
+	defer hole.Close()
+	go func() {
+		for {
+			conn, err := hole.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := GetConfiguration()
+	oldTimeout := config.Timeout
+	config.Timeout = 5000
+	config.SkipUpstreamVerification = true
+	config.Upstreams = []UpstreamConfig{{Address: "bootstrap.invalid", Port: port, BootstrapIps: []string{"127.0.0.2", "127.0.0.1"}}}
+	defer func() {
+		config.Timeout = oldTimeout
+		config.SkipUpstreamVerification = false
+		config.Upstreams = nil
+	}()
+
+	client, err := BuildClient()
+	if err != nil {
+		t.Fatalf("could not build client: %s", err)
+	}
+
+	start := time.Now()
+	conn, err := client.Dial(config.Upstreams[0].Upstream().GetAddress())
+	if err != nil {
+		t.Fatalf("could not dial bootstrapped upstream: %s", err)
+	}
+	defer conn.Close()
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("address that never answered held up the dial for [%s]", elapsed)
+	}
+}
+
+func TestBootstrapDialWithoutAddresses(t *testing.T) {
+	config := GetConfiguration()
+	config.Upstreams = []UpstreamConfig{{Address: "bootstrap.invalid", BootstrapResolvers: []string{"127.0.0.1:1"}}}
+	defer func() { config.Upstreams = nil }()
+
+	client, err := BuildClient()
+	if err != nil {
+		t.Fatalf("could not build client: %s", err)
+	}
+
+	// the system resolver could be funkyd itself, it only gets asked if that's been allowed
+	address := config.Upstreams[0].Upstream().GetAddress()
+	if _, err := client.Dial(address); err == nil || !strings.Contains(err.Error(), "bootstrap resolvers") {
+		t.Fatalf("dial without any bootstrapped addresses didn't fail up front: %v", err)
+	}
+}
+
+func TestBootstrapDialFailureReason(t *testing.T) {
+	port, shutdown := startTlsBlackhole(t)
+	defer shutdown()
+
+	config := GetConfiguration()
+	config.Upstreams = []UpstreamConfig{{
+		Address:      "bootstrap.invalid",
+		Port:         port,
+		BootstrapIps: []string{"127.0.0.1"},
+		SpkiPins:     []string{bogusPin()},
+		SpkiPinOnly:  true,
+	}}
+	defer func() { config.Upstreams = nil }()
+
+	client, err := BuildClient()
+	if err != nil {
+		t.Fatalf("could not build client: %s", err)
+	}
+
+	// the pin failure has to make it through the dial to the upstream's addresses
+	_, err = client.Dial(config.Upstreams[0].Upstream().GetAddress())
+	if err == nil {
+		t.Fatalf("dialed an upstream with a pin that doesn't match")
+	}
+	if reason := connectionFailureReason(err); reason != "spki_pin" {
+		t.Fatalf("expected the failure reason to be [spki_pin], got [%s] for [%s]", reason, err)
+	}
+}
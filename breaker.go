@@ -0,0 +1,149 @@
+package main
+
+// Circuit breaker for upstreams.  An upstream that fails gets its breaker opened and
+// won't get any traffic until the breaker's cooldown has passed.  After that the breaker
+// is half-open, and a limited number of probe queries are let through: if one succeeds,
+// the breaker closes, if one fails, the breaker opens again for twice as long.
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	// traffic flows normally
+	BreakerClosed BreakerState = iota
+
+	// no traffic until the wakeup time
+	BreakerOpen
+
+	// the cooldown is over, only probes get through
+	BreakerHalfOpen
+)
+
+var breakerStates = []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen}
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+// how much the open duration can be pushed either way, so that upstreams that failed
+// together don't all get probed together
+const breakerJitter = 0.2
+
+// Returns the breaker's current state.  The switch from open to half-open happens when the
+// wakeup time passes, this reports it even if nothing has noticed yet.
+func (u *Upstream) BreakerState() BreakerState {
+	if u.breakerState == BreakerOpen && !u.wakeupTime.After(time.Now()) {
+		return BreakerHalfOpen
+	}
+	return u.breakerState
+}
+
+// Opens the breaker after a failure.  Every failure in a row doubles how long it stays
+// open, starting at base and capped at max.  Returns how long the breaker will stay open.
+func (u *Upstream) Trip(base, max time.Duration) time.Duration {
+	if u.BreakerState() == BreakerOpen {
+		// this is fallout from whatever opened it in the first place, it isn't a new failure
+		return time.Until(u.wakeupTime)
+	}
+
+	u.trips++
+	open := base
+	for i := 1; i < u.trips && open < max; i++ {
+		open *= 2
+	}
+	if jitter := int64(float64(open) * breakerJitter); jitter > 0 {
+		open += time.Duration(rand.Int63n(2*jitter) - jitter)
+	}
+	if open > max {
+		open = max
+	}
+
+	u.wakeupTime = time.Now().Add(open)
+	u.probes = 0
+	UpstreamBreakerOpenDurationGauge.WithLabelValues(u.GetAddress()).Set(open.Seconds())
+	u.setBreakerState(BreakerOpen)
+	return open
+}
+
+// Opens the breaker for a given amount of time, without any backoff
+func (u *Upstream) Cooldown(t time.Duration) {
+	u.wakeupTime = time.Now().Add(t)
+	u.probes = 0
+	u.setBreakerState(BreakerOpen)
+}
+
+// Lets a probe query through a half-open breaker
+func (u *Upstream) AddProbe() {
+	u.setBreakerState(BreakerHalfOpen)
+	u.probes++
+}
+
+// Closes the breaker, the upstream is healthy again
+func (u *Upstream) CloseBreaker() {
+	u.trips = 0
+	u.probes = 0
+	u.setBreakerState(BreakerClosed)
+}
+
+// returns whether or not the breaker is keeping traffic away from this upstream,
+// either because it's open or because it's half-open and the probes are already out
+func (u *Upstream) IsCooling() (ret bool) {
+	switch u.BreakerState() {
+	case BreakerOpen:
+		return true
+	case BreakerHalfOpen:
+		probes := GetConfiguration().HalfOpenProbes
+		if probes == 0 {
+			probes = 1
+		}
+		return u.probes >= probes
+	}
+	return false
+}
+
+// returns the actual time when this upstream will be ready for connections
+func (u *Upstream) WakeupTime() (wakeupTime time.Time) {
+	return u.wakeupTime
+}
+
+func (u *Upstream) setBreakerState(state BreakerState) {
+	previous := u.breakerState
+	if previous == state {
+		return
+	}
+	u.breakerState = state
+
+	address := u.GetAddress()
+	Logger.Log(NewLogMessage(
+		WARNING,
+		LogContext{
+			"what":    "upstream circuit breaker changed state",
+			"address": address,
+			"from":    previous.String(),
+			"to":      state.String(),
+			"wakeup":  u.wakeupTime.Format(time.RFC3339Nano),
+			"trips":   fmt.Sprintf("%d", u.trips),
+		},
+		nil,
+	))
+	UpstreamBreakerTransitionsCounter.WithLabelValues(address, previous.String(), state.String()).Inc()
+	for _, each := range breakerStates {
+		value := 0.0
+		if each == state {
+			value = 1
+		}
+		UpstreamBreakerStateGauge.WithLabelValues(address, each.String()).Set(value)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// pretends the breaker's cooldown has run out
+func expireBreaker(u *Upstream) {
+	u.wakeupTime = time.Now().Add(-time.Millisecond)
+}
+
+func TestBreakerBackoff(t *testing.T) {
+	u := &Upstream{Name: "example.com"}
+	base, max := 100*time.Millisecond, time.Second
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expected {
+		e = e * time.Millisecond
+		open := u.Trip(base, max)
+		low, high := time.Duration(float64(e)*(1-breakerJitter)), e+time.Duration(float64(e)*breakerJitter)
+		if high > max {
+			high = max
+		}
+		if open < low || open > high {
+			t.Fatalf("trip [%d] opened the breaker for [%s], expected between [%s] and [%s]", i, open, low, high)
+		}
+		if !u.IsCooling() || u.BreakerState() != BreakerOpen {
+			t.Fatalf("breaker wasn't open after trip [%d]: [%s]", i, u.BreakerState())
+		}
+		expireBreaker(u)
+	}
+}
+
+func TestBreakerTripWhileOpen(t *testing.T) {
+	u := &Upstream{Name: "example.com"}
+	u.Trip(time.Second, time.Hour)
+	// a pile of failures from the connections that were already out shouldn't count as new failures
+	for i := 0; i < 5; i++ {
+		u.Trip(time.Second, time.Hour)
+	}
+	if u.trips != 1 {
+		t.Fatalf("trips while open counted toward the backoff: [%d]", u.trips)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	u := &Upstream{Name: "example.com"}
+	u.Trip(time.Second, time.Hour)
+	expireBreaker(u)
+
+	if u.BreakerState() != BreakerHalfOpen || u.IsCooling() {
+		t.Fatalf("breaker should be half-open and letting probes through, got [%s]", u.BreakerState())
+	}
+
+	u.AddProbe()
+	if !u.IsCooling() {
+		t.Fatalf("breaker let more than one probe through")
+	}
+
+	u.CloseBreaker()
+	if u.BreakerState() != BreakerClosed || u.IsCooling() || u.trips != 0 {
+		t.Fatalf("breaker didn't close: [%s], [%d] trips", u.BreakerState(), u.trips)
+	}
+}
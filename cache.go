@@ -93,6 +93,9 @@ type RecordCache struct {
 
 	// the cache lock
 	lock Lock
+
+	// whether the janitor and trashman are running, so that they only get stopped once
+	cleaning bool
 }
 
 // DNS response cache wrapper
@@ -115,7 +118,7 @@ type Response struct {
 
 // constructs a cache key from a response
 func (r Response) FormatKey() string {
-	return r.Key + string(r.Qtype)
+	return fmt.Sprintf("%s%d", r.Key, r.Qtype)
 }
 
 func (response Response) IsExpired(rr dns.RR) bool {
@@ -157,7 +160,7 @@ func (r Response) updateTtl(rr dns.RR) {
 		DEBUG,
 		LogContext{
 			"what": "updating cached TTL",
-			"ttl":  string(castTtl),
+			"ttl":  fmt.Sprintf("%d", castTtl),
 		},
 		func() string { return fmt.Sprintf("rr [%v] ttl [%f] casted ttl [%d]", rr, ttl, castTtl) },
 	))
@@ -375,10 +378,24 @@ func (r *RecordCache) StartCleaningCrew() {
 
 	r.Janitor.Start(r)
 	r.TrashMan.Start(r)
+
+	r.Lock()
+	r.cleaning = true
+	r.Unlock()
 }
 
-// Mainly allowing this so that tests can clean up their grs
+// Stops the janitor and trashman, this is safe to call on a cache whose crew
+// was never started or has already been stopped
 func (r *RecordCache) StopCleaningCrew() {
+	r.Lock()
+	if !r.cleaning {
+		r.Unlock()
+		return
+	}
+	r.cleaning = false
+	// the trashman needs the lock to flush, so it can't be held while stopping
+	r.Unlock()
+
 	r.TrashMan.Stop()
 	r.Janitor.Stop()
 }
@@ -438,7 +455,7 @@ func (t *trashMan) Start(r *RecordCache) {
 			INFO,
 			LogContext{
 				"what":      "starting trashman",
-				"batchsize": string(t.evictionBatchSize),
+				"batchsize": fmt.Sprintf("%d", t.evictionBatchSize),
 			},
 			nil,
 		))
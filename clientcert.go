@@ -0,0 +1,104 @@
+package main
+
+// Client certificates for mutual TLS with upstreams, reloaded from disk when they change
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Loads a certificate/key pair and reloads it whenever either file changes,
+// so certificates can be rotated without restarting
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert *tls.Certificate
+
+	// the newest modification time of the two files when they were last loaded
+	modTime time.Time
+
+	lock sync.Mutex
+}
+
+func NewCertReloader(conf tlsConfig) (*certReloader, error) {
+	if conf.CertificateFile == "" || conf.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("client certificates need both a certificate file and a private key file")
+	}
+	r := &certReloader{
+		certFile: conf.CertificateFile,
+		keyFile:  conf.PrivateKeyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// returns the newest modification time of the cert and key files
+func (r *certReloader) currentModTime() (time.Time, error) {
+	var newest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return newest, fmt.Errorf("could not stat [%s]: %s", file, err)
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// non re-entrant, needs outside locking once the reloader is in use
+func (r *certReloader) reload() error {
+	modTime, err := r.currentModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load client certificate [%s] with key [%s]: %s", r.certFile, r.keyFile, err)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// for tls.Config.GetClientCertificate, checks the files for changes on every handshake
+func (r *certReloader) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	modTime, err := r.currentModTime()
+	if err == nil && modTime.After(r.modTime) {
+		err = r.reload()
+		if err == nil {
+			Logger.Log(NewLogMessage(
+				WARNING,
+				LogContext{
+					"what":        "reloaded client certificate",
+					"certificate": r.certFile,
+				},
+				nil,
+			))
+		}
+	}
+
+	if err != nil {
+		// a half-written file during rotation shouldn't take the upstream down, keep the old one
+		Logger.Log(NewLogMessage(
+			ERROR,
+			LogContext{
+				"what":        "could not reload client certificate",
+				"certificate": r.certFile,
+				"error":       err.Error(),
+				"next":        "using previously loaded certificate",
+			},
+			nil,
+		))
+	}
+	return r.cert, nil
+}
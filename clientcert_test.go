@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes a fresh self-signed client certificate and key to dir, returns the config pointing at them
+func writeTestClientCert(t *testing.T, dir string, name string) (tlsConfig, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %s", err)
+	}
+
+	conf := tlsConfig{
+		CertificateFile: filepath.Join(dir, "client.crt"),
+		PrivateKeyFile:  filepath.Join(dir, "client.key"),
+	}
+	if err := ioutil.WriteFile(conf.CertificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("could not write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(conf.PrivateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("could not write key: %s", err)
+	}
+	return conf, cert
+}
+
+// runs a handshake and a read against a server that requires client certificates signed by ca
+func mutualHandshake(t *testing.T, clientConf *tls.Config, ca *x509.Certificate) error {
+	serverCert, err := tls.LoadX509KeyPair("testdata/cert", "testdata/priv")
+	if err != nil {
+		t.Fatalf("could not load test key pair: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		server := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		})
+		if server.Handshake() == nil {
+			server.Write([]byte("ok"))
+		}
+		server.Close()
+	}()
+
+	client := tls.Client(clientConn, clientConf)
+	if err := client.Handshake(); err != nil {
+		return err
+	}
+	// under TLS 1.3, the server's verdict on our certificate arrives after the handshake
+	_, err = client.Read(make([]byte, 2))
+	return err
+}
+
+func TestClientCertificateHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "funkyd")
+	if err != nil {
+		t.Fatalf("could not make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	clientTls, ca := writeTestClientCert(t, dir, "funkyd")
+
+	u := UpstreamConfig{Address: "example.com", ClientTls: clientTls}
+	tlsConf, err := u.TlsConfig()
+	if err != nil {
+		t.Fatalf("could not build TLS config for [%v]: %s", u, err)
+	}
+	tlsConf.InsecureSkipVerify = true
+	if err := mutualHandshake(t, tlsConf, ca); err != nil {
+		t.Fatalf("mutual TLS handshake failed: %s", err)
+	}
+
+	err = mutualHandshake(t, &tls.Config{InsecureSkipVerify: true}, ca)
+	if err == nil {
+		t.Fatalf("handshake without a client certificate succeeded")
+	}
+	if reason := connectionFailureReason(err); reason != "client_certificate_rejected" {
+		t.Fatalf("rejected client certificate was classified as [%s]: %s", reason, err)
+	}
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "funkyd")
+	if err != nil {
+		t.Fatalf("could not make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	clientTls, _ := writeTestClientCert(t, dir, "original")
+
+	reloader, err := NewCertReloader(clientTls)
+	if err != nil {
+		t.Fatalf("could not load client certificate: %s", err)
+	}
+
+	_, rotated := writeTestClientCert(t, dir, "rotated")
+	// make sure the change is visible even on filesystems with coarse timestamps
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(clientTls.CertificateFile, future, future)
+
+	cert, err := reloader.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatalf("could not get client certificate: %s", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != rotated.Subject.CommonName {
+		t.Fatalf("client certificate wasn't reloaded, got [%s]", leaf.Subject.CommonName)
+	}
+
+	// a broken file keeps the last good certificate
+	ioutil.WriteFile(clientTls.CertificateFile, []byte("garbage"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(clientTls.CertificateFile, future, future)
+	if cert, err = reloader.GetClientCertificate(&tls.CertificateRequestInfo{}); err != nil || cert == nil {
+		t.Fatalf("broken certificate file wasn't tolerated: [%v] %s", cert, err)
+	}
+}
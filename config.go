@@ -17,7 +17,7 @@ type logConfig struct {
 	Location string `json:"location"`
 }
 
-// For server side tls configuration
+// A certificate and key, used for server side tls configuration and for client certificates
 type tlsConfig struct {
 	// Private key file
 	PrivateKeyFile string `json:"private_key_file"`
@@ -27,11 +27,21 @@ type tlsConfig struct {
 }
 
 type Configuration struct {
-	// how long to cool upstreams down for if they start throwing errors
+	// how long to cool upstreams down for if they start throwing errors, this doubles
+	// every time the upstream fails again in a row, see breaker.go
 	// cooling upstreams will only be used if no other options are available
 	// the 0-value equates to 500 ms
 	CooldownPeriod time.Duration `json:"cooldown_period"`
 
+	// the longest an upstream will be cooled for, in ms
+	// the 0-value equates to 60000 ms
+	MaxCooldownPeriod time.Duration `json:"max_cooldown_period"`
+
+	// how many queries to let through to an upstream at once once its cooldown is over,
+	// the upstream stays cooling for everything else until one of them succeeds
+	// the 0-value equates to 1
+	HalfOpenProbes int `json:"half_open_probes"`
+
 	// Whether or not to use TCP Fast Open (hint: this is an experimental protocol
 	// that slows the hell out of things when the upstream doesn't support it,
 	// the first packet is sent with a payload and if the server doesn't support that,
@@ -52,8 +62,50 @@ type Configuration struct {
 	// Location of zone files with local dns configuration
 	ZoneFiles []string `json:"zone_files"`
 
+	// Overrides for the locally-served and special-use zones (see localzones.go) that are answered
+	// without going upstream. Maps zones to "nxdomain", "loopback" or "forward", where
+	// "forward" sends the zone upstream like anything else.  Routing a domain to an upstream group
+	// only takes it out of a local zone if the routed domain is at least as specific as the zone.
+	LocalZones map[string]string `json:"local_zones"`
+
 	// List of upstreams, overrides resolv.conf
-	Upstreams []UpstreamName `json:"upstreams"`
+	// entries can be bare hostnames or full upstream objects, see UpstreamConfig
+	Upstreams []UpstreamConfig `json:"upstreams"`
+
+	// Plain DNS resolvers (ip or ip:port) to look up upstreams that are configured by hostname, see bootstrap.go
+	// the 0-value uses the system resolver, which may well be funkyd itself
+	BootstrapResolvers []string `json:"bootstrap_resolvers"`
+
+	// How often to look the upstreams back up with the bootstrap resolvers, in ms
+	// the 0-value equates to 300000 ms, negative values disable re-resolution
+	BootstrapInterval time.Duration `json:"bootstrap_interval"`
+
+	// Lets upstreams that are bootstrapped from resolvers alone fall back on the system resolver
+	// while the bootstrap resolvers haven't found any addresses for them, the 0-value fails those dials
+	BootstrapFallback bool `json:"bootstrap_fallback"`
+
+	// Additional groups of upstreams that handle specific domains, everything else
+	// goes to the upstreams above, which make up the default group
+	UpstreamGroups []UpstreamGroupConfig `json:"upstream_groups"`
+
+	// How to pick which upstream gets a query: "lowest_weight" (the default), "power_of_two",
+	// "round_robin" or "priority", see selector.go
+	UpstreamSelection string `json:"upstream_selection"`
+
+	// How much each new RTT counts toward an upstream's weight, between 0 and 1, higher
+	// values make weights follow the latest RTTs more closely
+	// the 0-value equates to 0.3
+	UpstreamRttSmoothing float64 `json:"upstream_rtt_smoothing"`
+
+	// How long it takes for an upstream's weight to decay halfway to the mean weight of its pool when it
+	// isn't getting traffic, in ms
+	// the 0-value equates to 60000 ms
+	UpstreamWeightHalfLife time.Duration `json:"upstream_weight_half_life"`
+
+	// How often to send a query to an upstream that isn't getting traffic to re-measure it, in ms,
+	// this only applies to lowest_weight selection since the other strategies spread traffic out anyway
+	// the 0-value equates to 30000 ms, negative values disable exploration
+	UpstreamExplorationInterval time.Duration `json:"upstream_exploration_interval"`
 
 	// Whether or not to blackhole all DNS traffic
 	Blackhole bool `json:"blackhole"`
@@ -61,9 +113,16 @@ type Configuration struct {
 	// Port to listen for DNS traffic on
 	DnsPort int `json:"dns_port"`
 
+	// Where to listen for DNS traffic, this applies to the blackhole server as well, see listeners.go
+	// the 0-value equates to every address on dns_port, over udp and tcp (or listen_protocol for the blackhole server)
+	Listeners []ListenerConfig `json:"listeners"`
+
 	// Port to expose admin API on
 	HttpPort int `json:"http_port"`
 
+	// Where to expose the admin API, the 0-value equates to every address on http_port
+	HttpListener ListenerConfig `json:"http_listener"`
+
 	// Force a maximum number of concurrent queries, 0 value will set this to GOMAXPROCS
 	ConcurrentQueries int `json:"concurrent_queries"`
 
@@ -73,7 +132,7 @@ type Configuration struct {
 	// Query logging
 	QueryLog logConfig `json:"query_log"`
 
-	// Which protocol to listen on
+	// Which protocol the blackhole server listens on when there are no listeners configured
 	ListenProtocol string `json:"listen_protocol"`
 
 	// Optional TLS config for using TLS inbound
@@ -82,8 +141,96 @@ type Configuration struct {
 	// skips cert verification, only use in testing pls
 	SkipUpstreamVerification bool `json:"skip_upstream_verification"`
 
-	// How many times to retry connections to upstream servers
+	// Client certificate to present to upstreams that want mutual TLS,
+	// upstreams can override this with their own. Reloaded when the files change
+	UpstreamClientTls tlsConfig `json:"upstream_client_tls"`
+
+	// Turns off TLS session resumption with upstreams.  Resumed sessions skip most of the handshake,
+	// but they let an upstream tie a client's connections back to each other
+	DisableTlsResumption bool `json:"disable_tls_resumption"`
+
+	// How many TLS sessions to remember for each upstream
+	// the 0-value equates to 8
+	TlsSessionCacheSize int `json:"tls_session_cache_size"`
+
+	// How long a pooled connection can sit unused before it's closed, in ms
+	// the 0-value equates to 10000 ms, negative values let connections idle forever
+	ConnectionIdleTimeout time.Duration `json:"connection_idle_timeout"`
+
+	// How long a connection can stay open before it's closed, in ms
+	// the 0-value means there is no limit
+	ConnectionMaxAge time.Duration `json:"connection_max_age"`
+
+	// How many queries a connection can carry before it's closed
+	// the 0-value means there is no limit
+	ConnectionMaxQueries int `json:"connection_max_queries"`
+
+	// Connections that have been idle for longer than this get checked before they're used, in ms
+	// the 0-value equates to 1000 ms, negative values disable the check
+	ConnectionCheckAfter time.Duration `json:"connection_check_after"`
+
+	// The most connections to keep open to a single upstream, including ones being dialed,
+	// queries wait for a connection once this is reached
+	// the 0-value means there is no limit
+	MaxConnectionsPerUpstream int `json:"max_connections_per_upstream"`
+
+	// The most connections to keep open across all the upstreams in a group
+	// the 0-value means there is no limit
+	MaxConnections int `json:"max_connections"`
+
+	// How many connections can be dialed to a single upstream at once, queries that come
+	// in while they're dialing wait for a connection to come back to the pool instead of
+	// setting up their own
+	// the 0-value means there is no limit
+	MaxConcurrentDials int `json:"max_concurrent_dials"`
+
+	// How many idle connections to keep open to each upstream, these are dialed at startup and
+	// topped up in the background whenever the pool drops below this, see warmer.go.  Connections
+	// that make up the minimum aren't closed for hitting the idle timeout, only for the other limits
+	// the 0-value keeps none, connections are only dialed when queries need them
+	MinIdleConnections int `json:"min_idle_connections"`
+
+	// Stops asking upstreams for their idle timeout with the EDNS TCP keepalive option, see keepalive.go,
+	// for upstreams that don't cope with it.  Connections to upstreams that send a timeout are closed before it runs out
+	DisableTcpKeepalive bool `json:"disable_tcp_keepalive"`
+
+	// How many queries can be in flight at once on a single upstream connection, see pipeline.go
+	// the 0-value disables pipelining, every connection carries one query at a time
+	PipelineQueries int `json:"pipeline_queries"`
+
+	// How long a query will wait for a connection when the limits above have been reached, in ms
+	// the 0-value equates to the dial timeout, or 500 ms if that isn't set either
+	ConnectionWaitTimeout time.Duration `json:"connection_wait_timeout"`
+
+	// If the upstream hasn't answered within this percentile (0-100) of its recent RTTs, the query is also
+	// sent to the next best upstream and whichever answer comes back first is used, see hedge.go
+	// the 0-value disables hedging
+	HedgePercentile float64 `json:"hedge_percentile"`
+
+	// The most hedges to send, as a fraction of the queries that could have been hedged
+	// the 0-value equates to 0.05
+	HedgeBudget float64 `json:"hedge_budget"`
+
+	// How many times to retry a query on upstream servers, each retry goes to an upstream
+	// the query hasn't been tried on yet, see retry.go
 	UpstreamRetries int `json:"upstream_retries"`
+
+	// How long to wait for in-flight queries to drain during shutdown, in ms
+	// the 0-value equates to 5000 ms
+	ShutdownTimeout time.Duration `json:"shutdown_timeout"`
+
+	// How often to send a canary query to each upstream in the background, in ms, failures
+	// cool the upstream and successes bring cooling upstreams back early
+	// the 0-value equates to 10000 ms, negative values disable probing
+	HealthProbeInterval time.Duration `json:"health_probe_interval"`
+
+	// Domain to look up when probing upstreams
+	// the 0-value will query the root zone's NS records
+	HealthProbeName string `json:"health_probe_name"`
+
+	// Domain to look up through the upstreams when checking readiness
+	// the 0-value will query the root zone's NS records
+	ReadinessCanary string `json:"readiness_canary"`
 }
 
 // this is a pointer so that tests can set variables easily
@@ -100,6 +247,10 @@ func InitConfiguration(configpath string) error {
 		return fmt.Errorf("error while loading configuration from JSON: %s\n", err)
 	}
 
+	if err := checkUpstreamConflicts(&configuration); err != nil {
+		return fmt.Errorf("invalid upstream configuration: %s", err)
+	}
+
 	configJSON, err := json.MarshalIndent(configuration, "", "    ")
 	if err != nil {
 		return fmt.Errorf("could not render configuration [%v] as JSON", configuration)
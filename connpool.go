@@ -3,9 +3,13 @@ package main
 // Pools connections to upstream servers, does high level lifecycle management and
 // prioritizes which upstreams get connections and which don't
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"net"
 	"sort"
 	"sync"
 	"time"
@@ -14,8 +18,14 @@ import (
 type ConnPool interface {
 	// Retrieves a new connection from the pool
 	// returns an upstream and a nil connentry if a new
-	// connection must be made
-	Get() (ce *ConnEntry, upstream Upstream, err error)
+	// connection must be made.  If the pool's limits don't allow
+	// that yet, this waits until they do or until the context is done.
+	// Upstreams with the excluded addresses won't be picked.
+	Get(ctx context.Context, exclude ...string) (ce *ConnEntry, upstream Upstream, err error)
+
+	// Waits until the pool's limits allow a new connection to a given upstream and reserves
+	// it, the caller then dials it with NewConnection.  This never hands out a pooled connection.
+	ReserveDial(ctx context.Context, upstream Upstream) (err error)
 
 	// Adds a new connection to the pool
 	Add(ce *ConnEntry) (err error)
@@ -38,6 +48,24 @@ type ConnPool interface {
 
 	// Returns the number of open connections in the pool
 	Size() int
+
+	// Closes every pooled connection, used when shutting down
+	CloseAll()
+
+	// Returns a copy of every upstream in the pool
+	Upstreams() []Upstream
+
+	// Closes pooled connections that have outlived the lifecycle policy, see lifecycle.go
+	Reap()
+
+	// Returns a percentile (0-100) of an upstream's recent RTTs, ok is false if there aren't enough to go on
+	RttPercentile(address string, percentile float64) (rtt time.Duration, ok bool)
+
+	// Returns a snapshot of how each upstream is doing, see stats.go
+	Stats() []UpstreamStats
+
+	// Dials connections until every healthy upstream has the minimum number of idle connections, see warmer.go
+	Warm(dialFunc func(address string) (*dns.Conn, error))
 }
 
 type connPool struct {
@@ -51,6 +79,30 @@ type connPool struct {
 
 	cache map[string][]*ConnEntry
 	lock  Lock
+
+	// The upstream group this pool serves
+	group string
+
+	// How long to cool upstreams for, in ms, the 0-value falls back to the global cooldown period
+	cooldownPeriod time.Duration
+
+	// Decides which upstream gets the next query
+	selector UpstreamSelector
+
+	// connections that are open, pooled or checked out, keyed by address
+	open map[string]int
+
+	// dials that Get has handed out but that haven't finished, keyed by address
+	dialing map[string]int
+
+	// closed and replaced whenever a connection or a dial slot frees up, to wake up waiting checkouts
+	changed chan struct{}
+
+	// how many checkouts are waiting
+	waiting int
+
+	// what the stats API reports on each upstream, keyed by address, see stats.go
+	stats map[string]*upstreamStats
 }
 
 type CachedConn interface {
@@ -72,6 +124,42 @@ type ConnEntry struct {
 
 	// whether this connection hit an error
 	error bool
+
+	// RTTs of the exchanges since the connection was last in the pool, these
+	// get folded into the upstream's weight when it comes back
+	rtts []time.Duration
+
+	// whether this is a health probe's connection, see prober.go
+	probe bool
+
+	// when the connection was made
+	created time.Time
+
+	// when the connection last went back into the pool
+	lastUsed time.Time
+
+	// how many queries the connection has carried
+	queries int
+
+	// set on checkouts of a pipelined connection, the connection itself stays in the
+	// pool so that other queries can share it, see pipeline.go
+	parent *ConnEntry
+
+	// how many checkouts a pipelined connection has out
+	checkouts int
+
+	// set when a pipelined connection has to be closed, but still has queries in flight
+	retiring string
+
+	// whether the connection has been closed
+	closed bool
+
+	// set when the upstream closed the connection while it was in the pool, see retry.go
+	stale bool
+
+	// the idle timeout the upstream sent for this connection, if it sent one, see keepalive.go
+	keepalive    time.Duration
+	hasKeepalive bool
 }
 
 type Lock struct {
@@ -91,6 +179,13 @@ func (c *ConnEntry) Error() bool {
 
 // Increment the internal counters tracking successful exchanges and durations
 func (c *ConnEntry) AddExchange(rtt time.Duration) {
+	c.addRtt(rtt)
+	c.rtts = append(c.rtts, rtt)
+	c.queries++
+}
+
+// counts time spent on the connection without it being an exchange for the upstream's weight
+func (c *ConnEntry) addRtt(rtt time.Duration) {
 	// TODO evaluate having multiple timeouts for dialing vs rtt'ing
 	RttTimeout := GetConfiguration().Timeout
 	if RttTimeout == 0 {
@@ -106,6 +201,12 @@ func (c *ConnEntry) AddExchange(rtt time.Duration) {
 	c.exchanges += 1
 }
 
+// whether the stream of a pipelined connection broke, see pipeline.go
+func (c *ConnEntry) streamBroken() bool {
+	pc, ok := c.Conn.(*pipelinedConn)
+	return !ok || pc.Err() != nil
+}
+
 func (c *ConnEntry) GetAddress() string {
 	return c.upstream.GetAddress()
 }
@@ -137,11 +238,96 @@ func (ce *ConnEntry) GetWeight() (weight UpstreamWeight) {
 }
 
 func NewConnPool() *connPool {
+	return NewGroupConnPool(DefaultUpstreamGroup, 0, &lowestWeightSelector{})
+}
+
+// builds a pool for a named upstream group with its own cooldown period (in ms) and selection strategy
+func NewGroupConnPool(group string, cooldownPeriod time.Duration, selector UpstreamSelector) *connPool {
 	return &connPool{
-		cache: make(map[string][]*ConnEntry),
+		cache:          make(map[string][]*ConnEntry),
+		group:          group,
+		cooldownPeriod: cooldownPeriod,
+		selector:       selector,
+		open:           make(map[string]int),
+		dialing:        make(map[string]int),
+		changed:        make(chan struct{}),
+		stats:          make(map[string]*upstreamStats),
 	}
 }
 
+type poolLimits struct {
+	// 0 means no limit for all of these
+	perUpstream int
+	total       int
+	dials       int
+}
+
+func connectionLimits() poolLimits {
+	config := GetConfiguration()
+	return poolLimits{
+		perUpstream: config.MaxConnectionsPerUpstream,
+		total:       config.MaxConnections,
+		dials:       config.MaxConcurrentDials,
+	}
+}
+
+// whether the limits allow another connection to a given address
+// non re-entrant, needs outside locking
+func (c *connPool) canDial(address string) bool {
+	limits := connectionLimits()
+	if limits.dials > 0 && c.dialing[address] >= limits.dials {
+		// there are already handshakes in flight, the connections they make will come back to the pool soon enough
+		return false
+	}
+
+	if limits.perUpstream > 0 && c.open[address]+c.dialing[address] >= limits.perUpstream {
+		return false
+	}
+
+	if limits.total > 0 {
+		total := 0
+		for _, open := range c.open {
+			total += open
+		}
+		for _, dialing := range c.dialing {
+			total += dialing
+		}
+		if total >= limits.total {
+			return false
+		}
+	}
+	return true
+}
+
+// wakes up everything waiting on a checkout so that it can try again
+// non re-entrant, needs outside locking
+func (c *connPool) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// records that a dial handed out by Get is over
+// non re-entrant, needs outside locking
+func (c *connPool) finishDial(address string, connected bool) {
+	// dials that didn't come from Get (like health probes) were never counted
+	if c.dialing[address] > 0 {
+		c.dialing[address]--
+	}
+	if connected {
+		c.open[address]++
+	}
+	c.notify()
+}
+
+// records that a connection has been closed
+// non re-entrant, needs outside locking
+func (c *connPool) releaseConnection(address string) {
+	if c.open[address] > 0 {
+		c.open[address]--
+	}
+	c.notify()
+}
+
 func (c *connPool) Lock() {
 	c.lock.Lock()
 }
@@ -164,57 +350,69 @@ func (c *connPool) getUpstreamByAddress(address string) (upstream *Upstream, err
 
 // WARNING: this function is not reentrant, it is meant to be called internally
 // when the connection pool is already locked and needs to update its upstream weights
-func (c *connPool) weightUpstream(upstream *Upstream, ce ConnEntry) {
-	// the upstream weight will be the result of the most recent connection:
-	// we want to prefer the upstream with the fastest connections and
-	// ditch them when they start to slow down
-	upstream.SetWeight(ce.GetWeight())
-
+func (c *connPool) weightUpstream(upstream *Upstream, ce *ConnEntry) {
+	// every exchange counts toward the upstream's moving average, so we
+	// prefer the upstream with the fastest exchanges and ditch it when it starts to slow down
+	for _, rtt := range ce.rtts {
+		upstream.AddSample(rtt)
+	}
+	if len(ce.rtts) > 0 {
+		c.statsFor(upstream.GetAddress()).AddExchanges(time.Now(), len(ce.rtts))
+		c.updateNeutralWeight()
+	}
+	ce.rtts = nil
 }
 
-// Will select the lowest weighted cached connection
-// falling back to the lowest weighted upstream if none exist
-// upstreams that are cooling will be ignored
-func (c *connPool) getBestUpstream() (upstream Upstream) {
-	// get the first upstream with connections, default to the 0th connection on the list
-	// iterate through in order; this list is sorted based on weight
-
-	var bestCandidate Upstream
-
-	// goal: find the highest lowest weighted upstream with connections
+// Idle upstreams decay toward the mean of the measured weights in the pool, so that they drift
+// back into contention instead of becoming the most attractive upstream in the pool.
+// non re-entrant, needs outside locking
+func (c *connPool) updateNeutralWeight() {
+	var total UpstreamWeight
+	measured := 0
 	for _, each := range c.upstreams {
-		if conns, ok := c.cache[each.GetAddress()]; ok {
-			// should this upstream be taking connections?
-			if !each.IsCooling() {
-				// it should. does it HAVE connections?
-				if len(conns) > 0 {
-					return *each
-				}
+		if each.GetSamples() > 0 {
+			total += each.weight
+			measured++
+		}
+	}
+	if measured == 0 {
+		return
+	}
+	for _, each := range c.upstreams {
+		each.SetNeutralWeight(total / UpstreamWeight(measured))
+	}
+}
 
-				// it's open, but it doesn't have existing connections, let's
-				// use it iff there's no existing connections
-				if (bestCandidate == Upstream{}) {
-					bestCandidate = *each
+// asks the selector which upstream should be used next
+// non re-entrant, needs outside locking
+func (c *connPool) getBestUpstream(exclude []string) (upstream *Upstream) {
+	upstreams := c.upstreams
+	if len(exclude) > 0 {
+		upstreams = make([]*Upstream, 0, len(c.upstreams))
+	Upstreams:
+		for _, u := range c.upstreams {
+			for _, address := range exclude {
+				if u.GetAddress() == address {
+					continue Upstreams
 				}
 			}
+			upstreams = append(upstreams, u)
 		}
 	}
-
-	// if we got here, there are no cached connections, did we find a candidate?
-	// the candidate will be the lowest weighted connection that wasn't cooling
-	if (bestCandidate != Upstream{}) {
-		return bestCandidate
-	}
-
-	// no cached connections, everything is cooling, let's abuse the lowest
-	// weighted upstream
-	return *c.upstreams[0]
+	return c.selector.Select(upstreams, func(u *Upstream) int {
+		return len(c.cache[u.GetAddress()])
+	})
 }
 
 // arranges the upstreams based on weight
 func (c *connPool) sortUpstreams() {
+	// the weights decay as time passes, take a snapshot so that the comparisons are consistent
+	weights := make(map[*Upstream]UpstreamWeight, len(c.upstreams))
+	for _, each := range c.upstreams {
+		weights[each] = each.GetBiasedWeight()
+	}
 	sort.Slice(c.upstreams, func(i, j int) bool {
-		return c.upstreams[i].GetWeight() < c.upstreams[j].GetWeight()
+		return weights[c.upstreams[i]] < weights[c.upstreams[j]]
 	})
 }
 
@@ -227,44 +425,59 @@ func (c *connPool) updateUpstream(ce *ConnEntry) (err error) {
 		return fmt.Errorf("could not update upstream with address [%s]: %s", address, err)
 	}
 
-	// we may need to update after a fresh connection errored out
-	// so ignore weightless connections
-	if ce.GetWeight() != 0 {
-		c.weightUpstream(upstream, *ce)
-	}
+	// if the probe made it through, the upstream is back in business, health
+	// probes are trusted to bring the upstream back before its cooldown is up
+	exchanged := len(ce.rtts) > 0
+	c.weightUpstream(upstream, ce)
 
-	errorString := "no"
-	if upstream.IsCooling() {
-		errorString = "cooling"
+	if ce.hasKeepalive {
+		upstream.SetKeepalive(ce.keepalive)
 	}
 
 	if ce.Error() {
+		c.statsFor(address).AddError(time.Now())
 		c.coolAndPurgeUpstream(upstream)
-		errorString += ", connection"
+	} else if exchanged && (ce.probe || upstream.BreakerState() == BreakerHalfOpen) {
+		upstream.CloseBreaker()
 	}
 
 	c.sortUpstreams()
+	for _, each := range c.upstreams {
+		// the scores of the other upstreams have been decaying in the meantime
+		UpstreamScoreGauge.WithLabelValues(each.GetAddress()).Set(float64(each.GetWeight()))
+	}
 
-	coolingString := "0"
-	if upstream.IsCooling() {
-		// Wake Up Time: wut :)
-		wut := upstream.WakeupTime()
-		coolingString = fmt.Sprintf(
-			"%d-%d-%d %d:%d:%d:%s",
-			wut.Year(),
-			wut.Month(),
-			wut.Day(),
-			wut.Hour(),
-			wut.Minute(),
-			wut.Second(),
-			time.Now().Sub(wut),
-		)
-	}
-
-	UpstreamWeightGauge.WithLabelValues(upstream.GetAddress(), errorString, coolingString).Set(float64(upstream.GetWeight()))
+	UpstreamWeightGauge.WithLabelValues(upstream.GetAddress()).Set(float64(upstream.GetBiasedWeight()))
 	return nil
 }
 
+// alerts an upstream sends when it doesn't like our client certificate
+var clientCertificateAlerts = map[string]bool{
+	"tls: bad certificate":               true,
+	"tls: unsupported certificate":       true,
+	"tls: certificate revoked":           true,
+	"tls: certificate expired":           true,
+	"tls: certificate unknown":           true,
+	"tls: unknown certificate authority": true,
+	"tls: access denied":                 true,
+	"tls: certificate required":          true,
+}
+
+// categorizes connection errors for the FailedConnectionsCounter
+func connectionFailureReason(err error) string {
+	var pinErr *SpkiPinError
+	if errors.As(err, &pinErr) {
+		return "spki_pin"
+	}
+
+	// the alert type in crypto/tls is private, this is the only way to get at it
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" && clientCertificateAlerts[opErr.Err.Error()] {
+		return "client_certificate_rejected"
+	}
+	return "dial"
+}
+
 // adds a connection to the cache
 func (c *connPool) Add(ce *ConnEntry) (err error) {
 	c.Lock()
@@ -275,6 +488,22 @@ func (c *connPool) Add(ce *ConnEntry) (err error) {
 		err = fmt.Errorf("couldn't update upstream weight on connection to [%s]: %s", address, err.Error())
 	}
 
+	now := time.Now()
+	if ce.parent != nil {
+		c.returnCheckout(ce, now)
+		return
+	}
+
+	reason := c.expired(ce, lifecyclePolicy(), now, len(c.cache[address])+1)
+	if ce.Error() {
+		reason = CloseReasonError
+	}
+	if reason != "" {
+		c.retireConnection(ce, reason)
+		return
+	}
+	ce.lastUsed = now
+
 	Logger.Log(NewLogMessage(
 		INFO,
 		LogContext{
@@ -290,8 +519,10 @@ func (c *connPool) Add(ce *ConnEntry) (err error) {
 		// the max is greater than zero and there's nothing here, so we can just insert
 		c.cache[address] = []*ConnEntry{ce}
 	}
+	// anything waiting on a checkout can have this one
+	c.notify()
 
-	ConnPoolSizeGauge.WithLabelValues(address).Set(float64(len(c.cache[address])))
+	ConnPoolSizeGauge.WithLabelValues(address, c.group).Set(float64(len(c.cache[address])))
 	return
 }
 
@@ -320,6 +551,8 @@ func (c *connPool) NewConnection(upstream Upstream, dialFunc func(address string
 		// errors! better cool this upstream
 		c.Lock()
 		defer c.Unlock()
+		c.finishDial(address, false)
+		c.statsFor(address).AddError(time.Now())
 
 		upstream, upstreamErr := c.getUpstreamByAddress(address)
 		if upstreamErr != nil {
@@ -329,47 +562,168 @@ func (c *connPool) NewConnection(upstream Upstream, dialFunc func(address string
 
 		c.coolAndPurgeUpstream(upstream)
 
-		FailedConnectionsCounter.WithLabelValues(address).Inc()
+		FailedConnectionsCounter.WithLabelValues(address, connectionFailureReason(err)).Inc()
 		return &ConnEntry{}, fmt.Errorf("cooling upstream, could not connect to [%s]: %s", address, err)
 	}
 
+	handshake := "none"
+	if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+		handshake = "full"
+		if tlsConn.ConnectionState().DidResume {
+			handshake = "resumed"
+		}
+		TLSHandshakesCounter.WithLabelValues(address, handshake).Inc()
+	}
+
 	Logger.Log(NewLogMessage(
 		INFO,
 		LogContext{
-			"what":    "connection successful",
-			"address": address,
+			"what":      "connection successful",
+			"address":   address,
+			"handshake": handshake,
 		},
 		nil,
 	))
 
-	ce = &ConnEntry{Conn: conn, upstream: upstream}
-	ce.AddExchange(dialDuration)
+	c.Lock()
+	c.finishDial(address, true)
+	c.statsFor(address).handshakes.Add(dialDuration)
+	c.Unlock()
+
+	var cached CachedConn = conn
+	if GetConfiguration().PipelineQueries > 0 {
+		cached = newPipelinedConn(conn, address, pipelineTimeout())
+	}
+
+	now := time.Now()
+	ce = &ConnEntry{Conn: cached, upstream: upstream, created: now, lastUsed: now}
+	// the handshake counts against the connection, but it isn't an exchange, so it stays out of the upstream's weight
+	ce.addRtt(dialDuration)
 	return ce, nil
 }
 
 // attempts to retrieve a connection from the most attractive upstream
-// if it doesn't have one, returns an upstream for the caller to connect to
-func (c *connPool) Get() (ce *ConnEntry, upstream Upstream, err error) {
-	c.Lock()
-	defer c.Unlock()
+// if it doesn't have one, returns an upstream for the caller to connect to,
+// waiting for the limits to allow that if need be
+func (c *connPool) Get(ctx context.Context, exclude ...string) (ce *ConnEntry, upstream Upstream, err error) {
+	err = c.waitFor(ctx, func() (ok bool, err error) {
+		ce, upstream, ok, err = c.checkout(exclude)
+		return ok, err
+	})
+	if err != nil {
+		return &ConnEntry{}, Upstream{}, err
+	}
+	return ce, upstream, nil
+}
 
-	upstream = c.getBestUpstream()
-	// now use the address for whichever one came out, the default one with no connections
-	// or the best weighted upstream with cached connections
+func (c *connPool) ReserveDial(ctx context.Context, upstream Upstream) error {
 	address := upstream.GetAddress()
+	return c.waitFor(ctx, func() (bool, error) {
+		if !c.canDial(address) {
+			return false, nil
+		}
+		c.dialing[address]++
+		return true, nil
+	})
+}
+
+// Runs try with the pool locked until it succeeds or fails, waiting for something in the
+// pool to change in between tries, for as long as the context allows
+func (c *connPool) waitFor(ctx context.Context, try func() (ok bool, err error)) (err error) {
+	var waitStart time.Time
+	for {
+		c.Lock()
+		ok, err := try()
+		if err != nil || ok {
+			c.Unlock()
+			if !waitStart.IsZero() {
+				ConnPoolWaitTimer.WithLabelValues(c.group).Observe(time.Since(waitStart).Seconds())
+			}
+			return err
+		}
+
+		// at the limit, wait for something to change
+		changed := c.changed
+		c.waiting++
+		ConnPoolWaitingGauge.WithLabelValues(c.group).Set(float64(c.waiting))
+		c.Unlock()
+		if waitStart.IsZero() {
+			waitStart = time.Now()
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			err = fmt.Errorf("gave up waiting for a connection in group [%s] after [%s]: %s", c.group, time.Since(waitStart), ctx.Err())
+		}
+
+		c.Lock()
+		c.waiting--
+		ConnPoolWaitingGauge.WithLabelValues(c.group).Set(float64(c.waiting))
+		c.Unlock()
+
+		if err != nil {
+			ConnPoolWaitTimer.WithLabelValues(c.group).Observe(time.Since(waitStart).Seconds())
+			ConnPoolWaitTimeoutsCounter.WithLabelValues(c.group).Inc()
+			return err
+		}
+	}
+}
 
-	// Check for an existing connection
-	if conns, ok := c.cache[address]; ok && len(conns) > 0 {
-		for i := 0; i < len(conns); i++ {
-			j := i + 1
-			// pop off a connection and return it
-			ce, c.cache[address] = conns[i], conns[j:]
-			ConnPoolSizeGauge.WithLabelValues(address).Set(float64(len(c.cache[address])))
-			return ce, Upstream{}, nil
+// Hands out a pooled connection, or an upstream to dial if the limits allow it.  ok will be false
+// if the caller needs to wait.
+// non re-entrant, needs outside locking
+func (c *connPool) checkout(exclude []string) (ce *ConnEntry, upstream Upstream, ok bool, err error) {
+	best := c.getBestUpstream(exclude)
+	if best == nil {
+		return &ConnEntry{}, Upstream{}, false, fmt.Errorf("no upstreams available in group [%s]", c.group)
+	}
+	// now use the address for whichever one came out, the default one with no connections
+	// or the best weighted upstream with cached connections
+	address := best.GetAddress()
+
+	// Check for an existing connection, skipping any that have gone stale in the pool
+	policy := lifecyclePolicy()
+	now := time.Now()
+	if limit := GetConfiguration().PipelineQueries; limit > 0 {
+		if ce = c.sharePipelined(address, limit, policy, now); ce != nil {
+			if best.BreakerState() == BreakerHalfOpen {
+				best.AddProbe()
+			}
+			return ce, Upstream{}, true, nil
+		}
+	}
+	for GetConfiguration().PipelineQueries <= 0 && len(c.cache[address]) > 0 {
+		// pop off a connection and return it
+		ce, c.cache[address] = c.cache[address][0], c.cache[address][1:]
+		ConnPoolSizeGauge.WithLabelValues(address, c.group).Set(float64(len(c.cache[address])))
+
+		reason := c.expired(ce, policy, now, len(c.cache[address])+1)
+		if reason == "" && policy.needsCheck(ce, now) {
+			if err := connAlive(ce.Conn); err != nil {
+				reason = CloseReasonDead
+			}
+		}
+		if reason != "" {
+			c.retireConnection(ce, reason)
+			continue
+		}
+		if best.BreakerState() == BreakerHalfOpen {
+			best.AddProbe()
 		}
+		return ce, Upstream{}, true, nil
 	}
+
+	if !c.canDial(address) {
+		return &ConnEntry{}, Upstream{}, false, nil
+	}
+
 	// we couldn't find a single connection, tell the caller to make a new one to the best weighted upstream
-	return &ConnEntry{}, upstream, nil
+	c.dialing[address]++
+	if best.BreakerState() == BreakerHalfOpen {
+		best.AddProbe()
+	}
+	return &ConnEntry{}, *best, true, nil
 }
 
 // since this reads all the maps, it needs to make sure there are no concurrent writes
@@ -386,27 +740,376 @@ func (c *connPool) Size() int {
 }
 
 func (c *connPool) AddUpstream(r *Upstream) {
+	// selectors that care about the configured order need to know this, the list itself gets sorted by weight
+	r.order = len(c.upstreams)
 	c.upstreams = append(c.upstreams, r)
 }
 
+func (c *connPool) RttPercentile(address string, percentile float64) (rtt time.Duration, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	upstream, err := c.getUpstreamByAddress(address)
+	if err != nil {
+		return 0, false
+	}
+	return upstream.RttPercentile(percentile)
+}
+
+// returns the stats for an upstream, starting them if there aren't any yet
+// non re-entrant, needs outside locking
+func (c *connPool) statsFor(address string) *upstreamStats {
+	stats, ok := c.stats[address]
+	if !ok {
+		stats = &upstreamStats{}
+		c.stats[address] = stats
+	}
+	return stats
+}
+
+func (c *connPool) Stats() []UpstreamStats {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	ret := make([]UpstreamStats, 0, len(c.upstreams))
+	for _, u := range c.upstreams {
+		address := u.GetAddress()
+		stats := c.statsFor(address)
+
+		idle, idleQueries := 0, 0
+		for _, ce := range c.cache[address] {
+			// pipelined connections stay in the pool while they're carrying queries
+			if ce.checkouts == 0 {
+				idle++
+				idleQueries += ce.queries
+			}
+		}
+
+		queriesPerConnection := 0.0
+		if connections := stats.closedConnections + idle; connections > 0 {
+			queriesPerConnection = float64(stats.closedQueries+idleQueries) / float64(connections)
+		}
+
+		ret = append(ret, UpstreamStats{
+			Group:            c.group,
+			Address:          address,
+			Weight:           u.GetBiasedWeight(),
+			Cooling:          u.IsCooling(),
+			Breaker:          u.BreakerState().String(),
+			ExchangeLatency:  newLatencyPercentiles(u.recentRtts),
+			HandshakeLatency: newLatencyPercentiles(stats.handshakes),
+			ErrorRates: ErrorRates{
+				OneMinute:      stats.ErrorRate(now, time.Minute),
+				FiveMinutes:    stats.ErrorRate(now, 5*time.Minute),
+				FifteenMinutes: stats.ErrorRate(now, 15*time.Minute),
+			},
+			OpenConnections:      c.open[address],
+			IdleConnections:      idle,
+			QueriesPerConnection: queriesPerConnection,
+		})
+	}
+	return ret
+}
+
+func (c *connPool) Upstreams() []Upstream {
+	c.Lock()
+	defer c.Unlock()
+	ret := make([]Upstream, 0, len(c.upstreams))
+	for _, u := range c.upstreams {
+		ret = append(ret, *u)
+	}
+	return ret
+}
+
 func (c *connPool) CloseConnection(ce *ConnEntry) {
+	reason := CloseReasonClosed
+	if ce.probe {
+		reason = CloseReasonProbe
+	} else if ce.stale {
+		reason = CloseReasonDead
+	} else if ce.Error() {
+		reason = CloseReasonError
+	}
+	c.closeConnection(ce, reason)
+}
+
+func (c *connPool) closeConnection(ce *ConnEntry, reason string) {
 	c.Lock()
 	defer c.Unlock()
 	c.updateUpstream(ce)
-	ce.Conn.Close()
+	c.retireConnection(ce, reason)
+}
+
+// Closes a connection that isn't going back into the pool, without holding up the caller.  Checkouts
+// of a pipelined connection only close the connection they share if the stream itself broke, a
+// single query timing out or getting a bad reply shouldn't fail every other query on the stream.
+// non re-entrant, needs outside locking
+func (c *connPool) retireConnection(ce *ConnEntry, reason string) {
+	if ce.parent != nil {
+		if !ce.parent.streamBroken() {
+			c.releaseCheckout(ce, time.Now())
+			return
+		}
+		ce.parent.checkouts--
+		ce = ce.parent
+		c.removeFromCache(ce)
+	} else if ce.checkouts > 0 {
+		// this one still has queries in flight, it gets closed when the last one comes back
+		ce.retiring = reason
+		return
+	}
+
+	if ce.closed {
+		return
+	}
+	ce.closed = true
+
+	address := ce.GetAddress()
+	Logger.Log(NewLogMessage(
+		INFO,
+		LogContext{
+			"what":    "closing connection",
+			"address": address,
+			"reason":  reason,
+		},
+		func() string { return fmt.Sprintf("connection entry [%v]", ce) },
+	))
+	go ce.Conn.Close()
+	c.releaseConnection(address)
+	stats := c.statsFor(address)
+	stats.closedConnections++
+	stats.closedQueries += ce.queries
+	ClosedConnectionsCounter.WithLabelValues(address, reason).Inc()
+}
+
+// Finds a pooled pipelined connection with room for another query and checks it out, the
+// connection itself stays in the pool so that other queries can share it
+// non re-entrant, needs outside locking
+func (c *connPool) sharePipelined(address string, limit int, policy connLifecycle, now time.Time) (shared *ConnEntry) {
+	kept := make([]*ConnEntry, 0, len(c.cache[address]))
+	for _, ce := range c.cache[address] {
+		pc, ok := ce.Conn.(*pipelinedConn)
+		if !ok {
+			// left over from before pipelining was turned on, the reaper will get it
+			kept = append(kept, ce)
+			continue
+		}
+
+		reason := c.expired(ce, policy, now, len(c.cache[address]))
+		if pc.Err() != nil {
+			reason = CloseReasonDead
+		}
+		if reason != "" {
+			c.retireConnection(ce, reason)
+			continue
+		}
+
+		kept = append(kept, ce)
+		if shared == nil && ce.checkouts < limit {
+			ce.checkouts++
+			ce.lastUsed = now
+			shared = &ConnEntry{Conn: pc, upstream: ce.upstream, parent: ce, created: ce.created, lastUsed: now}
+		}
+	}
+	c.cache[address] = kept
+	ConnPoolSizeGauge.WithLabelValues(address, c.group).Set(float64(len(kept)))
+	return shared
+}
+
+// Puts a checkout of a pipelined connection back, the connection itself never left the pool
+// non re-entrant, needs outside locking
+func (c *connPool) returnCheckout(ce *ConnEntry, now time.Time) {
+	if ce.parent.streamBroken() {
+		c.retireConnection(ce, CloseReasonDead)
+		return
+	}
+	c.releaseCheckout(ce, now)
+}
+
+// Gives up a checkout of a pipelined connection whose stream is still good, the connection
+// stays in the pool for the other queries
+// non re-entrant, needs outside locking
+func (c *connPool) releaseCheckout(ce *ConnEntry, now time.Time) {
+	parent := ce.parent
+	parent.checkouts--
+	parent.queries += ce.queries
+	parent.lastUsed = now
+	if ce.hasKeepalive {
+		parent.keepalive, parent.hasKeepalive = ce.keepalive, true
+	}
+	if parent.retiring != "" {
+		// already out of the pool, waiting on its last queries
+		if parent.checkouts == 0 {
+			c.retireConnection(parent, parent.retiring)
+		}
+	} else if reason := c.expired(parent, lifecyclePolicy(), now, len(c.cache[parent.GetAddress()])); reason != "" {
+		c.removeFromCache(parent)
+		c.retireConnection(parent, reason)
+	}
+	// there's room on the connection again
+	c.notify()
+}
+
+// takes a connection out of the pool, if it's still in there
+// non re-entrant, needs outside locking
+func (c *connPool) removeFromCache(ce *ConnEntry) {
+	address := ce.GetAddress()
+	for i, each := range c.cache[address] {
+		if each == ce {
+			c.cache[address] = append(c.cache[address][:i:i], c.cache[address][i+1:]...)
+			ConnPoolSizeGauge.WithLabelValues(address, c.group).Set(float64(len(c.cache[address])))
+			return
+		}
+	}
+}
+
+// Connections that keep an upstream at min_idle_connections don't get closed for sitting idle, the
+// warmer would only dial replacements for them.  They still go once they're too old or have carried
+// too many queries.  pooled is how many connections to the upstream the pool holds, this one included.
+// non re-entrant, needs outside locking
+func (c *connPool) expired(ce *ConnEntry, policy connLifecycle, now time.Time, pooled int) string {
+	reason := policy.expired(ce, now)
+	if reason == CloseReasonIdle && pooled <= GetConfiguration().MinIdleConnections {
+		reason = policy.withoutIdleTimeout().expired(ce, now)
+	}
+	return reason
+}
+
+func (c *connPool) Reap() {
+	c.Lock()
+	defer c.Unlock()
+	policy := lifecyclePolicy()
+	now := time.Now()
+	for addr, conns := range c.cache {
+		// idle connections only go if the ones that aren't idle already make up the minimum
+		fresh := 0
+		for _, ce := range conns {
+			if policy.expired(ce, now) == "" {
+				fresh++
+			}
+		}
+
+		kept := make([]*ConnEntry, 0, len(conns))
+		for _, ce := range conns {
+			if reason := c.expired(ce, policy, now, len(kept)+fresh+1); reason != "" {
+				c.retireConnection(ce, reason)
+				continue
+			}
+			if policy.expired(ce, now) == "" {
+				fresh--
+			}
+			kept = append(kept, ce)
+		}
+		c.cache[addr] = kept
+		ConnPoolSizeGauge.WithLabelValues(addr, c.group).Set(float64(len(kept)))
+	}
+}
+
+func (c *connPool) Warm(dialFunc func(address string) (*dns.Conn, error)) {
+	minIdle := GetConfiguration().MinIdleConnections
+	if minIdle <= 0 {
+		return
+	}
+
+	// work out what's missing and reserve the dials so that checkouts count them against the limits
+	c.Lock()
+	var dials []Upstream
+	for _, upstream := range c.upstreams {
+		// no sense dialing something that's cooling, or taking the probes a half-open breaker is waiting on
+		if upstream.BreakerState() != BreakerClosed {
+			continue
+		}
+		address := upstream.GetAddress()
+		for missing := minIdle - len(c.cache[address]) - c.dialing[address]; missing > 0 && c.canDial(address); missing-- {
+			c.dialing[address]++
+			dials = append(dials, *upstream)
+		}
+	}
+	c.Unlock()
+
+	var wg sync.WaitGroup
+	for _, upstream := range dials {
+		wg.Add(1)
+		go func(upstream Upstream) {
+			defer wg.Done()
+			ce, err := c.NewConnection(upstream, dialFunc)
+			if err != nil {
+				Logger.Log(NewLogMessage(
+					WARNING,
+					LogContext{
+						"what":    "could not warm connection",
+						"address": upstream.GetAddress(),
+						"error":   err.Error(),
+					},
+					nil,
+				))
+				return
+			}
+			WarmedConnectionsCounter.WithLabelValues(upstream.GetAddress(), c.group).Inc()
+
+			c.Lock()
+			if u, err := c.getUpstreamByAddress(upstream.GetAddress()); err == nil && u.GetSamples() == 0 {
+				// nothing to go on yet, the handshake is better than nothing
+				u.AddSample(ce.totalRTT)
+			}
+			c.Unlock()
+			c.Add(ce)
+		}(upstream)
+	}
+	wg.Wait()
+}
+
+// closes all pooled connections synchronously, unlike purgeUpstream, since
+// the caller is tearing the pool down and wants the connections gone before it moves on
+func (c *connPool) CloseAll() {
+	c.Lock()
+	defer c.Unlock()
+	for addr, conns := range c.cache {
+		for _, ce := range conns {
+			if ce.closed {
+				continue
+			}
+			ce.closed = true
+			c.releaseConnection(addr)
+			ClosedConnectionsCounter.WithLabelValues(addr, CloseReasonShutdown).Inc()
+			if err := ce.Conn.Close(); err != nil {
+				Logger.Log(NewLogMessage(
+					WARNING,
+					LogContext{
+						"what":    "error closing pooled connection",
+						"address": addr,
+						"error":   err.Error(),
+					},
+					nil,
+				))
+			}
+		}
+		c.cache[addr] = []*ConnEntry{}
+		ConnPoolSizeGauge.WithLabelValues(addr, c.group).Set(0)
+	}
 }
 
 // take an upstream pointer (so that we can update the actual record)
-// and tell it to cool down, sever all connections
+// and trip its breaker, sever all connections
 // non re-entrant, needs outside locking
 func (c *connPool) coolAndPurgeUpstream(upstream *Upstream) {
 	config := GetConfiguration()
 	cooldownPeriod := time.Duration(500) * time.Millisecond
-	if config.CooldownPeriod != 0 {
+	if c.cooldownPeriod != 0 {
+		cooldownPeriod = c.cooldownPeriod * time.Millisecond
+	} else if config.CooldownPeriod != 0 {
 		cooldownPeriod = config.CooldownPeriod * time.Millisecond
 	}
 
-	upstream.Cooldown(cooldownPeriod)
+	maxCooldownPeriod := time.Duration(60000) * time.Millisecond
+	if config.MaxCooldownPeriod != 0 {
+		maxCooldownPeriod = config.MaxCooldownPeriod * time.Millisecond
+	}
+	// the breaker can't open for less than the base period, whatever the cap says
+	if maxCooldownPeriod < cooldownPeriod {
+		maxCooldownPeriod = cooldownPeriod
+	}
+
+	upstream.Trip(cooldownPeriod, maxCooldownPeriod)
 
 	c.purgeUpstream(*upstream)
 }
@@ -419,10 +1122,10 @@ func (c *connPool) purgeUpstream(upstream Upstream) {
 		for _, conn := range c.cache[addr] {
 			// run async so as not to block queries that might be calling
 			go func(conn *ConnEntry) {
-				c.CloseConnection(conn)
+				c.closeConnection(conn, CloseReasonPurged)
 			}(conn)
 		}
 		c.cache[addr] = []*ConnEntry{}
 	}
-	ConnPoolSizeGauge.WithLabelValues(addr).Set(float64(len(c.cache[addr])))
+	ConnPoolSizeGauge.WithLabelValues(addr, c.group).Set(float64(len(c.cache[addr])))
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
 	"net"
@@ -22,7 +23,7 @@ func buildPool() ConnPool {
 func TestConnectionPoolSingleEntry(t *testing.T) {
 	pool := buildPool()
 	var upstream Upstream
-	x, upstream, err := pool.Get()
+	x, upstream, err := pool.Get(context.Background())
 	if (upstream == Upstream{}) {
 		t.Fatalf("could not retrieve upstream to connect to: [%v] [%v] [%s]", x, upstream, err)
 	}
@@ -46,7 +47,7 @@ func TestConnectionPoolSingleEntry(t *testing.T) {
 		t.Errorf("pool [%v] had incorrect size [%d] after adding ce [%v], expected %d", pool, size, ce, 1)
 	}
 
-	ce1, upstream, err := pool.Get()
+	ce1, upstream, err := pool.Get(context.Background())
 	if err != nil {
 		t.Fatalf("failed to retrieve new connection from pool [%v]", pool)
 	}
@@ -103,7 +104,7 @@ func TestConnectionPoolMultipleAddresses(t *testing.T) {
 	}
 
 	for i := 0; i < max; i++ {
-		ce, upstream, err := pool.Get()
+		ce, upstream, err := pool.Get(context.Background())
 		if err != nil {
 			t.Fatalf("error retrieving entry [%d] from pool [%v]: [%s]", i, pool, err)
 		}
@@ -176,7 +177,7 @@ func TestConnectionPoolWeighting(t *testing.T) {
 
 	// Once a connection is in the pool, does it get returned or does the pool prompt for additional connections?
 	// this also tests that lower weighted resolvers don't take precedence over ones with connections
-	ce2, upstream2, err := pool.Get()
+	ce2, upstream2, err := pool.Get(context.Background())
 	if (upstream2 != Upstream{}) {
 		t.Fatalf("expected to receive cached connection, got prompted to connect to [%v] instead", upstream2)
 	}
@@ -208,12 +209,474 @@ func TestConnectionPoolAddSlowConnection(t *testing.T) {
 		t.Fatalf("got error trying to add ce [%v] to pool [%v]: %s", ce, pool, err.Error())
 	}
 
-	ce2, u, _ := pool.Get()
+	ce2, u, _ := pool.Get(context.Background())
 	if u.Name != upstream.Name {
 		t.Fatalf("expected slow connection to have been closed! [%v] [%v]", u, ce2)
 	}
 }
 
+var selectionStrategies = []string{LowestWeightSelection, PowerOfTwoSelection, RoundRobinSelection, PrioritySelection}
+
+// builds a pool using a given strategy with max upstreams, named in the order they were added
+func buildSelectorPool(t *testing.T, strategy string, max int) (*connPool, []*Upstream) {
+	selector, err := NewUpstreamSelector(strategy)
+	if err != nil {
+		t.Fatalf("could not build selector [%s]: %s", strategy, err)
+	}
+	pool := NewGroupConnPool(DefaultUpstreamGroup, 0, selector)
+	upstreams := []*Upstream{}
+	for i := 0; i < max; i++ {
+		upstream := &Upstream{Name: UpstreamName(fmt.Sprintf("%d.example.com", i))}
+		pool.AddUpstream(upstream)
+		upstreams = append(upstreams, upstream)
+	}
+	return pool, upstreams
+}
+
+func TestSelectorsReuseConnections(t *testing.T) {
+	for _, strategy := range selectionStrategies {
+		pool, _ := buildSelectorPool(t, strategy, 1)
+		_, upstream, err := pool.Get(context.Background())
+		if err != nil || (upstream == Upstream{}) {
+			t.Fatalf("[%s] could not retrieve upstream to connect to: [%v] %s", strategy, upstream, err)
+		}
+
+		ce, err := pool.NewConnection(upstream, UpstreamTestingDialer(upstream))
+		if err != nil {
+			t.Fatalf("[%s] could not make connection to upstream [%v]: %s", strategy, upstream, err)
+		}
+		if err := pool.Add(ce); err != nil {
+			t.Fatalf("[%s] failed to add connection entry [%v] to pool: %s", strategy, ce, err)
+		}
+
+		if _, upstream, err = pool.Get(context.Background()); err != nil || (upstream != Upstream{}) {
+			t.Fatalf("[%s] expected to receive cached connection, got prompted to connect to [%v] instead: %v", strategy, upstream, err)
+		}
+	}
+}
+
+func TestSelectorsSkipCoolingUpstreams(t *testing.T) {
+	for _, strategy := range selectionStrategies {
+		pool, upstreams := buildSelectorPool(t, strategy, 3)
+		upstreams[0].Cooldown(time.Hour)
+		upstreams[1].Cooldown(time.Hour)
+		for i := 0; i < 100; i++ {
+			_, upstream, err := pool.Get(context.Background())
+			if err != nil {
+				t.Fatalf("[%s] could not get upstream: %s", strategy, err)
+			}
+			if upstream.Name != upstreams[2].Name {
+				t.Fatalf("[%s] got cooling upstream [%v] when [%v] was available", strategy, upstream, upstreams[2])
+			}
+		}
+	}
+}
+
+func TestSelectorsAllCooling(t *testing.T) {
+	for _, strategy := range selectionStrategies {
+		pool, upstreams := buildSelectorPool(t, strategy, 3)
+		for _, upstream := range upstreams {
+			upstream.Cooldown(time.Hour)
+		}
+		if _, upstream, err := pool.Get(context.Background()); err != nil || (upstream == Upstream{}) {
+			t.Fatalf("[%s] everything cooling should still produce an upstream, got [%v]: %v", strategy, upstream, err)
+		}
+	}
+}
+
+func TestSelectorsEmptyPool(t *testing.T) {
+	for _, strategy := range selectionStrategies {
+		pool, _ := buildSelectorPool(t, strategy, 0)
+		if _, upstream, err := pool.Get(context.Background()); err == nil {
+			t.Fatalf("[%s] empty pool produced upstream [%v]", strategy, upstream)
+		}
+	}
+}
+
+func TestRoundRobinSelection(t *testing.T) {
+	pool, upstreams := buildSelectorPool(t, RoundRobinSelection, 3)
+	// the weights shouldn't change the rotation
+	upstreams[2].SetWeight(100)
+	pool.sortUpstreams()
+
+	seen := make(map[UpstreamName]int)
+	for i := 0; i < 30; i++ {
+		_, upstream, err := pool.Get(context.Background())
+		if err != nil {
+			t.Fatalf("could not get upstream: %s", err)
+		}
+		if expected := upstreams[i%3].Name; upstream.Name != expected {
+			t.Fatalf("round robin went out of order on selection [%d]: got [%s], expected [%s]", i, upstream.Name, expected)
+		}
+		seen[upstream.Name]++
+	}
+
+	for _, upstream := range upstreams {
+		if seen[upstream.Name] != 10 {
+			t.Fatalf("traffic wasn't spread evenly: [%v]", seen)
+		}
+	}
+}
+
+func TestPrioritySelection(t *testing.T) {
+	pool, upstreams := buildSelectorPool(t, PrioritySelection, 3)
+	// the last upstream is the fastest, but it's last in line
+	upstreams[0].SetWeight(100)
+	upstreams[1].SetWeight(50)
+	pool.sortUpstreams()
+
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != upstreams[0].Name {
+		t.Fatalf("expected the first configured upstream, got [%v]", upstream)
+	}
+
+	upstreams[0].Cooldown(time.Hour)
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != upstreams[1].Name {
+		t.Fatalf("expected failover to the second configured upstream, got [%v]", upstream)
+	}
+
+	for _, upstream := range upstreams {
+		upstream.Cooldown(time.Hour)
+	}
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != upstreams[0].Name {
+		t.Fatalf("expected the first configured upstream when everything is cooling, got [%v]", upstream)
+	}
+}
+
+func TestPowerOfTwoSelection(t *testing.T) {
+	pool, upstreams := buildSelectorPool(t, PowerOfTwoSelection, 3)
+	upstreams[0].SetWeight(1)
+	upstreams[1].SetWeight(2)
+	upstreams[2].SetWeight(100)
+	pool.sortUpstreams()
+
+	seen := make(map[UpstreamName]int)
+	for i := 0; i < 300; i++ {
+		_, upstream, err := pool.Get(context.Background())
+		if err != nil {
+			t.Fatalf("could not get upstream: %s", err)
+		}
+		seen[upstream.Name]++
+	}
+
+	// the heaviest upstream loses every comparison it's in
+	if seen[upstreams[2].Name] != 0 {
+		t.Fatalf("heaviest upstream was selected: [%v]", seen)
+	}
+
+	// but the second best still gets sampled, unlike with lowest_weight
+	if seen[upstreams[1].Name] == 0 {
+		t.Fatalf("second best upstream was never selected: [%v]", seen)
+	}
+}
+
+func TestUnknownSelectionStrategy(t *testing.T) {
+	if _, err := NewUpstreamSelector("bogus"); err == nil {
+		t.Fatalf("unknown selection strategy was accepted")
+	}
+}
+
+func TestConnectionPoolExchangeWeighting(t *testing.T) {
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	ce, err := pool.NewConnection(*upstream, UpstreamTestingDialer(*upstream))
+	if err != nil {
+		t.Fatalf("could not make connection with upstream [%v]: %s", upstream, err)
+	}
+	ce.AddExchange(10 * time.Millisecond)
+	ce.AddExchange(20 * time.Millisecond)
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("got error trying to add ce [%v] to pool [%v]: %s", ce, pool, err.Error())
+	}
+
+	// the dial shouldn't be counted, only the exchanges
+	if upstream.GetSamples() != 2 {
+		t.Fatalf("expected 2 samples on upstream, got [%d]", upstream.GetSamples())
+	}
+
+	// returning the same connection again shouldn't count the exchanges twice
+	ce, _, _ = pool.Get(context.Background())
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("got error trying to add ce [%v] to pool [%v]: %s", ce, pool, err.Error())
+	}
+	if upstream.GetSamples() != 2 {
+		t.Fatalf("exchanges were counted more than once: [%d] samples", upstream.GetSamples())
+	}
+}
+
+func TestLowestWeightExploration(t *testing.T) {
+	pool := NewGroupConnPool(DefaultUpstreamGroup, 0, &lowestWeightSelector{explorationInterval: time.Hour})
+	fast, slow := &Upstream{Name: "fast.example.com"}, &Upstream{Name: "slow.example.com"}
+	pool.AddUpstream(fast)
+	pool.AddUpstream(slow)
+	fast.AddSample(time.Millisecond)
+	slow.AddSample(time.Second)
+	pool.sortUpstreams()
+
+	// both have fresh samples, nothing to explore
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != fast.Name {
+		t.Fatalf("expected fast upstream, got [%v]", upstream)
+	}
+
+	// the slow one has gone stale, it gets a single query
+	slow.lastSample = time.Now().Add(-2 * time.Hour)
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != slow.Name {
+		t.Fatalf("expected stale upstream to be explored, got [%v]", upstream)
+	}
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != fast.Name {
+		t.Fatalf("stale upstream was explored twice in one interval, got [%v]", upstream)
+	}
+}
+
+func TestConnectionPoolBreakerProbes(t *testing.T) {
+	pool := NewConnPool()
+	broken, backup := &Upstream{Name: "broken.example.com"}, &Upstream{Name: "backup.example.com"}
+	pool.AddUpstream(broken)
+	pool.AddUpstream(backup)
+	backup.SetWeight(100)
+	broken.Trip(time.Second, time.Hour)
+	expireBreaker(broken)
+
+	// the first query is a probe, everything else has to wait for it
+	_, upstream, _ := pool.Get(context.Background())
+	if upstream.Name != broken.Name {
+		t.Fatalf("expected half-open upstream to get a probe, got [%v]", upstream)
+	}
+	if _, upstream, _ := pool.Get(context.Background()); upstream.Name != backup.Name {
+		t.Fatalf("expected traffic to avoid the upstream while the probe is out, got [%v]", upstream)
+	}
+
+	// the probe fails, the breaker opens for longer
+	ce, err := pool.NewConnection(upstream, UpstreamTestingDialer(upstream))
+	if err != nil {
+		t.Fatalf("could not make connection to upstream [%v]: %s", upstream, err)
+	}
+	ce.AddError()
+	pool.CloseConnection(ce)
+	if broken.BreakerState() != BreakerOpen || broken.trips != 2 {
+		t.Fatalf("failed probe should have reopened the breaker: [%s], [%d] trips", broken.BreakerState(), broken.trips)
+	}
+
+	// this time the probe works out
+	expireBreaker(broken)
+	_, upstream, _ = pool.Get(context.Background())
+	ce, err = pool.NewConnection(upstream, UpstreamTestingDialer(upstream))
+	if err != nil {
+		t.Fatalf("could not make connection to upstream [%v]: %s", upstream, err)
+	}
+	ce.AddExchange(time.Millisecond)
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("could not add connection [%v] to pool: %s", ce, err)
+	}
+	if broken.BreakerState() != BreakerClosed || broken.trips != 0 {
+		t.Fatalf("successful probe should have closed the breaker: [%s], [%d] trips", broken.BreakerState(), broken.trips)
+	}
+}
+
+// makes a pooled connection whose other end stays open until the test is over
+func addLiveConnection(t *testing.T, pool *connPool, upstream *Upstream) (*ConnEntry, net.Conn) {
+	server, client := net.Pipe()
+	ce, err := pool.NewConnection(*upstream, func(addr string) (*dns.Conn, error) {
+		return &dns.Conn{Conn: client}, nil
+	})
+	if err != nil {
+		t.Fatalf("could not make connection to upstream [%v]: %s", upstream, err)
+	}
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("could not add connection [%v] to pool: %s", ce, err)
+	}
+	return ce, server
+}
+
+func TestConnectionPoolReap(t *testing.T) {
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	stale, server := addLiveConnection(t, pool, upstream)
+	defer server.Close()
+	_, server1 := addLiveConnection(t, pool, upstream)
+	defer server1.Close()
+	stale.lastUsed = time.Now().Add(-time.Hour)
+
+	pool.Reap()
+	if pool.Size() != 1 {
+		t.Fatalf("expected the idle connection to be reaped, pool has [%d] connections", pool.Size())
+	}
+}
+
+func TestConnectionPoolCheckout(t *testing.T) {
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	// a connection that the upstream closed behind our back
+	ce, server := addLiveConnection(t, pool, upstream)
+	server.Close()
+	ce.lastUsed = time.Now().Add(-5 * time.Second)
+
+	if _, u, err := pool.Get(context.Background()); err != nil || u.Name != upstream.Name {
+		t.Fatalf("expected to be prompted for a new connection instead of getting a dead one, got [%v]: %v", u, err)
+	}
+
+	if upstream.IsCooling() {
+		t.Fatalf("upstream was cooled because of a connection that went stale in the pool")
+	}
+}
+
+func TestConnectionPoolMaxQueries(t *testing.T) {
+	config := GetConfiguration()
+	config.ConnectionMaxQueries = 2
+	defer func() { config.ConnectionMaxQueries = 0 }()
+
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+	ce, server := addLiveConnection(t, pool, upstream)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		ce, _, _ = pool.Get(context.Background())
+		ce.AddExchange(time.Millisecond)
+		if err := pool.Add(ce); err != nil {
+			t.Fatalf("could not add connection [%v] to pool: %s", ce, err)
+		}
+	}
+
+	if pool.Size() != 0 {
+		t.Fatalf("connection that carried the maximum number of queries went back into the pool")
+	}
+}
+
+// runs a checkout in the background so that the test can unblock it
+func getAsync(pool ConnPool, timeout time.Duration) chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		ce, upstream, err := pool.Get(ctx)
+		if err == nil && ce.Conn == nil && (upstream == Upstream{}) {
+			err = fmt.Errorf("got neither a connection nor an upstream")
+		}
+		result <- err
+	}()
+	return result
+}
+
+func waitingCheckouts(pool *connPool) int {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.waiting
+}
+
+func TestConnectionPoolUpstreamLimit(t *testing.T) {
+	config := GetConfiguration()
+	config.MaxConnectionsPerUpstream = 1
+	defer func() { config.MaxConnectionsPerUpstream = 0 }()
+
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	_, u, err := pool.Get(context.Background())
+	if err != nil || u.Name != upstream.Name {
+		t.Fatalf("expected to be prompted for a connection, got [%v]: %v", u, err)
+	}
+	ce, err := pool.NewConnection(u, UpstreamTestingDialer(u))
+	if err != nil {
+		t.Fatalf("could not make connection to upstream [%v]: %s", u, err)
+	}
+
+	// the only connection is checked out, so there's nothing to do but wait
+	if err := <-getAsync(pool, 50*time.Millisecond); err == nil {
+		t.Fatalf("checkout went through with the pool at its limit")
+	}
+
+	// it gets handed over once it comes back
+	result := getAsync(pool, time.Second)
+	WaitForCondition(10, func() bool { return waitingCheckouts(pool) == 1 })
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("could not add connection [%v] to pool: %s", ce, err)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("waiting checkout didn't get the returned connection: %s", err)
+	}
+}
+
+func TestConnectionPoolTotalLimit(t *testing.T) {
+	config := GetConfiguration()
+	config.MaxConnections = 1
+	defer func() { config.MaxConnections = 0 }()
+
+	pool := NewConnPool()
+	upstream, upstream1 := &Upstream{Name: "example.com"}, &Upstream{Name: "test.example.com"}
+	pool.AddUpstream(upstream)
+	pool.AddUpstream(upstream1)
+
+	_, u, _ := pool.Get(context.Background())
+	ce, err := pool.NewConnection(u, UpstreamTestingDialer(u))
+	if err != nil {
+		t.Fatalf("could not make connection to upstream [%v]: %s", u, err)
+	}
+
+	// the other upstream has room of its own, but the pool doesn't
+	upstream1.SetWeight(-1)
+	pool.sortUpstreams()
+	if err := <-getAsync(pool, 50*time.Millisecond); err == nil {
+		t.Fatalf("checkout went through with the pool at its limit")
+	}
+
+	// closing the connection frees up room
+	result := getAsync(pool, time.Second)
+	WaitForCondition(10, func() bool { return waitingCheckouts(pool) == 1 })
+	pool.CloseConnection(ce)
+	if err := <-result; err != nil {
+		t.Fatalf("waiting checkout didn't go through after a connection was closed: %s", err)
+	}
+}
+
+func TestConnectionPoolDialCoalescing(t *testing.T) {
+	config := GetConfiguration()
+	config.MaxConcurrentDials = 1
+	defer func() { config.MaxConcurrentDials = 0 }()
+
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	dialed := 0
+	dialer := func(addr string) (*dns.Conn, error) {
+		dialed++
+		return UpstreamTestingDialer(*upstream)(addr)
+	}
+
+	// one dial goes out, the rest of the burst waits on it
+	_, u, _ := pool.Get(context.Background())
+	for i := 0; i < 5; i++ {
+		getAsync(pool, time.Second)
+	}
+	if !WaitForCondition(10, func() bool { return waitingCheckouts(pool) == 5 }) {
+		t.Fatalf("expected the burst to wait on the dial, [%d] checkouts are waiting", waitingCheckouts(pool))
+	}
+
+	ce, err := pool.NewConnection(u, dialer)
+	if err != nil {
+		t.Fatalf("could not make connection to upstream [%v]: %s", u, err)
+	}
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("could not add connection [%v] to pool: %s", ce, err)
+	}
+
+	// one of them reuses the new connection, the next gets to dial and the rest keep waiting
+	if !WaitForCondition(10, func() bool { return waitingCheckouts(pool) == 3 }) {
+		t.Fatalf("expected 3 checkouts to still be waiting, got [%d]", waitingCheckouts(pool))
+	}
+	if dialed != 1 {
+		t.Fatalf("expected a single handshake, got [%d]", dialed)
+	}
+}
+
 /** BENCHMARKS **/
 
 func BenchmarkConnectionParallel(b *testing.B) {
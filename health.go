@@ -0,0 +1,144 @@
+package main
+
+// Liveness and readiness checks for the admin API
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sort"
+	"time"
+)
+
+// The result of a single readiness check
+type HealthCheck struct {
+	// What was checked
+	Name string `json:"name"`
+
+	// Whether the check passed
+	Ok bool `json:"ok"`
+
+	// Human readable explanation of the result
+	Message string `json:"message"`
+}
+
+// The full set of readiness checks
+type HealthReport struct {
+	// true iff every check passed
+	Ready bool `json:"ready"`
+
+	Checks []HealthCheck `json:"checks"`
+}
+
+// fails if there's nothing in a group's pool that will take connections
+func checkUpstreams(group string, pool ConnPool) HealthCheck {
+	check := HealthCheck{Name: fmt.Sprintf("upstreams [%s]", group)}
+	upstreams := pool.Upstreams()
+	if len(upstreams) == 0 {
+		check.Message = "no upstreams configured"
+		return check
+	}
+
+	cooling := 0
+	for _, u := range upstreams {
+		if u.IsCooling() {
+			cooling++
+		}
+	}
+
+	if cooling == len(upstreams) {
+		check.Message = fmt.Sprintf("all [%d] upstreams are cooling", cooling)
+		return check
+	}
+
+	check.Ok = true
+	check.Message = fmt.Sprintf("[%d]/[%d] upstreams available", len(upstreams)-cooling, len(upstreams))
+	return check
+}
+
+// runs a synthetic query through the upstreams, bypassing the caches
+func checkCanary(s Server) HealthCheck {
+	canary, qtype := canaryQuestion(GetConfiguration().ReadinessCanary)
+	check := HealthCheck{Name: fmt.Sprintf("canary [%s] [%s]", canary, dns.Type(qtype).String())}
+
+	response, address, err := s.RecursiveQuery(canary, qtype)
+	if err != nil {
+		check.Message = fmt.Sprintf("canary query failed: %s", err)
+		return check
+	}
+
+	// NXDOMAIN is a perfectly good answer from a working upstream, these two aren't
+	rcode := response.Entry.Rcode
+	if rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused {
+		check.Message = fmt.Sprintf("upstream [%s] answered canary query with [%s]", address, dns.RcodeToString[rcode])
+		return check
+	}
+
+	check.Ok = true
+	check.Message = fmt.Sprintf("upstream [%s] answered canary query with [%s]", address, dns.RcodeToString[rcode])
+	return check
+}
+
+// held by the goroutine running a responsiveness check, so that a wedged server only ever has one stuck on it
+var responsiveCheck = make(chan struct{}, 1)
+
+// Fails if the locks on the query path can't be had within a timeout, which means the server is
+// wedged.  Upstream outages don't count here, restarting wouldn't get the upstreams back.
+func checkResponsive(s Server, timeout time.Duration) HealthCheck {
+	check := HealthCheck{Name: "responsive"}
+	select {
+	case responsiveCheck <- struct{}{}:
+	default:
+		check.Message = "the last check is still waiting on the caches and upstream groups"
+		return check
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer func() { <-responsiveCheck }()
+		defer close(done)
+		s.GetHostedCache().Size()
+		for _, pool := range s.GetUpstreamGroups() {
+			pool.Upstreams()
+		}
+	}()
+
+	select {
+	case <-done:
+		check.Ok = true
+		check.Message = "caches and upstream groups are responding"
+	case <-time.After(timeout):
+		check.Message = fmt.Sprintf("caches and upstream groups did not respond within [%s]", timeout)
+	}
+	return check
+}
+
+// Checks whether a given server can actually resolve queries
+func CheckReadiness(s Server) HealthReport {
+	if s == nil {
+		return HealthReport{
+			Checks: []HealthCheck{
+				{Name: "server", Message: "server has not been initialized"},
+			},
+		}
+	}
+
+	// every group has to be able to resolve the domains routed to it
+	groups := s.GetUpstreamGroups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := HealthReport{Ready: true}
+	for _, name := range names {
+		report.Checks = append(report.Checks, checkUpstreams(name, groups[name]))
+	}
+	report.Checks = append(report.Checks, checkCanary(s))
+
+	for _, check := range report.Checks {
+		if !check.Ok {
+			report.Ready = false
+		}
+	}
+	return report
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func buildHealthTestServer(upstreams []Upstream, rcode int, queryErr error) *MockServer {
+	pool := new(MockConnPool)
+	pool.On("Upstreams").Return(upstreams)
+
+	server := new(MockServer)
+	server.On("GetUpstreamGroups").Return(map[string]ConnPool{DefaultUpstreamGroup: pool})
+	response := Response{Entry: dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}}}
+	server.On("RecursiveQuery", ".", dns.TypeNS).Return(response, "example.com:853", queryErr)
+	return server
+}
+
+func TestReadinessHealthy(t *testing.T) {
+	server := buildHealthTestServer([]Upstream{{Name: "example.com"}}, dns.RcodeSuccess, nil)
+	if report := CheckReadiness(server); !report.Ready {
+		t.Fatalf("healthy server reported as not ready: [%v]", report)
+	}
+	server.AssertExpectations(t)
+}
+
+func TestReadinessAllUpstreamsCooling(t *testing.T) {
+	cooling := Upstream{Name: "example.com"}
+	cooling.Cooldown(time.Hour)
+	server := buildHealthTestServer([]Upstream{cooling}, dns.RcodeSuccess, nil)
+	report := CheckReadiness(server)
+	if report.Ready {
+		t.Fatalf("server with only cooling upstreams reported as ready: [%v]", report)
+	}
+
+	if report.Checks[0].Ok {
+		t.Fatalf("upstream check passed with only cooling upstreams: [%v]", report.Checks[0])
+	}
+}
+
+func TestReadinessGroupWithoutUpstreams(t *testing.T) {
+	pool := new(MockConnPool)
+	pool.On("Upstreams").Return([]Upstream{{Name: "example.com"}})
+	empty := new(MockConnPool)
+	empty.On("Upstreams").Return([]Upstream{})
+
+	server := new(MockServer)
+	server.On("GetUpstreamGroups").Return(map[string]ConnPool{DefaultUpstreamGroup: pool, "internal": empty})
+	server.On("RecursiveQuery", ".", dns.TypeNS).Return(Response{}, "example.com:853", nil)
+
+	report := CheckReadiness(server)
+	if report.Ready {
+		t.Fatalf("server with a group that has no upstreams reported as ready: [%v]", report)
+	}
+
+	for _, check := range report.Checks {
+		if check.Name == "upstreams [internal]" && check.Ok {
+			t.Fatalf("check for the empty group passed: [%v]", check)
+		}
+	}
+}
+
+func TestReadinessCanaryFailures(t *testing.T) {
+	upstreams := []Upstream{{Name: "example.com"}}
+	server := buildHealthTestServer(upstreams, dns.RcodeSuccess, fmt.Errorf("no DNS for you!"))
+	if report := CheckReadiness(server); report.Ready {
+		t.Fatalf("server with failing canary query reported as ready: [%v]", report)
+	}
+
+	server = buildHealthTestServer(upstreams, dns.RcodeServerFailure, nil)
+	if report := CheckReadiness(server); report.Ready {
+		t.Fatalf("server with SERVFAILing canary query reported as ready: [%v]", report)
+	}
+
+	// NXDOMAIN still means that the upstream is resolving
+	server = buildHealthTestServer(upstreams, dns.RcodeNameError, nil)
+	if report := CheckReadiness(server); !report.Ready {
+		t.Fatalf("server with NXDOMAIN canary query reported as not ready: [%v]", report)
+	}
+}
+
+func TestReadinessUninitialized(t *testing.T) {
+	if report := CheckReadiness(nil); report.Ready {
+		t.Fatalf("uninitialized server reported as ready: [%v]", report)
+	}
+}
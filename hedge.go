@@ -0,0 +1,154 @@
+package main
+
+// Hedged queries.  When the upstream a query went to is slower than it usually is, the same
+// query goes to the next best upstream as well and whichever answer comes back first wins,
+// so one slow upstream doesn't hold the query up until the timeout.
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// the most hedges that can be saved up during a quiet spell
+const hedgeBudgetCap = 10.0
+
+// Keeps hedges to a fraction of queries.  Every query that could be hedged earns a fraction
+// of a hedge, and every hedge spends a whole one.
+type hedgeBudget struct {
+	lock    sync.Mutex
+	balance float64
+}
+
+// credits the budget for a query
+func (b *hedgeBudget) deposit(ratio float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.balance += ratio
+	if b.balance > hedgeBudgetCap {
+		b.balance = hedgeBudgetCap
+	}
+}
+
+// spends a hedge, returns false if there isn't one to spend
+func (b *hedgeBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// what one side of a hedged exchange came back with
+type hedgeResult struct {
+	ce      *ConnEntry
+	reply   *dns.Msg
+	err     error
+	attempt TraceAttempt
+}
+
+// Runs an exchange, hedging it on the next best upstream if the first one takes longer than it
+// usually does.  Every attempt that's done by the time this returns gets added to the trace.
+// Upstreams with the excluded addresses won't be used for either side.
+func (s *MutexServer) hedgedExchange(pool ConnPool, group string, m *dns.Msg, i int, trace *QueryTrace, exclude ...string) (ce *ConnEntry, reply *dns.Msg, err error) {
+	primary := TraceAttempt{Attempt: i}
+	if ce, err = s.checkoutConnection(pool, &primary, exclude...); err != nil {
+		trace.AddAttempt(primary)
+		return ce, nil, err
+	}
+
+	config := GetConfiguration()
+	delay, ok := time.Duration(0), false
+	if config.HedgePercentile > 0 {
+		budget := 0.05
+		if config.HedgeBudget != 0 {
+			budget = config.HedgeBudget
+		}
+		s.hedges.deposit(budget)
+		delay, ok = pool.RttPercentile(ce.GetAddress(), config.HedgePercentile)
+	}
+	if !ok {
+		// not hedging, or nothing to judge the upstream by yet
+		ce, reply, err = s.exchange(pool, ce, m, &primary)
+		trace.AddAttempt(primary)
+		return ce, reply, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	go func(ce *ConnEntry) {
+		ce, reply, err := s.exchange(pool, ce, m, &primary)
+		results <- hedgeResult{ce: ce, reply: reply, err: err, attempt: primary}
+	}(ce)
+
+	timer := time.NewTimer(delay)
+	select {
+	case result := <-results:
+		timer.Stop()
+		trace.AddAttempt(result.attempt)
+		return result.ce, result.reply, result.err
+	case <-timer.C:
+	}
+
+	if !s.hedges.withdraw() {
+		HedgeBudgetExhaustedCounter.WithLabelValues(group).Inc()
+		result := <-results
+		trace.AddAttempt(result.attempt)
+		return result.ce, result.reply, result.err
+	}
+
+	HedgesCounter.WithLabelValues(group).Inc()
+	Logger.Log(NewLogMessage(
+		INFO,
+		LogContext{
+			"what":    "hedging slow query",
+			"address": ce.GetAddress(),
+			"delay":   delay.String(),
+			"next":    "sending the query to the next best upstream",
+		},
+		nil,
+	))
+	go func(slow string) {
+		hedge := TraceAttempt{Attempt: i, Hedge: true}
+		ce, reply, err := s.attemptExchange(pool, m, &hedge, append(append([]string{}, exclude...), slow)...)
+		results <- hedgeResult{ce: ce, reply: reply, err: err, attempt: hedge}
+	}(ce.GetAddress())
+
+	// take the first answer, unless it's a failure and the other one can still come through
+	result := <-results
+	trace.AddAttempt(result.attempt)
+	if result.err != nil {
+		result = <-results
+		trace.AddAttempt(result.attempt)
+	} else {
+		go s.discardHedge(pool, results)
+	}
+
+	if result.err == nil {
+		winner := "primary"
+		if result.attempt.Hedge {
+			winner = "hedge"
+		}
+		HedgeWinsCounter.WithLabelValues(group, winner).Inc()
+	}
+	return result.ce, result.reply, result.err
+}
+
+// waits out the losing side of a hedge, its connection is still good if it got an answer
+func (s *MutexServer) discardHedge(pool ConnPool, results chan hedgeResult) {
+	result := <-results
+	if result.err != nil {
+		// the exchange already closed the connection
+		return
+	}
+	if err := pool.Add(result.ce); err != nil {
+		Logger.Log(NewLogMessage(
+			ERROR,
+			LogContext{
+				"what":  "could not return connection from losing hedge to the pool",
+				"error": err.Error(),
+			},
+			nil,
+		))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHedgeBudget(t *testing.T) {
+	var budget hedgeBudget
+	if budget.withdraw() {
+		t.Fatalf("spent a hedge that was never earned")
+	}
+
+	budget.deposit(0.5)
+	budget.deposit(0.5)
+	if !budget.withdraw() || budget.withdraw() {
+		t.Fatalf("two half-queries should pay for exactly one hedge")
+	}
+
+	for i := 0; i < 100; i++ {
+		budget.deposit(1)
+	}
+	for i := 0; i < hedgeBudgetCap; i++ {
+		budget.withdraw()
+	}
+	if budget.withdraw() {
+		t.Fatalf("the budget saved up more than its cap")
+	}
+}
+
+// builds a server with a slow upstream that looks fast and a fast upstream that looks slow,
+// so that every query goes to the slow one first
+func buildHedgeTestServer(t *testing.T) (*MutexServer, *connPool, *dns.Conn) {
+	pool := NewConnPool()
+	slow := &Upstream{Name: "slow.example.com"}
+	fast := &Upstream{Name: "fast.example.com"}
+	pool.AddUpstream(slow)
+	pool.AddUpstream(fast)
+	for i := 0; i < minPercentileSamples; i++ {
+		slow.AddSample(time.Millisecond)
+		fast.AddSample(50 * time.Millisecond)
+	}
+
+	_, slowClient := net.Pipe()
+	_, fastClient := net.Pipe()
+	slowConn, fastConn := &dns.Conn{Conn: slowClient}, &dns.Conn{Conn: fastClient}
+
+	cl := new(MockDnsClient)
+	cl.On("Dial", slow.GetAddress()).Return(slowConn, nil)
+	cl.On("Dial", fast.GetAddress()).Return(fastConn, nil)
+	cl.On("ExchangeWithConn", mock.Anything, slowConn).After(100*time.Millisecond).Return(answerWith(dns.RcodeSuccess), 100*time.Millisecond, nil)
+	cl.On("ExchangeWithConn", mock.Anything, fastConn).Return(answerWith(dns.RcodeSuccess), time.Millisecond, nil)
+
+	server, err := NewMutexServer(cl, pool)
+	if err != nil {
+		t.Fatalf("could not build test server: %s", err)
+	}
+	return server.(*MutexServer), pool, fastConn
+}
+
+func TestHedgedExchange(t *testing.T) {
+	config := GetConfiguration()
+	config.HedgePercentile = 95
+	config.HedgeBudget = 1
+	defer func() { config.HedgePercentile, config.HedgeBudget = 0, 0 }()
+
+	server, pool, fastConn := buildHedgeTestServer(t)
+	wins := testutil.ToFloat64(HedgeWinsCounter.WithLabelValues(DefaultUpstreamGroup, "hedge"))
+
+	trace := NewQueryTrace("example.com.", "A", false)
+	ce, _, err := server.hedgedExchange(pool, DefaultUpstreamGroup, testQuery("example.com"), 0, trace)
+	if err != nil {
+		t.Fatalf("hedged exchange failed: %s", err)
+	}
+
+	if ce.Conn != fastConn {
+		t.Fatalf("expected the hedge to the fast upstream to win, got an answer from [%s]", ce.GetAddress())
+	}
+
+	if len(trace.Attempts) != 1 || !trace.Attempts[0].Hedge {
+		t.Fatalf("expected only the winning hedge to be traced, got [%v]", trace.Attempts)
+	}
+
+	if after := testutil.ToFloat64(HedgeWinsCounter.WithLabelValues(DefaultUpstreamGroup, "hedge")); after != wins+1 {
+		t.Fatalf("hedge win wasn't counted")
+	}
+
+	// the slow answer still comes in, and its connection goes back to the pool
+	pool.Add(ce)
+	if !WaitForCondition(10, func() bool { return pool.Size() == 2 }) {
+		t.Fatalf("losing connection wasn't returned to the pool, pool has [%d] connections", pool.Size())
+	}
+}
+
+func TestHedgedExchangeBudget(t *testing.T) {
+	config := GetConfiguration()
+	config.HedgePercentile = 95
+	config.HedgeBudget = 0.01
+	defer func() { config.HedgePercentile, config.HedgeBudget = 0, 0 }()
+
+	server, pool, fastConn := buildHedgeTestServer(t)
+	exhausted := testutil.ToFloat64(HedgeBudgetExhaustedCounter.WithLabelValues(DefaultUpstreamGroup))
+
+	ce, _, err := server.hedgedExchange(pool, DefaultUpstreamGroup, testQuery("example.com"), 0, nil)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	if ce.Conn == fastConn {
+		t.Fatalf("query was hedged without any budget")
+	}
+
+	if after := testutil.ToFloat64(HedgeBudgetExhaustedCounter.WithLabelValues(DefaultUpstreamGroup)); after != exhausted+1 {
+		t.Fatalf("skipped hedge wasn't counted")
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func handleError(w http.ResponseWriter, err error, code int) {
@@ -26,7 +30,8 @@ func handleError(w http.ResponseWriter, err error, code int) {
 func shutdownHttpHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	w.Write([]byte("{\"message\": \"shutting down server\"}"))
-	Shutdown()
+	// this has to be async, the HTTP server won't finish shutting down until this handler returns
+	go Shutdown()
 }
 
 func versionHttpHandler(w http.ResponseWriter, r *http.Request) {
@@ -54,6 +59,133 @@ func configHttpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// liveness: if we can answer this, the process is alive
+func healthzHttpHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := w.Write([]byte("{\"status\": \"ok\"}")); err != nil {
+		handleError(w, err, 500)
+	}
+}
+
+// readiness: can this instance actually resolve anything?
+func readyzHttpHandler(w http.ResponseWriter, r *http.Request) {
+	report := CheckReadiness(resolver)
+	str, err := json.Marshal(report)
+	if err != nil {
+		handleError(w, err, 500)
+		return
+	}
+
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if _, err := w.Write([]byte(str)); err != nil {
+		handleError(w, err, 500)
+	}
+}
+
+// what the resolve endpoint hands back
+type resolveResult struct {
+	Rcode  string      `json:"rcode,omitempty"`
+	Answer []string    `json:"answer"`
+	Error  string      `json:"error,omitempty"`
+	Trace  *QueryTrace `json:"trace"`
+}
+
+// runs a query the same way the DNS server would and returns the answer with a trace
+// GET /v1/resolve?name=example.com&type=AAAA&skip_cache=true
+func resolveHttpHandler(w http.ResponseWriter, r *http.Request) {
+	if resolver == nil {
+		handleError(w, fmt.Errorf("server has not been initialized"), http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		handleError(w, fmt.Errorf("no name given to resolve"), http.StatusBadRequest)
+		return
+	}
+
+	rrtype := dns.TypeA
+	if typeString := query.Get("type"); typeString != "" {
+		var ok bool
+		if rrtype, ok = dns.StringToType[strings.ToUpper(typeString)]; !ok {
+			handleError(w, fmt.Errorf("unknown record type [%s]", typeString), http.StatusBadRequest)
+			return
+		}
+	}
+
+	skipCache := false
+	if skipString := query.Get("skip_cache"); skipString != "" {
+		var err error
+		if skipCache, err = strconv.ParseBool(skipString); err != nil {
+			handleError(w, fmt.Errorf("invalid value for skip_cache [%s]: %s", skipString, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response, trace, err := resolver.RetrieveRecordsWithTrace(dns.Fqdn(name), rrtype, skipCache)
+	result := resolveResult{
+		Answer: []string{},
+		Trace:  trace,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Rcode = dns.RcodeToString[response.Entry.Rcode]
+		for _, rr := range response.Entry.Answer {
+			result.Answer = append(result.Answer, rr.String())
+		}
+	}
+
+	str, err := json.Marshal(result)
+	if err != nil {
+		handleError(w, err, 500)
+		return
+	}
+
+	if _, err := w.Write([]byte(str)); err != nil {
+		handleError(w, err, 500)
+	}
+}
+
+// what the upstream stats endpoint hands back
+type upstreamStatsResult struct {
+	Upstreams []UpstreamStats `json:"upstreams"`
+}
+
+// reports how every upstream in every group is doing
+// GET /v1/upstreams/stats
+func upstreamStatsHttpHandler(w http.ResponseWriter, r *http.Request) {
+	if resolver == nil {
+		handleError(w, fmt.Errorf("server has not been initialized"), http.StatusServiceUnavailable)
+		return
+	}
+
+	groups := resolver.GetUpstreamGroups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := upstreamStatsResult{Upstreams: []UpstreamStats{}}
+	for _, name := range names {
+		result.Upstreams = append(result.Upstreams, groups[name].Stats()...)
+	}
+
+	str, err := json.Marshal(result)
+	if err != nil {
+		handleError(w, err, 500)
+		return
+	}
+
+	if _, err := w.Write([]byte(str)); err != nil {
+		handleError(w, err, 500)
+	}
+}
+
 func addPratchettHeader(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Clacks-Overhead", "GNU Terry Pratchett")
@@ -71,7 +203,6 @@ func setContentTypeHeader(next http.Handler) http.Handler {
 var HttpServer *http.Server
 
 func InitApi() {
-	conf := GetConfiguration()
 	router := mux.NewRouter().StrictSlash(true)
 	InitPrometheus(router)
 	router.Use(addPratchettHeader)
@@ -80,10 +211,21 @@ func InitApi() {
 	router.HandleFunc("/v1/config", configHttpHandler)
 	router.HandleFunc("/v1/shutdown", shutdownHttpHandler)
 	router.HandleFunc("/v1/version", versionHttpHandler)
-	log.Printf("starting HTTP server on ':%d'\n", conf.HttpPort)
-	HttpServer := &http.Server{Handler: router, Addr: fmt.Sprintf(":%d", conf.HttpPort)}
+	router.HandleFunc("/healthz", healthzHttpHandler)
+	router.HandleFunc("/readyz", readyzHttpHandler)
+	router.HandleFunc("/v1/resolve", resolveHttpHandler).Methods("GET")
+	router.HandleFunc("/v1/upstreams/stats", upstreamStatsHttpHandler).Methods("GET")
+	listener, addr, err := httpListener()
+	if err != nil {
+		log.Printf("could not start HTTP server on '%s': %s\n", addr, err)
+		return
+	}
+	log.Printf("starting HTTP server on '%s'\n", addr)
+	HttpServer = &http.Server{Handler: router, Addr: addr}
 	// don't block the main thread with this jazz
 	go func() {
-		log.Printf(fmt.Sprintf("%s", HttpServer.ListenAndServe()))
+		if err := HttpServer.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("%s", err)
+		}
 	}()
 }
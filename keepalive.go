@@ -0,0 +1,72 @@
+package main
+
+// EDNS TCP keepalive (RFC 7828).  Upstream queries ask for the upstream's idle timeout, and
+// the pool closes connections before the upstream would, instead of finding out from an EOF.
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// connections are closed once they've been idle for this much of the upstream's timeout,
+// leaving room for the reaper's interval and for clocks that don't quite agree
+const keepaliveSafety = 0.8
+
+// the dns library packs and unpacks EDNS0_TCP_KEEPALIVE with its own header inside the option data,
+// so the option goes out and comes back in its raw form
+func keepaliveOption(opt *dns.OPT) (option *dns.EDNS0_LOCAL, index int) {
+	for i, each := range opt.Option {
+		if local, ok := each.(*dns.EDNS0_LOCAL); ok && local.Code == dns.EDNS0TCPKEEPALIVE {
+			return local, i
+		}
+	}
+	return nil, -1
+}
+
+// returns a copy of a query that asks the upstream for its idle timeout, the option goes out
+// without a timeout, as the RFC requires from clients
+func withTcpKeepalive(m *dns.Msg) *dns.Msg {
+	query := m.Copy()
+	opt := query.IsEdns0()
+	if opt == nil {
+		query.SetEdns0(dns.DefaultMsgSize, false)
+		opt = query.IsEdns0()
+	}
+	if option, _ := keepaliveOption(opt); option == nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+	return query
+}
+
+// Pulls the upstream's idle timeout out of a reply, ok is false if it didn't send one.  The option
+// only means something to us, so it comes out of the reply, along with the whole OPT record if the
+// original query didn't have one.
+func takeTcpKeepalive(reply *dns.Msg, query *dns.Msg) (timeout time.Duration, ok bool) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+
+	if option, i := keepaliveOption(opt); option != nil && len(option.Data) == 2 {
+		// the timeout is in units of 100 ms
+		timeout = time.Duration(binary.BigEndian.Uint16(option.Data)) * 100 * time.Millisecond
+		ok = true
+		opt.Option = append(opt.Option[:i], opt.Option[i+1:]...)
+	}
+
+	if query.IsEdns0() == nil {
+		extra := reply.Extra[:0]
+		for _, rr := range reply.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		reply.Extra = extra
+	}
+	return timeout, ok
+}
+
+// how long a connection can idle before the upstream's keepalive timeout catches up with it
+func keepaliveDeadline(timeout time.Duration) time.Duration {
+	return time.Duration(float64(timeout) * keepaliveSafety)
+}
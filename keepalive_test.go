@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// builds a reply the way it would come off the wire, with a keepalive timeout in units of 100 ms
+func keepaliveReply(t *testing.T, query *dns.Msg, timeout uint16) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	reply.SetEdns0(dns.DefaultMsgSize, false)
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{byte(timeout >> 8), byte(timeout)}})
+
+	packed, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("could not pack reply [%v]: %s", reply, err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatalf("could not unpack reply: %s", err)
+	}
+	return unpacked
+}
+
+func TestTcpKeepaliveQuery(t *testing.T) {
+	m := testQuery("example.com")
+	query := withTcpKeepalive(m)
+	if m.IsEdns0() != nil {
+		t.Fatalf("asking for keepalive changed the original query")
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatalf("could not pack query [%v]: %s", query, err)
+	}
+	unpacked := new(dns.Msg)
+	if err := unpacked.Unpack(packed); err != nil {
+		t.Fatalf("could not unpack query: %s", err)
+	}
+	opt := unpacked.IsEdns0()
+	if opt == nil {
+		t.Fatalf("query went out without an OPT record")
+	}
+	option, _ := keepaliveOption(opt)
+	if option == nil || len(option.Data) != 0 {
+		t.Fatalf("query should carry a keepalive option without a timeout, got [%v]", opt)
+	}
+
+	// asking twice doesn't send the option twice
+	if again := withTcpKeepalive(query); len(again.IsEdns0().Option) != 1 {
+		t.Fatalf("keepalive option was added twice: [%v]", again.IsEdns0())
+	}
+}
+
+func TestTcpKeepaliveReply(t *testing.T) {
+	m := testQuery("example.com")
+	reply := keepaliveReply(t, m, 50)
+	timeout, ok := takeTcpKeepalive(reply, m)
+	if !ok || timeout != 5*time.Second {
+		t.Fatalf("expected a 5s timeout, got [%s] [%t]", timeout, ok)
+	}
+	if reply.IsEdns0() != nil {
+		t.Fatalf("reply to a query without EDNS kept its OPT record: [%v]", reply)
+	}
+
+	// a query that had its own EDNS keeps the record, minus our option
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	reply = keepaliveReply(t, m, 50)
+	takeTcpKeepalive(reply, m)
+	if opt := reply.IsEdns0(); opt == nil || len(opt.Option) != 0 {
+		t.Fatalf("expected the OPT record to stay without the keepalive option, got [%v]", opt)
+	}
+
+	if _, ok := takeTcpKeepalive(new(dns.Msg), m); ok {
+		t.Fatalf("found a keepalive timeout in a reply without one")
+	}
+}
+
+func TestConnectionPoolKeepalive(t *testing.T) {
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	ce, server := addLiveConnection(t, pool, upstream)
+	defer server.Close()
+	ce.keepalive, ce.hasKeepalive = time.Second, true
+	ce.lastUsed = time.Now().Add(-900 * time.Millisecond)
+
+	pool.Reap()
+	if pool.Size() != 0 {
+		t.Fatalf("connection outlived the upstream's keepalive timeout")
+	}
+
+	// the upstream asking us to close the connection
+	_, server1 := addLiveConnection(t, pool, upstream)
+	defer server1.Close()
+	checkout, _, _ := pool.Get(context.Background())
+	checkout.keepalive, checkout.hasKeepalive = 0, true
+	pool.Add(checkout)
+	if pool.Size() != 0 {
+		t.Fatalf("connection stayed in the pool after the upstream sent a 0 timeout")
+	}
+
+	if timeout, ok := upstream.GetKeepalive(); !ok || timeout != 0 {
+		t.Fatalf("upstream didn't record the negotiated timeout, got [%s] [%t]", timeout, ok)
+	}
+}
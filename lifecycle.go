@@ -0,0 +1,180 @@
+package main
+
+// Decides how long pooled connections get to live.  Upstreams close connections that sit
+// idle for too long (RFC 7766 asks clients to keep idle time down anyway), and a query that
+// picks one of those up gets an EOF, so we close them ourselves before that happens.
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// how often the reaper looks for connections to close
+const reapInterval = time.Duration(1000) * time.Millisecond
+
+// Reasons for closing a connection, as they show up in the ClosedConnectionsCounter
+const (
+	// nothing used it for longer than the idle timeout
+	CloseReasonIdle = "idle"
+
+	// it was open for longer than the max age
+	CloseReasonMaxAge = "max_age"
+
+	// it was about to hit the idle timeout the upstream sent, see keepalive.go
+	CloseReasonKeepalive = "keepalive"
+
+	// it carried the maximum number of queries
+	CloseReasonMaxQueries = "max_queries"
+
+	// the upstream closed it while it was in the pool
+	CloseReasonDead = "dead"
+
+	// an exchange on it failed
+	CloseReasonError = "error"
+
+	// its upstream got cooled
+	CloseReasonPurged = "purged"
+
+	// it carried a health probe, see prober.go
+	CloseReasonProbe = "probe"
+
+	// the pool was torn down
+	CloseReasonShutdown = "shutdown"
+
+	// closed for any other reason
+	CloseReasonClosed = "closed"
+)
+
+type connLifecycle struct {
+	// 0 or less means connections can idle forever
+	idleTimeout time.Duration
+
+	// 0 means no limit
+	maxAge time.Duration
+
+	// 0 means no limit
+	maxQueries int
+
+	// connections idle for longer than this get checked before they're handed out, 0 or less means never
+	checkAfter time.Duration
+}
+
+// builds the lifecycle policy from the configuration
+func lifecyclePolicy() connLifecycle {
+	config := GetConfiguration()
+	policy := connLifecycle{
+		idleTimeout: time.Duration(10000) * time.Millisecond,
+		maxAge:      config.ConnectionMaxAge * time.Millisecond,
+		maxQueries:  config.ConnectionMaxQueries,
+		checkAfter:  time.Duration(1000) * time.Millisecond,
+	}
+	if config.ConnectionIdleTimeout != 0 {
+		policy.idleTimeout = config.ConnectionIdleTimeout * time.Millisecond
+	}
+	if config.ConnectionCheckAfter != 0 {
+		policy.checkAfter = config.ConnectionCheckAfter * time.Millisecond
+	}
+	return policy
+}
+
+// returns why a connection should be closed, or an empty string if it can stay open
+func (l connLifecycle) expired(ce *ConnEntry, now time.Time) string {
+	if l.maxQueries > 0 && ce.queries >= l.maxQueries {
+		return CloseReasonMaxQueries
+	}
+	if l.maxAge > 0 && !ce.created.IsZero() && now.Sub(ce.created) > l.maxAge {
+		return CloseReasonMaxAge
+	}
+	if l.idleTimeout > 0 && !ce.lastUsed.IsZero() && now.Sub(ce.lastUsed) > l.idleTimeout {
+		return CloseReasonIdle
+	}
+	// a 0 timeout is the upstream asking us to close the connection
+	if ce.hasKeepalive && !ce.lastUsed.IsZero() && now.Sub(ce.lastUsed) >= keepaliveDeadline(ce.keepalive) {
+		return CloseReasonKeepalive
+	}
+	return ""
+}
+
+// the same policy, but letting connections idle forever
+func (l connLifecycle) withoutIdleTimeout() connLifecycle {
+	l.idleTimeout = 0
+	return l
+}
+
+// whether a connection has been sitting around long enough that the upstream may have closed it
+func (l connLifecycle) needsCheck(ce *ConnEntry, now time.Time) bool {
+	return l.checkAfter > 0 && !ce.lastUsed.IsZero() && now.Sub(ce.lastUsed) > l.checkAfter
+}
+
+// Checks whether the upstream has closed a pooled connection behind our back.  There's nothing
+// to read on a healthy idle connection, so a read that times out is the good outcome.
+func connAlive(conn CachedConn) error {
+	// pipelined connections are always reading, they know when they've been closed
+	if pc, ok := conn.(*pipelinedConn); ok {
+		return pc.Err()
+	}
+
+	dnsConn, ok := conn.(*dns.Conn)
+	if !ok || dnsConn.Conn == nil {
+		return nil
+	}
+
+	if err := dnsConn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return err
+	}
+	// the exchanges set their own deadlines, but leave things the way we found them
+	defer dnsConn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := dnsConn.Conn.Read(b[:])
+	if err == nil {
+		return fmt.Errorf("upstream sent data nobody asked for")
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// Periodically closes pooled connections that have outlived the lifecycle policy
+type connReaper struct {
+	// the pools to reap, keyed by group
+	pools map[string]ConnPool
+
+	Cancel chan bool
+}
+
+func NewConnReaper(pools map[string]ConnPool) *connReaper {
+	return &connReaper{pools: pools}
+}
+
+func (r *connReaper) Start() {
+	r.Cancel = make(chan bool)
+	go func() {
+		t := time.NewTicker(reapInterval)
+		defer t.Stop()
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":     "starting connection reaper",
+				"interval": fmt.Sprintf("%s", reapInterval),
+			},
+			nil,
+		))
+		for {
+			select {
+			case _ = <-t.C:
+				for _, pool := range r.pools {
+					pool.Reap()
+				}
+			case _ = <-r.Cancel:
+				return
+			}
+		}
+	}()
+}
+
+func (r *connReaper) Stop() {
+	close(r.Cancel)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLifecycleExpiry(t *testing.T) {
+	policy := connLifecycle{idleTimeout: time.Minute, maxAge: time.Hour, maxQueries: 10}
+	now := time.Now()
+
+	for _, tc := range []struct {
+		ce       ConnEntry
+		expected string
+	}{
+		{ConnEntry{created: now, lastUsed: now}, ""},
+		{ConnEntry{created: now, lastUsed: now.Add(-2 * time.Minute)}, CloseReasonIdle},
+		{ConnEntry{created: now.Add(-2 * time.Hour), lastUsed: now}, CloseReasonMaxAge},
+		{ConnEntry{created: now, lastUsed: now, queries: 10}, CloseReasonMaxQueries},
+		// connections that never went through the pool don't have timestamps
+		{ConnEntry{}, ""},
+	} {
+		if reason := policy.expired(&tc.ce, now); reason != tc.expected {
+			t.Fatalf("expected connection [%v] to expire with [%s], got [%s]", tc.ce, tc.expected, reason)
+		}
+	}
+
+	if reason := (connLifecycle{}).expired(&ConnEntry{created: now.Add(-24 * time.Hour), queries: 1000}, now); reason != "" {
+		t.Fatalf("empty policy expired a connection with [%s]", reason)
+	}
+}
+
+func TestConnAlive(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	if err := connAlive(&dns.Conn{Conn: client}); err != nil {
+		t.Fatalf("open connection was reported as dead: %s", err)
+	}
+
+	server.Close()
+	if err := connAlive(&dns.Conn{Conn: client}); err == nil {
+		t.Fatalf("closed connection was reported as alive")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+// Where funkyd listens.  Every listener binds one address and port, optionally to a single
+// network interface, and the sockets are all opened up front so that a bad listener stops
+// startup instead of failing quietly in the background.
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The configuration for a single listener
+type ListenerConfig struct {
+	// The IP (v4 or v6) to bind to, the 0-value equates to every address
+	Address string `json:"address"`
+
+	// The port to bind to, the 0-value equates to dns_port (or http_port for the admin API)
+	Port int `json:"port"`
+
+	// "udp", "tcp" or "tcp-tls", with a 4 or 6 after the udp or tcp to only use that IP version
+	// ("udp6", "tcp4-tls"), the 0-value equates to both udp and tcp.  The admin API only takes tcp.
+	Protocol string `json:"protocol"`
+
+	// The name of a network interface to bind to, binding to an interface needs CAP_NET_RAW
+	Interface string `json:"interface"`
+
+	// Sockets passed in by systemd with this name (the FileDescriptorName in the socket unit) get
+	// used instead of binding new ones, the address, port and interface don't apply to those, see systemd.go
+	Name string `json:"name"`
+}
+
+// every protocol a DNS listener can use
+var dnsProtocols = map[string]bool{
+	"udp":      true,
+	"udp4":     true,
+	"udp6":     true,
+	"tcp":      true,
+	"tcp4":     true,
+	"tcp6":     true,
+	"tcp-tls":  true,
+	"tcp4-tls": true,
+	"tcp6-tls": true,
+}
+
+// returns the protocols the listener serves, an empty protocol means both udp and tcp
+func (l ListenerConfig) protocols() ([]string, error) {
+	if l.Protocol == "" {
+		return []string{"udp", "tcp"}, nil
+	}
+	if !dnsProtocols[l.Protocol] {
+		return nil, fmt.Errorf("unsupported protocol [%s]", l.Protocol)
+	}
+	return []string{l.Protocol}, nil
+}
+
+// returns the address to bind to
+func (l ListenerConfig) addr(defaultPort int) string {
+	port := l.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	// JoinHostPort takes care of bracketing IPv6 literals, so strip any that were configured
+	host := strings.TrimSuffix(strings.TrimPrefix(l.Address, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Returns what the listener's sockets get opened with, it sets SO_REUSEPORT, and
+// SO_BINDTODEVICE if the listener names an interface
+func (l ListenerConfig) listenConfig() (net.ListenConfig, error) {
+	if l.Interface != "" {
+		if _, err := net.InterfaceByName(l.Interface); err != nil {
+			return net.ListenConfig{}, fmt.Errorf("could not find interface [%s]: %s", l.Interface, err)
+		}
+	}
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); sockErr != nil {
+					sockErr = fmt.Errorf("could not set SO_REUSEPORT on [%s]: %s", address, sockErr)
+					return
+				}
+				if l.Interface != "" {
+					if sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, l.Interface); sockErr != nil {
+						sockErr = fmt.Errorf("could not bind [%s] to interface [%s]: %s", address, l.Interface, sockErr)
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}, nil
+}
+
+// Opens a stream socket for the listener, protocol can be tcp, tcp4 or tcp6
+func (l ListenerConfig) listen(protocol string, defaultPort int) (net.Listener, error) {
+	lc, err := l.listenConfig()
+	if err != nil {
+		return nil, err
+	}
+	return lc.Listen(context.Background(), protocol, l.addr(defaultPort))
+}
+
+// Opens a packet socket for the listener, protocol can be udp, udp4 or udp6
+func (l ListenerConfig) listenPacket(protocol string, defaultPort int) (net.PacketConn, error) {
+	lc, err := l.listenConfig()
+	if err != nil {
+		return nil, err
+	}
+	return lc.ListenPacket(context.Background(), protocol, l.addr(defaultPort))
+}
+
+// the TLS configuration for tcp-tls listeners
+func serverTlsConfig() (*tls.Config, error) {
+	config := GetConfiguration()
+	if (config.TlsConfig == tlsConfig{}) {
+		return nil, fmt.Errorf("attempted to listen for TLS connections, but no tls config was defined")
+	}
+	if config.TlsConfig.CertificateFile == "" {
+		return nil, fmt.Errorf("invalid certificate file in configuration")
+	}
+	if config.TlsConfig.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("invalid private key in configuration")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.TlsConfig.CertificateFile, config.TlsConfig.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load tls files: %s", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// the configured DNS listeners, or every address on the DNS port if there aren't any
+func dnsListeners(defaultProtocol string) []ListenerConfig {
+	config := GetConfiguration()
+	if len(config.Listeners) > 0 {
+		return config.Listeners
+	}
+	return []ListenerConfig{{Protocol: defaultProtocol}}
+}
+
+// the DNS port listeners fall back on
+func dnsPort() int {
+	if port := GetConfiguration().DnsPort; port != 0 {
+		return port
+	}
+	return 53
+}
+
+// Opens the sockets for a set of listeners and builds a server for each one, none of the servers
+// are running yet.  If any of the sockets can't be opened, the ones that were get closed.
+func buildDnsServers(listeners []ListenerConfig, handler dns.Handler) (servers []*dns.Server, err error) {
+	defer func() {
+		if err != nil {
+			for _, srv := range servers {
+				closeDnsServerSocket(srv)
+			}
+			servers = nil
+		}
+	}()
+
+	var tlsConf *tls.Config
+	withTls := func(listener net.Listener) (net.Listener, error) {
+		if tlsConf == nil {
+			var err error
+			if tlsConf, err = serverTlsConfig(); err != nil {
+				listener.Close()
+				return nil, err
+			}
+		}
+		return tls.NewListener(listener, tlsConf), nil
+	}
+
+	for _, l := range listeners {
+		protocols, err := l.protocols()
+		if err != nil {
+			return servers, fmt.Errorf("invalid listener [%s]: %s", l.addr(dnsPort()), err)
+		}
+
+		if files := claimActivatedSockets(l.Name); len(files) > 0 {
+			activated, err := l.activatedDnsServers(files, handler, withTls)
+			servers = append(servers, activated...)
+			if err != nil {
+				return servers, err
+			}
+			continue
+		}
+
+		for _, protocol := range protocols {
+			srv := &dns.Server{Addr: l.addr(dnsPort()), Net: protocol, MaxTCPQueries: -1, Handler: handler}
+			switch {
+			case strings.HasPrefix(protocol, "udp"):
+				srv.PacketConn, err = l.listenPacket(protocol, dnsPort())
+			case strings.HasSuffix(protocol, "-tls"):
+				if srv.Listener, err = l.listen(strings.TrimSuffix(protocol, "-tls"), dnsPort()); err == nil {
+					srv.Listener, err = withTls(srv.Listener)
+				}
+			default:
+				srv.Listener, err = l.listen(protocol, dnsPort())
+			}
+			if err != nil {
+				return servers, fmt.Errorf("could not listen on [%s] [%s]: %s", protocol, srv.Addr, err)
+			}
+			servers = append(servers, srv)
+		}
+	}
+	return servers, nil
+}
+
+// Builds servers on sockets passed in by systemd.  A listener without a protocol takes datagram
+// and stream sockets alike, otherwise the sockets have to match the protocol.
+func (l ListenerConfig) activatedDnsServers(files []*os.File, handler dns.Handler, withTls func(net.Listener) (net.Listener, error)) (servers []*dns.Server, err error) {
+	// the net package makes its own copies of the sockets
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, f := range files {
+		datagram, err := isDatagramSocket(f)
+		if err != nil {
+			return servers, err
+		}
+		if l.Protocol != "" && datagram != strings.HasPrefix(l.Protocol, "udp") {
+			return servers, fmt.Errorf("socket [%s] passed in by systemd doesn't match protocol [%s]", f.Name(), l.Protocol)
+		}
+
+		srv := &dns.Server{Net: l.Protocol, MaxTCPQueries: -1, Handler: handler}
+		if datagram {
+			if srv.PacketConn, err = net.FilePacketConn(f); err != nil {
+				return servers, fmt.Errorf("could not use socket [%s] passed in by systemd: %s", f.Name(), err)
+			}
+			srv.Addr = srv.PacketConn.LocalAddr().String()
+			if srv.Net == "" {
+				srv.Net = "udp"
+			}
+		} else {
+			if srv.Listener, err = net.FileListener(f); err != nil {
+				return servers, fmt.Errorf("could not use socket [%s] passed in by systemd: %s", f.Name(), err)
+			}
+			srv.Addr = srv.Listener.Addr().String()
+			if srv.Net == "" {
+				srv.Net = "tcp"
+			} else if strings.HasSuffix(srv.Net, "-tls") {
+				if srv.Listener, err = withTls(srv.Listener); err != nil {
+					return servers, err
+				}
+			}
+		}
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":     "using socket passed in by systemd",
+				"name":     l.Name,
+				"protocol": srv.Net,
+				"address":  srv.Addr,
+			},
+			nil,
+		))
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// closes the socket of a server that was never started
+func closeDnsServerSocket(srv *dns.Server) {
+	if srv.PacketConn != nil {
+		srv.PacketConn.Close()
+	}
+	if srv.Listener != nil {
+		srv.Listener.Close()
+	}
+}
+
+// Opens the socket for the admin API, the listener can only use tcp, tcp4 or tcp6
+func httpListener() (net.Listener, string, error) {
+	config := GetConfiguration()
+	l := config.HttpListener
+	protocol := l.Protocol
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	addr := l.addr(config.HttpPort)
+	if protocol != "tcp" && protocol != "tcp4" && protocol != "tcp6" {
+		return nil, addr, fmt.Errorf("unsupported protocol [%s] for the admin API", protocol)
+	}
+
+	if files := claimActivatedSockets(l.Name); len(files) > 0 {
+		defer func() {
+			for _, f := range files {
+				f.Close()
+			}
+		}()
+		if len(files) > 1 {
+			return nil, addr, fmt.Errorf("systemd passed in [%d] sockets named [%s] for the admin API, it can only use one", len(files), l.Name)
+		}
+		listener, err := net.FileListener(files[0])
+		if err != nil {
+			return nil, addr, fmt.Errorf("could not use socket [%s] passed in by systemd: %s", l.Name, err)
+		}
+		return listener, listener.Addr().String(), nil
+	}
+
+	listener, err := l.listen(protocol, config.HttpPort)
+	return listener, addr, err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListenerProtocols(t *testing.T) {
+	tests := []struct {
+		protocol  string
+		protocols []string
+		valid     bool
+	}{
+		{"", []string{"udp", "tcp"}, true},
+		{"udp6", []string{"udp6"}, true},
+		{"tcp4-tls", []string{"tcp4-tls"}, true},
+		{"sctp", nil, false},
+		{"udp-tls", nil, false},
+	}
+	for _, test := range tests {
+		protocols, err := ListenerConfig{Protocol: test.protocol}.protocols()
+		if (err == nil) != test.valid {
+			t.Errorf("protocol [%s]: expected valid [%t], got error [%v]", test.protocol, test.valid, err)
+		}
+		if !reflect.DeepEqual(protocols, test.protocols) {
+			t.Errorf("protocol [%s]: expected [%v], got [%v]", test.protocol, test.protocols, protocols)
+		}
+	}
+}
+
+func TestListenerAddr(t *testing.T) {
+	tests := []struct {
+		listener ListenerConfig
+		addr     string
+	}{
+		{ListenerConfig{}, ":53"},
+		{ListenerConfig{Address: "127.0.0.1", Port: 5353}, "127.0.0.1:5353"},
+		{ListenerConfig{Address: "::1"}, "[::1]:53"},
+		{ListenerConfig{Address: "[::1]"}, "[::1]:53"},
+	}
+	for _, test := range tests {
+		if addr := test.listener.addr(53); addr != test.addr {
+			t.Errorf("expected [%s] for [%v], got [%s]", test.addr, test.listener, addr)
+		}
+	}
+}
+
+// finds a port that's free for both UDP and TCP on the loopback
+func freePort(t *testing.T) int {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("could not find a free port: %s", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err == nil {
+			pc.Close()
+			return port
+		}
+	}
+	t.Fatalf("could not find a port that's free for UDP and TCP")
+	return 0
+}
+
+func TestBuildDnsServers(t *testing.T) {
+	port := freePort(t)
+	srvs, err := buildDnsServers([]ListenerConfig{{Address: "127.0.0.1", Port: port}}, &BlackholeServer{})
+	if err != nil {
+		t.Fatalf("could not build servers: %s", err)
+	}
+
+	if len(srvs) != 2 {
+		t.Fatalf("expected a UDP and a TCP server, got [%d] servers", len(srvs))
+	}
+
+	for _, srv := range srvs {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		defer srv.ShutdownContext(context.Background())
+	}
+
+	for _, protocol := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: protocol, Timeout: time.Second}
+		if _, _, err := client.Exchange(testQuery("example.com"), net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+			t.Errorf("could not query the [%s] server: %s", protocol, err)
+		}
+	}
+}
+
+func TestBuildDnsServersCleansUp(t *testing.T) {
+	port := freePort(t)
+	_, err := buildDnsServers([]ListenerConfig{
+		{Address: "127.0.0.1", Port: port, Protocol: "udp"},
+		{Address: "127.0.0.1", Port: port, Protocol: "tcp", Interface: "funkyd-does-not-exist0"},
+	}, &BlackholeServer{})
+	if err == nil {
+		t.Fatalf("bound to an interface that doesn't exist")
+	}
+
+	// this would collide with the first listener if it had been left open
+	pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("socket from the failed build was left open: %s", err)
+	}
+	pc.Close()
+}
+
+func TestBuildDnsServersIpv6Only(t *testing.T) {
+	l := ListenerConfig{Address: "::", Port: freePort(t), Protocol: "udp6"}
+	srvs, err := buildDnsServers([]ListenerConfig{l}, &BlackholeServer{})
+	if err != nil {
+		t.Skipf("could not listen on IPv6: %s", err)
+	}
+	defer closeDnsServerSocket(srvs[0])
+
+	// with the wildcard IPv6 socket being v6 only, the same port is still free for v4
+	pc, err := net.ListenPacket("udp4", ListenerConfig{Address: "0.0.0.0", Port: l.Port}.addr(0))
+	if err != nil {
+		t.Fatalf("IPv6 listener took the IPv4 port as well: %s", err)
+	}
+	pc.Close()
+}
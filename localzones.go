@@ -0,0 +1,166 @@
+package main
+
+// Answers queries for locally-served (RFC 6303) and special-use (RFC 6761) names
+// directly so that internal traffic never leaks to upstreams
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// What to do with queries for a local zone
+const (
+	// answer NXDOMAIN for anything under the zone
+	LocalZoneNxdomain = "nxdomain"
+
+	// answer with the loopback addresses, per RFC 6761 section 6.3
+	LocalZoneLoopback = "loopback"
+
+	// don't treat the zone specially, send it upstream like anything else
+	LocalZoneForward = "forward"
+)
+
+// the TTL on synthesized answers, also the negative caching TTL from RFC 6303 section 3
+const localZoneTtl = 10800
+
+// the zones that are answered locally unless overridden in the configuration
+var defaultLocalZones = map[string]string{
+	// RFC 6761 special-use names
+	"localhost.": LocalZoneLoopback,
+	"invalid.":   LocalZoneNxdomain,
+	"test.":      LocalZoneNxdomain,
+	// RFC 6762 multicast DNS
+	"local.": LocalZoneNxdomain,
+	// reserved by ICANN for private use
+	"internal.": LocalZoneNxdomain,
+	// RFC 7686
+	"onion.": LocalZoneNxdomain,
+	// RFC 8375
+	"home.arpa.": LocalZoneNxdomain,
+
+	// RFC 6303 section 4.2, RFC 1918 reverse zones
+	"10.in-addr.arpa.":      LocalZoneNxdomain,
+	"168.192.in-addr.arpa.": LocalZoneNxdomain,
+
+	// RFC 6303 section 4.3, the rest of the special IPv4 reverse zones
+	"0.in-addr.arpa.":               LocalZoneNxdomain,
+	"127.in-addr.arpa.":             LocalZoneNxdomain,
+	"254.169.in-addr.arpa.":         LocalZoneNxdomain,
+	"2.0.192.in-addr.arpa.":         LocalZoneNxdomain,
+	"100.51.198.in-addr.arpa.":      LocalZoneNxdomain,
+	"113.0.203.in-addr.arpa.":       LocalZoneNxdomain,
+	"255.255.255.255.in-addr.arpa.": LocalZoneNxdomain,
+
+	// RFC 6303 section 4.4, IPv6 unspecified and loopback addresses
+	"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": LocalZoneNxdomain,
+	"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.": LocalZoneNxdomain,
+
+	// RFC 6303 section 4.5, IPv6 locally assigned local addresses
+	"d.f.ip6.arpa.": LocalZoneNxdomain,
+
+	// RFC 6303 section 4.6, IPv6 link local addresses
+	"8.e.f.ip6.arpa.": LocalZoneNxdomain,
+	"9.e.f.ip6.arpa.": LocalZoneNxdomain,
+	"a.e.f.ip6.arpa.": LocalZoneNxdomain,
+	"b.e.f.ip6.arpa.": LocalZoneNxdomain,
+
+	// RFC 6303 section 4.7, IPv6 example prefix
+	"8.b.d.0.1.0.0.2.ip6.arpa.": LocalZoneNxdomain,
+
+	// tells browsers not to switch to their own DNS-over-HTTPS resolver behind our back
+	// https://support.mozilla.org/en-US/kb/canary-domain-use-application-dnsnet
+	"use-application-dns.net.": LocalZoneNxdomain,
+}
+
+func init() {
+	// RFC 6303 section 4.2, 172.16.0.0/12
+	for i := 16; i <= 31; i++ {
+		defaultLocalZones[fmt.Sprintf("%d.172.in-addr.arpa.", i)] = LocalZoneNxdomain
+	}
+	// RFC 7793, 100.64.0.0/10 shared address space
+	for i := 64; i <= 127; i++ {
+		defaultLocalZones[fmt.Sprintf("%d.100.in-addr.arpa.", i)] = LocalZoneNxdomain
+	}
+}
+
+// The set of zones answered by this server
+type LocalZones struct {
+	// maps lowercased, fully qualified zones to what should be done with them
+	zones map[string]string
+}
+
+// builds the local zones from the defaults, with overrides laid on top
+func NewLocalZones(overrides map[string]string) (*LocalZones, error) {
+	l := &LocalZones{zones: make(map[string]string)}
+	for zone, action := range defaultLocalZones {
+		l.zones[zone] = action
+	}
+	for zone, action := range overrides {
+		switch action {
+		case LocalZoneNxdomain, LocalZoneLoopback, LocalZoneForward:
+		default:
+			return nil, fmt.Errorf("unknown action [%s] for local zone [%s]", action, zone)
+		}
+		l.zones[strings.ToLower(dns.Fqdn(zone))] = action
+	}
+	return l, nil
+}
+
+// builds the SOA record that goes in the authority section of negative answers
+func localZoneSoa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: localZoneTtl},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  localZoneTtl,
+	}
+}
+
+// answers a query for a local zone, returns false if the domain should go upstream
+func (l *LocalZones) Answer(domain string, rrtype uint16) (Response, string, bool) {
+	if l == nil {
+		return Response{}, "", false
+	}
+	zone, action, ok := longestSuffixMatch(l.zones, domain)
+	if !ok || action == LocalZoneForward {
+		return Response{}, "", false
+	}
+
+	name := dns.Fqdn(domain)
+	// RFC 6303 zones are served as (empty) zones, so their apex exists. Special-use
+	// names, and especially the DoH canary, need NXDOMAIN all the way up.
+	apex := strings.EqualFold(name, zone) && strings.HasSuffix(zone, ".arpa.")
+	msg := dns.Msg{}
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Rrtype: rrtype, Ttl: localZoneTtl}
+	switch {
+	case action == LocalZoneLoopback && rrtype == dns.TypeA:
+		msg.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}}
+	case action == LocalZoneLoopback && rrtype == dns.TypeAAAA:
+		msg.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}}
+	case action == LocalZoneLoopback:
+		// the name exists, it just doesn't have this type
+		msg.Ns = []dns.RR{localZoneSoa(zone)}
+	case apex && rrtype == dns.TypeSOA:
+		msg.Answer = []dns.RR{localZoneSoa(zone)}
+	case apex:
+		// the apex of a locally-served zone exists, but is empty
+		msg.Ns = []dns.RR{localZoneSoa(zone)}
+	default:
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = []dns.RR{localZoneSoa(zone)}
+	}
+
+	return Response{
+		Key:          domain,
+		Entry:        msg,
+		Ttl:          time.Duration(localZoneTtl) * time.Second,
+		Qtype:        rrtype,
+		CreationTime: time.Now(),
+	}, zone, true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestLocalZoneDefaults(t *testing.T) {
+	zones, err := NewLocalZones(nil)
+	if err != nil {
+		t.Fatalf("could not build local zones: %s", err)
+	}
+
+	nxdomains := []string{
+		"1.1.168.192.in-addr.arpa.",
+		"4.3.20.172.in-addr.arpa.",
+		"1.0.0.10.IN-ADDR.ARPA.",
+		"printer.local.",
+		"host.internal.",
+		"anything.invalid.",
+		"use-application-dns.net.",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.",
+	}
+	for _, name := range nxdomains {
+		response, _, ok := zones.Answer(name, dns.TypePTR)
+		if !ok {
+			t.Errorf("[%s] wasn't answered locally", name)
+			continue
+		}
+		if response.Entry.Rcode != dns.RcodeNameError || len(response.Entry.Ns) != 1 {
+			t.Errorf("[%s] didn't get NXDOMAIN with an SOA: [%v]", name, response.Entry)
+		}
+	}
+
+	for _, name := range []string{"example.com.", "1.1.1.1.in-addr.arpa.", "4.3.32.172.in-addr.arpa."} {
+		if response, _, ok := zones.Answer(name, dns.TypeA); ok {
+			t.Errorf("[%s] should have gone upstream, was answered with [%v]", name, response.Entry)
+		}
+	}
+
+	// the apex exists, it's just empty
+	response, zone, _ := zones.Answer("168.192.in-addr.arpa.", dns.TypeNS)
+	if response.Entry.Rcode != dns.RcodeSuccess || len(response.Entry.Answer) != 0 || zone != "168.192.in-addr.arpa." {
+		t.Errorf("local zone apex didn't get NODATA: [%v]", response.Entry)
+	}
+}
+
+func TestLocalZoneLoopback(t *testing.T) {
+	zones, err := NewLocalZones(nil)
+	if err != nil {
+		t.Fatalf("could not build local zones: %s", err)
+	}
+
+	response, _, ok := zones.Answer("localhost.", dns.TypeA)
+	if !ok || len(response.Entry.Answer) != 1 || !response.Entry.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("localhost didn't resolve to the IPv4 loopback: [%v]", response.Entry)
+	}
+
+	response, _, ok = zones.Answer("www.localhost.", dns.TypeAAAA)
+	if !ok || len(response.Entry.Answer) != 1 || !response.Entry.Answer[0].(*dns.AAAA).AAAA.Equal(net.IPv6loopback) {
+		t.Fatalf("name under localhost didn't resolve to the IPv6 loopback: [%v]", response.Entry)
+	}
+
+	response, _, ok = zones.Answer("localhost.", dns.TypeMX)
+	if !ok || response.Entry.Rcode != dns.RcodeSuccess || len(response.Entry.Answer) != 0 {
+		t.Fatalf("localhost didn't get NODATA for MX: [%v]", response.Entry)
+	}
+}
+
+func TestLocalZoneOverrides(t *testing.T) {
+	zones, err := NewLocalZones(map[string]string{
+		"10.in-addr.arpa": LocalZoneForward,
+		"lan":             LocalZoneNxdomain,
+	})
+	if err != nil {
+		t.Fatalf("could not build local zones: %s", err)
+	}
+
+	if _, _, ok := zones.Answer("1.0.0.10.in-addr.arpa.", dns.TypePTR); ok {
+		t.Fatalf("zone overridden to forward was answered locally")
+	}
+
+	if _, _, ok := zones.Answer("nas.lan.", dns.TypeA); !ok {
+		t.Fatalf("zone added by override wasn't answered locally")
+	}
+
+	if _, err := NewLocalZones(map[string]string{"lan": "bogus"}); err == nil {
+		t.Fatalf("unknown local zone action was accepted")
+	}
+}
+
+func TestLocalZoneRoutingSpecificity(t *testing.T) {
+	zones, err := NewLocalZones(nil)
+	if err != nil {
+		t.Fatalf("could not build local zones: %s", err)
+	}
+	server := &MutexServer{localZones: zones, router: NewDomainRouter()}
+	for domain, group := range map[string]string{
+		".":                    "catchall",
+		"arpa.":                "reverse",
+		"corp.10.in-addr.arpa": "corp",
+		"168.192.in-addr.arpa": "home",
+	} {
+		if err := server.router.AddRule(domain, group); err != nil {
+			t.Fatalf("could not add rule: %s", err)
+		}
+	}
+
+	// broader rules don't let the private zones under them out
+	for _, domain := range []string{"1.0.0.10.in-addr.arpa.", "printer.local.", "example.internal."} {
+		if _, _, ok := server.answerLocally(domain, dns.TypePTR); !ok {
+			t.Errorf("[%s] was sent upstream because of a broader routing rule", domain)
+		}
+	}
+
+	// rules that are at least as specific as the local zone win
+	for _, domain := range []string{"1.corp.10.in-addr.arpa.", "1.1.168.192.in-addr.arpa."} {
+		if _, _, ok := server.answerLocally(domain, dns.TypePTR); ok {
+			t.Errorf("[%s] was answered locally despite being routed to a group", domain)
+		}
+	}
+}
@@ -79,6 +79,14 @@ func (l logger) output(output string) {
 	fmt.Fprintf(l.handle, "%s\n", output)
 }
 
+// flushes the underlying handle to disk, if it's the sort of handle that can be flushed
+func (l logger) Flush() error {
+	if syncer, ok := l.handle.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
 func (l logger) SetLevel(level LogLevel) {
 	l.level = level
 }
@@ -180,3 +188,11 @@ func InitLoggers() error {
 
 	return nil
 }
+
+// flushes all loggers, used on shutdown so that nothing gets lost in the buffers
+func FlushLoggers() {
+	// errors are ignored: stdout and stderr can't always be synced and there's
+	// nowhere left to complain to anyway
+	Logger.Flush()
+	QueryLogger.Flush()
+}
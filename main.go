@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/miekg/dns"
@@ -10,8 +9,9 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"strconv"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -43,34 +43,20 @@ func validateFlags() error {
 
 func runBlackholeServer() error {
 	config := GetConfiguration()
-	switch config.ListenProtocol {
-	case "tcp-tls":
-		srv := &dns.Server{Addr: ":" + strconv.Itoa(config.DnsPort), Net: "tcp-tls", MaxTCPQueries: -1, ReusePort: true}
-		log.Printf("starting tls blackhole server")
-		if (config.TlsConfig == tlsConfig{}) {
-			log.Fatalf("attempted to listen for TLS connections, but no tls config was defined")
-		}
-		if config.TlsConfig.CertificateFile == "" {
-			log.Fatalf("invalid certificate file in configuration")
-		}
-
-		if config.TlsConfig.PrivateKeyFile == "" {
-			log.Fatalf("invalid private key in configuration")
-		}
-
-		cert, err := tls.LoadX509KeyPair(config.TlsConfig.CertificateFile, config.TlsConfig.PrivateKeyFile)
-		if err != nil {
-			log.Fatalf("could not load tls files")
-		}
-
-		srv.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
+	srvs, err := buildDnsServers(dnsListeners(config.ListenProtocol), &BlackholeServer{})
+	if err != nil {
+		return err
+	}
+	if err := closeUnclaimedSockets(); err != nil {
+		for _, srv := range srvs {
+			closeDnsServerSocket(srv)
 		}
-		srv.Handler = &BlackholeServer{}
-		return srv.ListenAndServe()
-	default:
-		return fmt.Errorf("unsupported protocol [%s]", config.ListenProtocol)
+		return err
 	}
+	log.Printf("starting blackhole server")
+	serveDns(srvs)
+	notifySystemd("READY=1")
+	return nil
 }
 
 func loadLocalZones(server Server) {
@@ -99,18 +85,146 @@ func addServer(s *dns.Server) {
 	servers = append(servers, s)
 }
 
-var shutdownMutex *sync.Mutex = &sync.Mutex{}
+// starts serving DNS on servers whose sockets are already open
+func serveDns(srvs []*dns.Server) {
+	for _, srv := range srvs {
+		addServer(srv)
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				Logger.Log(LogMessage{
+					Level: CRITICAL,
+					Context: LogContext{
+						"what":     "error serving DNS",
+						"protocol": srv.Net,
+						"address":  srv.Addr,
+						"error":    err.Error(),
+					},
+				})
+				// bail here so it doesn't wait forever on a shutdown that will never come
+				os.Exit(1)
+			}
+		}(srv)
+	}
+}
+
+// the handler behind the DNS servers, it gets drained on shutdown
+var resolver Server
+
+func setResolver(s Server) {
+	resolver = s
+}
+
+// checks on the upstreams in the background, nil when probing is disabled
+var prober *upstreamProber
+
+// closes pooled connections that have been around too long
+var reaper *connReaper
+
+// keeps idle connections ready ahead of queries, nil when there's no minimum
+var warmer *connWarmer
+
+// looks upstream hostnames back up, nil when there's nothing to look up
+var bootstrapper *upstreamBootstrapper
+
+// keeps systemd's watchdog happy, nil when systemd didn't ask for one
+var watchdog *systemdWatchdog
 
+var shutdownOnce sync.Once
+
+// closed once shutdown has finished, main waits on this before exiting
+var shutdownComplete chan struct{} = make(chan struct{})
+
+// Stops accepting queries, drains the ones in flight and tears everything down.
+// This is safe to call more than once, only the first call does anything.
 func Shutdown() {
-	shutdownMutex.Lock()
-	defer shutdownMutex.Unlock()
-	for _, s := range servers {
-		ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	shutdownOnce.Do(func() {
+		defer close(shutdownComplete)
+		config := GetConfiguration()
+		timeout := time.Duration(5000) * time.Millisecond
+		if config.ShutdownTimeout != 0 {
+			timeout = config.ShutdownTimeout * time.Millisecond
+		}
+		// everything shares one deadline so that the whole process is bounded
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
-		if err := s.ShutdownContext(ctx); err != nil {
-			log.Printf("error shutting down server [%v] : %s", s, err)
+
+		Logger.Log(NewLogMessage(
+			CRITICAL,
+			LogContext{
+				"what":    "shutting down",
+				"timeout": fmt.Sprintf("%s", timeout),
+			},
+			nil,
+		))
+		notifySystemd("STOPPING=1")
+
+		if watchdog != nil {
+			watchdog.Stop()
 		}
-	}
+
+		// stop taking new queries first
+		for _, s := range servers {
+			if err := s.ShutdownContext(ctx); err != nil {
+				log.Printf("error shutting down server [%v] : %s", s, err)
+			}
+		}
+
+		if HttpServer != nil {
+			if err := HttpServer.Shutdown(ctx); err != nil {
+				log.Printf("error shutting down HTTP server: %s", err)
+			}
+		}
+
+		if prober != nil {
+			prober.Stop()
+		}
+
+		if warmer != nil {
+			warmer.Stop()
+		}
+
+		if bootstrapper != nil {
+			bootstrapper.Stop()
+		}
+
+		if reaper != nil {
+			reaper.Stop()
+		}
+
+		if resolver != nil {
+			if err := resolver.Shutdown(ctx); err != nil {
+				log.Printf("error shutting down resolver: %s", err)
+			}
+		}
+
+		Logger.Log(NewLogMessage(
+			CRITICAL,
+			LogContext{
+				"what": "shutdown complete",
+			},
+			nil,
+		))
+		FlushLoggers()
+	})
+}
+
+// shuts down cleanly when systemd (or a human) asks us to
+func handleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		Logger.Log(NewLogMessage(
+			CRITICAL,
+			LogContext{
+				"what":   "received signal",
+				"signal": sig.String(),
+				"next":   "shutting down",
+			},
+			nil,
+		))
+		Shutdown()
+	}()
 }
 
 func main() {
@@ -136,7 +250,13 @@ func main() {
 	config := GetConfiguration()
 
 	InitLoggers()
-	InitApi()
+
+	// this has to happen before any of the listeners are set up, they might want these sockets
+	sockets, err := takeActivatedSockets()
+	if err != nil {
+		log.Fatalf("could not take sockets passed in by systemd: %s\n", err)
+	}
+	activatedSockets = sockets
 
 	server, err := NewMutexServer(nil, nil)
 	if err != nil {
@@ -151,20 +271,11 @@ func main() {
 	}
 
 	loadLocalZones(server)
+	setResolver(server)
 
-	dnsPort := config.DnsPort
-	if dnsPort == 0 {
-		dnsPort = 53
-	}
-
-	// set up DNS server
-	srvUDP := &dns.Server{Addr: ":" + strconv.Itoa(dnsPort), Net: "udp", MaxTCPQueries: -1, ReusePort: true}
-	srvTCP := &dns.Server{Addr: ":" + strconv.Itoa(dnsPort), Net: "tcp", MaxTCPQueries: -1, ReusePort: true}
-
-	srvUDP.Handler, srvTCP.Handler = server, server
-
-	addServer(srvUDP)
-	addServer(srvTCP)
+	// the API resolves through the resolver, so it can only come up once that's set
+	InitApi()
+	handleSignals()
 
 	if config.Blackhole {
 		// PSYCH!
@@ -178,41 +289,65 @@ func main() {
 			})
 			os.Exit(1)
 		}
+		// wait until the blackhole servers have been shut down
+		<-shutdownComplete
+		return
 	}
 
-	Logger.Log(LogMessage{
-		Level: CRITICAL,
-		Context: LogContext{
-			"what":    "starting up TCP and UDP servers",
-			"version": GetVersion().String(),
-			"port":    fmt.Sprintf("%d", dnsPort),
-		},
-	})
-
-	go func(srvUDP *dns.Server) {
-		if err := srvUDP.ListenAndServe(); err != nil {
-			Logger.Log(LogMessage{
-				Level: CRITICAL,
-				Context: LogContext{
-					"what":  "error serving UDP",
-					"error": err.Error(),
-				},
-			})
-		}
-	}(srvUDP)
-
-	if err := srvTCP.ListenAndServe(); err != nil {
+	// set up DNS servers, the sockets get opened now so that a bad listener stops startup
+	srvs, err := buildDnsServers(dnsListeners(""), server)
+	if err != nil {
 		Logger.Log(LogMessage{
 			Level: CRITICAL,
 			Context: LogContext{
-				"what":  "error serving TCP",
+				"what":  "could not open DNS listeners",
 				"error": err.Error(),
 			},
 		})
-		// bail here so it doesn't deadlock on the shutdown mutex
 		os.Exit(1)
 	}
+	if err := closeUnclaimedSockets(); err != nil {
+		Logger.Log(LogMessage{
+			Level: CRITICAL,
+			Context: LogContext{
+				"what":  "sockets passed in by systemd were left unused",
+				"error": err.Error(),
+			},
+		})
+		os.Exit(1)
+	}
+
+	if prober = NewUpstreamProber(server.GetDnsClient(), server.GetUpstreamGroups()); prober != nil {
+		prober.Start()
+	}
+	reaper = NewConnReaper(server.GetUpstreamGroups())
+	reaper.Start()
+	if warmer = NewConnWarmer(server.GetDnsClient(), server.GetUpstreamGroups()); warmer != nil {
+		warmer.Start()
+	}
+	if bootstrapper = NewUpstreamBootstrapper(server.GetDnsClient()); bootstrapper != nil {
+		bootstrapper.Start()
+	}
+
+	for _, srv := range srvs {
+		Logger.Log(LogMessage{
+			Level: CRITICAL,
+			Context: LogContext{
+				"what":     "starting up DNS server",
+				"version":  GetVersion().String(),
+				"protocol": srv.Net,
+				"address":  srv.Addr,
+			},
+		})
+	}
+	serveDns(srvs)
+
+	// upstreams and zones are loaded and the listeners are open
+	notifySystemd("READY=1")
+	if watchdog = NewSystemdWatchdog(server); watchdog != nil {
+		watchdog.Start()
+	}
 
 	// wait until all shutdowns are complete
-	shutdownMutex.Lock()
+	<-shutdownComplete
 }
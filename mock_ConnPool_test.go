@@ -3,8 +3,12 @@
 package main
 
 import (
+	context "context"
+
 	dns "github.com/miekg/dns"
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // MockConnPool is an autogenerated mock type for the ConnPool type
@@ -36,13 +40,25 @@ func (_m *MockConnPool) CloseConnection(ce *ConnEntry) {
 	_m.Called(ce)
 }
 
-// Get provides a mock function with given fields:
-func (_m *MockConnPool) Get() (*ConnEntry, Upstream, error) {
-	ret := _m.Called()
+// CloseAll provides a mock function with given fields:
+func (_m *MockConnPool) CloseAll() {
+	_m.Called()
+}
+
+// Get provides a mock function with given fields: ctx, exclude
+func (_m *MockConnPool) Get(ctx context.Context, exclude ...string) (*ConnEntry, Upstream, error) {
+	_va := make([]interface{}, len(exclude))
+	for _i := range exclude {
+		_va[_i] = exclude[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
 
 	var r0 *ConnEntry
-	if rf, ok := ret.Get(0).(func() *ConnEntry); ok {
-		r0 = rf()
+	if rf, ok := ret.Get(0).(func(context.Context, ...string) *ConnEntry); ok {
+		r0 = rf(ctx, exclude...)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*ConnEntry)
@@ -50,15 +66,15 @@ func (_m *MockConnPool) Get() (*ConnEntry, Upstream, error) {
 	}
 
 	var r1 Upstream
-	if rf, ok := ret.Get(1).(func() Upstream); ok {
-		r1 = rf()
+	if rf, ok := ret.Get(1).(func(context.Context, ...string) Upstream); ok {
+		r1 = rf(ctx, exclude...)
 	} else {
 		r1 = ret.Get(1).(Upstream)
 	}
 
 	var r2 error
-	if rf, ok := ret.Get(2).(func() error); ok {
-		r2 = rf()
+	if rf, ok := ret.Get(2).(func(context.Context, ...string) error); ok {
+		r2 = rf(ctx, exclude...)
 	} else {
 		r2 = ret.Error(2)
 	}
@@ -94,6 +110,46 @@ func (_m *MockConnPool) NewConnection(upstream Upstream, dialFunc func(string) (
 	return r0, r1
 }
 
+// Reap provides a mock function with given fields:
+func (_m *MockConnPool) Reap() {
+	_m.Called()
+}
+
+// ReserveDial provides a mock function with given fields: ctx, upstream
+func (_m *MockConnPool) ReserveDial(ctx context.Context, upstream Upstream) error {
+	ret := _m.Called(ctx, upstream)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, Upstream) error); ok {
+		r0 = rf(ctx, upstream)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// RttPercentile provides a mock function with given fields: address, percentile
+func (_m *MockConnPool) RttPercentile(address string, percentile float64) (time.Duration, bool) {
+	ret := _m.Called(address, percentile)
+
+	var r0 time.Duration
+	if rf, ok := ret.Get(0).(func(string, float64) time.Duration); ok {
+		r0 = rf(address, percentile)
+	} else {
+		r0 = ret.Get(0).(time.Duration)
+	}
+
+	var r1 bool
+	if rf, ok := ret.Get(1).(func(string, float64) bool); ok {
+		r1 = rf(address, percentile)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
+}
+
 // Size provides a mock function with given fields:
 func (_m *MockConnPool) Size() int {
 	ret := _m.Called()
@@ -108,7 +164,44 @@ func (_m *MockConnPool) Size() int {
 	return r0
 }
 
+// Stats provides a mock function with given fields:
+func (_m *MockConnPool) Stats() []UpstreamStats {
+	ret := _m.Called()
+
+	var r0 []UpstreamStats
+	if rf, ok := ret.Get(0).(func() []UpstreamStats); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]UpstreamStats)
+		}
+	}
+
+	return r0
+}
+
 // Unlock provides a mock function with given fields:
 func (_m *MockConnPool) Unlock() {
 	_m.Called()
 }
+
+// Upstreams provides a mock function with given fields:
+func (_m *MockConnPool) Upstreams() []Upstream {
+	ret := _m.Called()
+
+	var r0 []Upstream
+	if rf, ok := ret.Get(0).(func() []Upstream); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]Upstream)
+		}
+	}
+
+	return r0
+}
+
+// Warm provides a mock function with given fields: dialFunc
+func (_m *MockConnPool) Warm(dialFunc func(string) (*dns.Conn, error)) {
+	_m.Called(dialFunc)
+}
@@ -3,6 +3,8 @@
 package main
 
 import (
+	context "context"
+
 	dns "github.com/miekg/dns"
 	mock "github.com/stretchr/testify/mock"
 )
@@ -88,6 +90,22 @@ func (_m *MockServer) GetHostedCache() *RecordCache {
 	return r0
 }
 
+// GetUpstreamGroups provides a mock function with given fields:
+func (_m *MockServer) GetUpstreamGroups() map[string]ConnPool {
+	ret := _m.Called()
+
+	var r0 map[string]ConnPool
+	if rf, ok := ret.Get(0).(func() map[string]ConnPool); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]ConnPool)
+		}
+	}
+
+	return r0
+}
+
 // HandleDNS provides a mock function with given fields: w, m
 func (_m *MockServer) HandleDNS(w ResponseWriter, m *dns.Msg) {
 	_m.Called(w, m)
@@ -149,7 +167,51 @@ func (_m *MockServer) RetrieveRecords(domain string, rrtype uint16) (Response, s
 	return r0, r1, r2
 }
 
+// RetrieveRecordsWithTrace provides a mock function with given fields: domain, rrtype, skipCache
+func (_m *MockServer) RetrieveRecordsWithTrace(domain string, rrtype uint16, skipCache bool) (Response, *QueryTrace, error) {
+	ret := _m.Called(domain, rrtype, skipCache)
+
+	var r0 Response
+	if rf, ok := ret.Get(0).(func(string, uint16, bool) Response); ok {
+		r0 = rf(domain, rrtype, skipCache)
+	} else {
+		r0 = ret.Get(0).(Response)
+	}
+
+	var r1 *QueryTrace
+	if rf, ok := ret.Get(1).(func(string, uint16, bool) *QueryTrace); ok {
+		r1 = rf(domain, rrtype, skipCache)
+	} else {
+		if ret.Get(1) != nil {
+			r1 = ret.Get(1).(*QueryTrace)
+		}
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string, uint16, bool) error); ok {
+		r2 = rf(domain, rrtype, skipCache)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // ServeDNS provides a mock function with given fields: w, r
 func (_m *MockServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	_m.Called(w, r)
 }
+
+// Shutdown provides a mock function with given fields: ctx
+func (_m *MockServer) Shutdown(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -11,6 +11,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/semaphore"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type MutexServer struct {
@@ -20,9 +24,18 @@ type MutexServer struct {
 	// cache of records hosted by this server
 	HostedCache *RecordCache
 
-	// connection pool
+	// connection pool for the default upstream group
 	connPool ConnPool
 
+	// connection pools for the other upstream groups, keyed by group name
+	groups map[string]ConnPool
+
+	// decides which group gets a given query
+	router *DomainRouter
+
+	// zones that are answered here instead of going upstream
+	localZones *LocalZones
+
 	// worker pool semaphore
 	sem *semaphore.Weighted
 
@@ -30,12 +43,21 @@ type MutexServer struct {
 	dnsClient Client
 
 	RWLock Lock
+
+	// tracks queries that are currently being resolved so that shutdown can wait on them
+	inflight sync.WaitGroup
+
+	// set once shutdown starts, new queries will be turned away
+	shuttingDown bool
+
+	// keeps hedged queries to a fraction of traffic, see hedge.go
+	hedges hedgeBudget
 }
 
-func (s *MutexServer) newConnection(upstream Upstream) (ce *ConnEntry, err error) {
+func (s *MutexServer) newConnection(pool ConnPool, upstream Upstream) (ce *ConnEntry, err error) {
 	// we're supposed to connect to this upstream, no existing connections
 	// (this doesn't block)
-	ce, err = s.connPool.NewConnection(upstream, s.dnsClient.Dial)
+	ce, err = pool.NewConnection(upstream, s.dnsClient.Dial)
 	if err != nil {
 		// leaving this at DEBUG since we're passing the actual error up
 		address := upstream.GetAddress()
@@ -54,30 +76,40 @@ func (s *MutexServer) newConnection(upstream Upstream) (ce *ConnEntry, err error
 }
 
 func (s *MutexServer) GetConnection() (ce *ConnEntry, err error) {
+	ce, _, err = s.getConnection(s.connPool)
+	return
+}
+
+// how long to wait for a connection when the pool is at its limits
+func connectionWaitTimeout() time.Duration {
+	config := GetConfiguration()
+	if config.ConnectionWaitTimeout != 0 {
+		return config.ConnectionWaitTimeout * time.Millisecond
+	}
+	if config.Timeout != 0 {
+		return config.Timeout * time.Millisecond
+	}
+	return time.Duration(500) * time.Millisecond
+}
+
+// retrieves a connection from a given pool, dialTime will be 0 if the connection came out of the pool,
+// upstreams with the excluded addresses won't be used
+func (s *MutexServer) getConnection(pool ConnPool, exclude ...string) (ce *ConnEntry, dialTime time.Duration, err error) {
 	// There are 3 cases: cache miss, cache hit, and error
 	// responses:
 	// 	cache miss, no error: attempt to make a new connection
 	//  cache hit: return the conn entry
 	//  error: return the error and an empty conn entry
-	// first check the conn pool (this blocks)
-	ce, upstream, err := s.connPool.Get()
+	// first check the conn pool (this blocks, for up to the wait timeout if the pool is at its limits)
+	ctx, cancel := context.WithTimeout(context.Background(), connectionWaitTimeout())
+	defer cancel()
+	ce, upstream, err := pool.Get(ctx, exclude...)
 	if err == nil && (upstream != Upstream{}) {
 		// cache miss, no error
-		Logger.Log(NewLogMessage(
-			INFO,
-			LogContext{
-				"what":    "creating new connection",
-				"address": upstream.GetAddress(),
-			},
-			func() string { return fmt.Sprintf("upstream [%v]", upstream) },
-		))
-
-		if ce, err = s.newConnection(upstream); err != nil {
-			return &ConnEntry{}, err
-		}
+		return s.dialConnection(pool, upstream)
 	} else if err != nil {
 		// error
-		return &ConnEntry{}, err
+		return &ConnEntry{}, 0, err
 	}
 
 	// cache hit
@@ -92,16 +124,48 @@ func (s *MutexServer) GetConnection() (ce *ConnEntry, err error) {
 		},
 		nil,
 	))
-	return ce, nil
+	return ce, dialTime, nil
+}
+
+// makes a new connection to a given upstream, returning how long it took
+func (s *MutexServer) dialConnection(pool ConnPool, upstream Upstream) (ce *ConnEntry, dialTime time.Duration, err error) {
+	Logger.Log(NewLogMessage(
+		INFO,
+		LogContext{
+			"what":    "creating new connection",
+			"address": upstream.GetAddress(),
+		},
+		func() string { return fmt.Sprintf("upstream [%v]", upstream) },
+	))
+
+	dialStart := time.Now()
+	if ce, err = s.newConnection(pool, upstream); err != nil {
+		return &ConnEntry{}, time.Now().Sub(dialStart), err
+	}
+	return ce, time.Now().Sub(dialStart), nil
 }
 
 func (s *MutexServer) AddUpstream(r *Upstream) {
 	s.connPool.AddUpstream(r)
 }
 
-func (s *MutexServer) attemptExchange(m *dns.Msg) (ce *ConnEntry, reply *dns.Msg, err error) {
-	ce, err = s.GetConnection()
+// runs a single exchange, recording what happened in the attempt
+func (s *MutexServer) attemptExchange(pool ConnPool, m *dns.Msg, attempt *TraceAttempt, exclude ...string) (ce *ConnEntry, reply *dns.Msg, err error) {
+	ce, err = s.checkoutConnection(pool, attempt, exclude...)
+	if err != nil {
+		return ce, nil, err
+	}
+	return s.exchange(pool, ce, m, attempt)
+}
+
+// gets a connection for an attempt, recording where it came from
+func (s *MutexServer) checkoutConnection(pool ConnPool, attempt *TraceAttempt, exclude ...string) (ce *ConnEntry, err error) {
+	ce, dialTime, err := s.getConnection(pool, exclude...)
+	if dialTime != 0 {
+		attempt.DialTime = fmt.Sprintf("%s", dialTime)
+	}
 	if err != nil {
+		attempt.Error = err.Error()
 		Logger.Log(LogMessage{
 			Level: INFO,
 			Context: LogContext{
@@ -109,29 +173,43 @@ func (s *MutexServer) attemptExchange(m *dns.Msg) (ce *ConnEntry, reply *dns.Msg
 				"error": err.Error(),
 			},
 		})
-		return ce, nil, fmt.Errorf("error getting connection from pool: %s", err.Error())
+		return ce, &attemptError{reason: RetryReasonConnection, err: fmt.Errorf("error getting connection from pool: %s", err.Error())}
 	}
 
+	attempt.Address = ce.GetAddress()
+	attempt.ReusedConnection = dialTime == 0
+	return ce, nil
+}
+
+// runs a query over a connection, failed exchanges close the connection
+func (s *MutexServer) exchange(pool ConnPool, ce *ConnEntry, m *dns.Msg, attempt *TraceAttempt) (*ConnEntry, *dns.Msg, error) {
 	address := ce.GetAddress()
 	exchangeTimer := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
 		ExchangeTimer.WithLabelValues(address).Observe(v)
 	}),
 	)
-	reply, rtt, err := s.dnsClient.ExchangeWithConn(m, ce.Conn.(*dns.Conn))
+	reply, rtt, err := exchangeOn(s.dnsClient, ce, m)
 	exchangeTimer.ObserveDuration()
-	ce.AddExchange(rtt)
+	attempt.Rtt = fmt.Sprintf("%s", rtt)
+	if err == nil {
+		err = s.checkReply(address, m, reply)
+	}
 	if err != nil {
-		/**
-			Not doing this, treating EOF errors as a sign that the server wants us to stfu
-		// a feeble attempt to filter out errors that are just the server cleaning up
-		// resources
-		if err.Error() != "EOF" {
+		attempt.Error = err.Error()
+		reason := classifyExchangeError(err, attempt.ReusedConnection)
+		if reason == RetryReasonStale {
+			// the upstream cleaned up a connection we had pooled, that's not worth cooling it over
+			ce.stale = true
+		} else {
 			ce.AddError()
+			UpstreamErrorsCounter.WithLabelValues(address).Inc()
+		}
+		pool.CloseConnection(ce)
+		// with TLS 1.3 the upstream checks our client certificate after the handshake has
+		// already finished on our end, so the rejection only shows up on the first read
+		if reason := connectionFailureReason(err); reason == "client_certificate_rejected" {
+			FailedConnectionsCounter.WithLabelValues(address, reason).Inc()
 		}
-		**/
-		ce.AddError()
-		s.connPool.CloseConnection(ce)
-		UpstreamErrorsCounter.WithLabelValues(address).Inc()
 		Logger.Log(LogMessage{
 			Level: DEBUG,
 			Context: LogContext{
@@ -141,52 +219,71 @@ func (s *MutexServer) attemptExchange(m *dns.Msg) (ce *ConnEntry, reply *dns.Msg
 			},
 		})
 		// try the next one
-		return &ConnEntry{}, &dns.Msg{}, fmt.Errorf("error looking up domain [%s] on server [%s]", m.Question[0].Name, address)
+		return &ConnEntry{}, &dns.Msg{}, &attemptError{
+			reason:   reason,
+			upstream: ce.upstream,
+			err:      fmt.Errorf("error looking up domain [%s] on server [%s]: %w", m.Question[0].Name, address, err),
+		}
 	}
+	// failed exchanges cool the upstream instead of weighing it down
+	ce.AddExchange(rtt)
 	return ce, reply, nil
 }
 
+// Rejects replies that aren't for the query and drops records that don't belong in them,
+// the reply can only be cached after this
+func (s *MutexServer) checkReply(address string, m *dns.Msg, reply *dns.Msg) error {
+	if err := validateReply(m, reply); err != nil {
+		RejectedRepliesCounter.WithLabelValues(address, err.(*invalidReplyError).reason).Inc()
+		return err
+	}
+
+	if dropped := trimBailiwick(reply); dropped > 0 {
+		OutOfBailiwickRecordsCounter.WithLabelValues(address).Add(float64(dropped))
+		Logger.Log(NewLogMessage(
+			WARNING,
+			LogContext{
+				"what":    "dropped out of bailiwick records from upstream reply",
+				"address": address,
+				"name":    m.Question[0].Name,
+				"dropped": strconv.Itoa(dropped),
+				"next":    "using the rest of the reply",
+			},
+			nil,
+		))
+	}
+	return nil
+}
+
 func (s *MutexServer) RecursiveQuery(domain string, rrtype uint16) (resp Response, address string, err error) {
+	return s.recursiveQuery(domain, rrtype, nil)
+}
+
+func (s *MutexServer) recursiveQuery(domain string, rrtype uint16, trace *QueryTrace) (resp Response, address string, err error) {
 	RecursiveQueryCounter.Inc()
 
 	m := &dns.Msg{}
 	m.SetQuestion(domain, rrtype)
 	m.RecursionDesired = true
 
-	config := GetConfiguration()
+	group, pool := s.routeQuery(domain)
+	RoutedQueriesCounter.WithLabelValues(group).Inc()
+	trace.SetGroup(group)
 
-	// to avoid locals in the loop overriding what we need on the outer level
-	// predefine the vars here
-	var ce *ConnEntry
-	var r *dns.Msg
-	for i := 0; i <= config.UpstreamRetries; i++ {
-		if ce, r, err = s.attemptExchange(m); err == nil {
-			break
-		}
-		if err != nil {
-			Logger.Log(NewLogMessage(
-				WARNING,
-				LogContext{
-					"what":  "failed exchange with upstreams",
-					"error": err.Error(),
-					"next":  fmt.Sprintf("retrying until config.UpstreamRetries is met. currently on attempt [%d]/[%d]", i, config.UpstreamRetries),
-				},
-				nil,
-			))
-		}
-		// continue trying
-	}
+	ce, r, err := s.exchangeWithRetries(pool, group, m, trace)
 
 	if err != nil {
 		// we failed to complete any exchanges
+		UpstreamGroupFailuresCounter.WithLabelValues(group).Inc()
 		Logger.Log(NewLogMessage(
 			ERROR,
 			LogContext{
 				"what":    "failed to complete any exchanges with upstreams",
+				"group":   group,
 				"error":   err.Error(),
 				"note":    "this is the most recent error, other errors may have been logged during the failed attempt(s)",
 				"address": domain,
-				"rrtype":  string(rrtype),
+				"rrtype":  dns.Type(rrtype).String(),
 				"next":    "aborting query attempt",
 			},
 			nil,
@@ -194,7 +291,7 @@ func (s *MutexServer) RecursiveQuery(domain string, rrtype uint16) (resp Respons
 		return Response{}, "", fmt.Errorf("failed to complete any exchanges with upstreams: %s", err)
 	}
 
-	if err := s.connPool.Add(ce); err != nil {
+	if err := pool.Add(ce); err != nil {
 		Logger.Log(NewLogMessage(
 			ERROR,
 			LogContext{
@@ -214,24 +311,46 @@ func (s *MutexServer) RecursiveQuery(domain string, rrtype uint16) (resp Respons
 // retrieves the record for that domain, either from cache or from
 // a recursive query
 func (s *MutexServer) RetrieveRecords(domain string, rrtype uint16) (Response, string, error) {
-	// First: check caches
+	return s.retrieveRecords(domain, rrtype, nil, false)
+}
 
-	cached_response, ok := s.Cache.Get(domain, rrtype)
-	if ok {
-		CacheHitsCounter.Inc()
-		return cached_response, "cache", nil
+func (s *MutexServer) RetrieveRecordsWithTrace(domain string, rrtype uint16, skipCache bool) (Response, *QueryTrace, error) {
+	trace := NewQueryTrace(domain, dns.Type(rrtype).String(), skipCache)
+	response, source, err := s.retrieveRecords(domain, rrtype, trace, skipCache)
+	trace.Finish(source)
+	return response, trace, err
+}
+
+func (s *MutexServer) retrieveRecords(domain string, rrtype uint16, trace *QueryTrace, skipCache bool) (Response, string, error) {
+	// First: check caches
+	if !skipCache {
+		cached_response, ok := s.Cache.Get(domain, rrtype)
+		trace.AddLookup("cache", ok)
+		if ok {
+			CacheHitsCounter.Inc()
+			return cached_response, "cache", nil
+		}
 	}
 
 	// Now check the hosted cache (stuff in our zone files that we're taking care of)
-	cached_response, ok = s.GetHostedCache().Get(domain, rrtype)
+	cached_response, ok := s.GetHostedCache().Get(domain, rrtype)
+	trace.AddLookup("hosted", ok)
 	if ok {
 		HostedCacheHitsCounter.Inc()
 		return cached_response, "cache", nil
 	}
 
+	// Then the zones that shouldn't leave this server
+	local_response, zone, ok := s.answerLocally(domain, rrtype)
+	trace.AddLookup("local", ok)
+	if ok {
+		LocalZoneAnswersCounter.WithLabelValues(zone).Inc()
+		return local_response, "local", nil
+	}
+
 	// Next , query upstream if there's no cache
 	// TODO only do if requested b/c thats what the spec says IIRC
-	response, source, err := s.RecursiveQuery(domain, rrtype)
+	response, source, err := s.recursiveQuery(domain, rrtype, trace)
 	if err != nil {
 		return response, "", fmt.Errorf("error running recursive query on domain [%s]: %s\n", domain, err)
 	}
@@ -244,6 +363,24 @@ func (s *MutexServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 }
 
 func (s *MutexServer) HandleDNS(w ResponseWriter, r *dns.Msg) {
+	// register the query before anything else so that shutdown can't miss it
+	s.RWLock.RLock()
+	if s.shuttingDown {
+		s.RWLock.RUnlock()
+		Logger.Log(NewLogMessage(
+			WARNING,
+			LogContext{
+				"what": "received query during shutdown",
+				"next": "returning SERVFAIL",
+			},
+			nil,
+		))
+		sendServfail(w, time.Duration(0), r)
+		return
+	}
+	s.inflight.Add(1)
+	s.RWLock.RUnlock()
+
 	TotalDnsQueriesCounter.Inc()
 	// we got this query, but it isn't getting handled until we get the sem
 	QueuedQueriesGauge.Inc()
@@ -270,6 +407,7 @@ func (s *MutexServer) HandleDNS(w ResponseWriter, r *dns.Msg) {
 		panic(err)
 	}
 	go func() {
+		defer s.inflight.Done()
 		defer s.sem.Release(1)
 		// the query is now in motion, no longer queued
 		QueuedQueriesGauge.Dec()
@@ -312,6 +450,133 @@ func (s *MutexServer) GetConnectionPool() (pool ConnPool) {
 	return s.connPool
 }
 
+func (s *MutexServer) GetUpstreamGroups() map[string]ConnPool {
+	ret := map[string]ConnPool{DefaultUpstreamGroup: s.connPool}
+	for name, pool := range s.groups {
+		ret[name] = pool
+	}
+	return ret
+}
+
+// Answers a domain from the local zones, unless a routing rule that's at least as specific as the
+// local zone sends it to an upstream group.  A broad rule like "." or "arpa." doesn't count as
+// asking for the private zones under it to leak upstream.
+func (s *MutexServer) answerLocally(domain string, rrtype uint16) (Response, string, bool) {
+	response, zone, ok := s.localZones.Answer(domain, rrtype)
+	if !ok {
+		return response, zone, false
+	}
+	if routed, _, match := s.router.Match(domain); match && dns.CountLabel(routed) >= dns.CountLabel(zone) {
+		return Response{}, "", false
+	}
+	return response, zone, true
+}
+
+// retrieves the pool for the group that should handle a domain
+func (s *MutexServer) routeQuery(domain string) (group string, pool ConnPool) {
+	group = s.router.Route(domain)
+	if pool, ok := s.groups[group]; ok {
+		return group, pool
+	}
+	return DefaultUpstreamGroup, s.connPool
+}
+
+// builds the pools and routing rules for the configured upstream groups
+func (s *MutexServer) addUpstreamGroups(groups []UpstreamGroupConfig) error {
+	for _, groupConfig := range groups {
+		name := groupConfig.Name
+		if name == "" || name == DefaultUpstreamGroup {
+			return fmt.Errorf("upstream groups need a name other than [%s]", DefaultUpstreamGroup)
+		}
+		if _, ok := s.groups[name]; ok {
+			return fmt.Errorf("upstream group [%s] is defined more than once", name)
+		}
+		if len(groupConfig.Upstreams) == 0 {
+			return fmt.Errorf("upstream group [%s] has no upstreams", name)
+		}
+
+		selection := groupConfig.UpstreamSelection
+		if selection == "" {
+			selection = GetConfiguration().UpstreamSelection
+		}
+		selector, err := NewUpstreamSelector(selection)
+		if err != nil {
+			return fmt.Errorf("invalid upstream group [%s]: %s", name, err)
+		}
+
+		pool := NewGroupConnPool(name, groupConfig.CooldownPeriod, selector)
+		for _, upstreamConfig := range groupConfig.Upstreams {
+			pool.AddUpstream(upstreamConfig.Upstream())
+		}
+		s.groups[name] = pool
+
+		for _, domain := range groupConfig.Domains {
+			if err := s.router.AddRule(domain, name); err != nil {
+				return err
+			}
+		}
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":      "added upstream group",
+				"group":     name,
+				"upstreams": fmt.Sprintf("%d", len(groupConfig.Upstreams)),
+				"domains":   strings.Join(groupConfig.Domains, ","),
+			},
+			nil,
+		))
+	}
+	return nil
+}
+
+func (s *MutexServer) Shutdown(ctx context.Context) error {
+	s.RWLock.Lock()
+	if s.shuttingDown {
+		s.RWLock.Unlock()
+		return fmt.Errorf("server is already shutting down")
+	}
+	s.shuttingDown = true
+	s.RWLock.Unlock()
+
+	Logger.Log(NewLogMessage(
+		WARNING,
+		LogContext{
+			"what": "shutting down server",
+			"next": "waiting for in-flight queries to drain",
+		},
+		nil,
+	))
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("gave up waiting for in-flight queries to drain: %s", ctx.Err())
+		Logger.Log(NewLogMessage(
+			ERROR,
+			LogContext{
+				"what":  "in-flight queries did not drain before the shutdown deadline",
+				"error": err.Error(),
+				"next":  "tearing down anyway",
+			},
+			nil,
+		))
+	}
+
+	s.Cache.StopCleaningCrew()
+	s.HostedCache.StopCleaningCrew()
+	for _, pool := range s.GetUpstreamGroups() {
+		pool.CloseAll()
+	}
+	return err
+}
+
 // never use this outside of tests, please
 func (s *MutexServer) SetConnectionPool(c ConnPool) {
 	s.connPool = c
@@ -339,15 +604,24 @@ func NewMutexServer(cl Client, pool ConnPool) (Server, error) {
 		INFO,
 		LogContext{
 			"what":        "creating server worker pool",
-			"concurrency": string(c),
+			"concurrency": fmt.Sprintf("%d", c),
 		},
 		nil,
 	))
 
 	sem := semaphore.NewWeighted(c)
 
+	localZones, err := NewLocalZones(config.LocalZones)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't set up local zones: %s", err)
+	}
+
 	if pool == nil {
-		pool = NewConnPool()
+		selector, err := NewUpstreamSelector(config.UpstreamSelection)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't set up upstream selection: %s", err)
+		}
+		pool = NewGroupConnPool(DefaultUpstreamGroup, 0, selector)
 	}
 
 	newcache, err := NewCache()
@@ -366,14 +640,18 @@ func NewMutexServer(cl Client, pool ConnPool) (Server, error) {
 		HostedCache: hostedcache,
 		dnsClient:   client,
 		connPool:    pool,
+		groups:      make(map[string]ConnPool),
+		router:      NewDomainRouter(),
+		localZones:  localZones,
 		sem:         sem,
 	}
 
-	upstreamNames := config.Upstreams
-	for _, name := range upstreamNames {
-		ret.AddUpstream(&Upstream{
-			Name: name,
-		})
+	for _, upstreamConfig := range config.Upstreams {
+		ret.AddUpstream(upstreamConfig.Upstream())
+	}
+
+	if err := ret.addUpstreamGroups(config.UpstreamGroups); err != nil {
+		return nil, fmt.Errorf("couldn't set up upstream groups: %s", err)
 	}
 	return ret, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/mock"
@@ -21,7 +22,21 @@ type MockDnsClient struct {
 
 func (m *MockDnsClient) ExchangeWithConn(s *dns.Msg, conn *dns.Conn) (r *dns.Msg, rtt time.Duration, err error) {
 	ret := m.Called(s, conn)
-	return ret.Get(0).(*dns.Msg), ret.Get(1).(time.Duration), ret.Error(2)
+	if rf, ok := ret.Get(0).(func(*dns.Msg, *dns.Conn) *dns.Msg); ok {
+		r = rf(s, conn)
+	} else {
+		r = ret.Get(0).(*dns.Msg)
+	}
+	return r, ret.Get(1).(time.Duration), ret.Error(2)
+}
+
+// for mocking a reply to whatever the query was, with a given rcode
+func answerWith(rcode int) func(*dns.Msg, *dns.Conn) *dns.Msg {
+	return func(s *dns.Msg, conn *dns.Conn) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetRcode(s, rcode)
+		return r
+	}
 }
 
 func (m *MockDnsClient) Dial(address string) (conn *dns.Conn, err error) {
@@ -50,7 +65,7 @@ func TestRecursiveQueryErrors(t *testing.T) {
 		t.Fatalf("could not build test resources: [%v]: %s", server, err)
 	}
 	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(&dns.Msg{}, time.Duration(0), fmt.Errorf("no DNS for you!"))
-	pool.On("Get").Return(&ConnEntry{Conn: &dns.Conn{}}, Upstream{}, nil)
+	pool.On("Get", mock.Anything).Return(&ConnEntry{Conn: &dns.Conn{}}, Upstream{}, nil)
 	pool.On("CloseConnection", mock.Anything).Return(nil)
 	if r, source, err := server.RecursiveQuery("example.com", dns.TypeA); err == nil {
 		t.Fatalf("exchange errors didn't bubble up to the caller r[%v] source[%v]", r, source)
@@ -58,6 +73,210 @@ func TestRecursiveQueryErrors(t *testing.T) {
 	cl.AssertExpectations(t)
 }
 
+func buildShutdownTestServer(t *testing.T, exchangeDelay time.Duration) (Server, *MockDnsClient, *MockConnPool) {
+	cl := new(MockDnsClient)
+	pool := new(MockConnPool)
+	server, err := buildTestServer(cl, pool)
+	if err != nil {
+		t.Fatalf("could not build test resources: [%v]: %s", server, err)
+	}
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).After(exchangeDelay).Return(answerWith(dns.RcodeSuccess), time.Duration(0), nil)
+	pool.On("Get", mock.Anything).Return(&ConnEntry{Conn: &dns.Conn{}}, Upstream{}, nil)
+	pool.On("Add", mock.Anything).Return(nil)
+	pool.On("CloseAll").Return()
+	return server, cl, pool
+}
+
+func TestShutdownDrainsQueries(t *testing.T) {
+	server, cl, pool := buildShutdownTestServer(t, time.Duration(200)*time.Millisecond)
+	w := new(MockResponseWriter)
+	w.On("WriteMsg", mock.Anything).Return(nil)
+
+	testMsg := new(dns.Msg)
+	testMsg.SetQuestion("example.com.", dns.TypeA)
+	server.HandleDNS(w, testMsg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed to drain queries: %s", err)
+	}
+
+	// the in-flight query should have been answered before shutdown returned
+	w.AssertNumberOfCalls(t, "WriteMsg", 1)
+	cl.AssertNumberOfCalls(t, "ExchangeWithConn", 1)
+	pool.AssertCalled(t, "CloseAll")
+
+	// anything arriving after shutdown gets turned away without going upstream
+	server.HandleDNS(w, testMsg)
+	w.AssertNumberOfCalls(t, "WriteMsg", 2)
+	cl.AssertNumberOfCalls(t, "ExchangeWithConn", 1)
+
+	if err := server.Shutdown(ctx); err == nil {
+		t.Fatalf("second shutdown should have reported that the server was already shutting down")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	server, _, pool := buildShutdownTestServer(t, time.Duration(1)*time.Second)
+	w := new(MockResponseWriter)
+	w.On("WriteMsg", mock.Anything).Return(nil)
+
+	testMsg := new(dns.Msg)
+	testMsg.SetQuestion("example.com.", dns.TypeA)
+	server.HandleDNS(w, testMsg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(50)*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err == nil {
+		t.Fatalf("shutdown didn't report queries that were still in flight after the deadline")
+	}
+	// teardown should still happen when the deadline passes
+	pool.AssertCalled(t, "CloseAll")
+}
+
+func TestRetrieveRecordsWithTrace(t *testing.T) {
+	config := GetConfiguration()
+	oldRetries := config.UpstreamRetries
+	config.UpstreamRetries = 1
+	defer func() { config.UpstreamRetries = oldRetries }()
+
+	cl := new(MockDnsClient)
+	pool := new(MockConnPool)
+	server, err := buildTestServer(cl, pool)
+	if err != nil {
+		t.Fatalf("could not build test resources: [%v]: %s", server, err)
+	}
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(&dns.Msg{}, time.Duration(0), fmt.Errorf("no DNS for you!")).Once()
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(answerWith(dns.RcodeSuccess), time.Duration(0), nil)
+	pool.On("Get", mock.Anything).Return(&ConnEntry{Conn: &dns.Conn{}}, Upstream{}, nil)
+	pool.On("CloseConnection", mock.Anything).Return(nil)
+	pool.On("Add", mock.Anything).Return(nil)
+
+	_, trace, err := server.RetrieveRecordsWithTrace("example.com.", dns.TypeA, false)
+	if err != nil {
+		t.Fatalf("traced query failed: %s", err)
+	}
+
+	if len(trace.Lookups) != 3 || trace.Lookups[0].Hit || trace.Lookups[1].Hit || trace.Lookups[2].Hit {
+		t.Fatalf("expected misses on both caches and the local zones, got [%v]", trace.Lookups)
+	}
+
+	if len(trace.Attempts) != 2 || trace.Retries != 1 {
+		t.Fatalf("expected one failed attempt and one retry, got [%v]", trace.Attempts)
+	}
+
+	if trace.Attempts[0].Error == "" || trace.Attempts[1].Error != "" {
+		t.Fatalf("errors weren't recorded on the right attempts: [%v]", trace.Attempts)
+	}
+
+	if !trace.Attempts[1].ReusedConnection {
+		t.Fatalf("pooled connection wasn't recorded as reused: [%v]", trace.Attempts[1])
+	}
+
+	// the answer should be cached now
+	_, trace, err = server.RetrieveRecordsWithTrace("example.com.", dns.TypeA, false)
+	if err != nil {
+		t.Fatalf("traced query failed: %s", err)
+	}
+
+	if trace.Source != "cache" || len(trace.Attempts) != 0 {
+		t.Fatalf("expected cache hit with no upstream attempts, got [%v]", trace)
+	}
+
+	// unless we ask to skip it
+	_, trace, err = server.RetrieveRecordsWithTrace("example.com.", dns.TypeA, true)
+	if err != nil {
+		t.Fatalf("traced query failed: %s", err)
+	}
+
+	if len(trace.Lookups) != 2 || trace.Lookups[0].Cache != "hosted" || len(trace.Attempts) != 1 {
+		t.Fatalf("expected the lookup cache to be skipped, got [%v]", trace)
+	}
+}
+
+func TestQueryTraceRetries(t *testing.T) {
+	trace := NewQueryTrace("example.com.", "A", false)
+	trace.AddAttempt(TraceAttempt{Attempt: 0})
+	trace.AddAttempt(TraceAttempt{Attempt: 0, Hedge: true})
+	// the redial after a stale pooled connection
+	trace.AddAttempt(TraceAttempt{Attempt: 0})
+	if trace.Retries != 0 {
+		t.Fatalf("hedges and redials were counted as retries: [%d]", trace.Retries)
+	}
+
+	trace.AddAttempt(TraceAttempt{Attempt: 1})
+	if len(trace.Attempts) != 4 || trace.Retries != 1 {
+		t.Fatalf("expected 4 attempts with 1 retry, got [%d] with [%d]", len(trace.Attempts), trace.Retries)
+	}
+}
+
+func TestRecursiveQueryRouting(t *testing.T) {
+	cl := new(MockDnsClient)
+	defaultPool := new(MockConnPool)
+	corpPool := new(MockConnPool)
+	server, err := buildTestServer(cl, defaultPool)
+	if err != nil {
+		t.Fatalf("could not build test resources: [%v]: %s", server, err)
+	}
+	mutexServer := server.(*MutexServer)
+	mutexServer.groups["corp"] = corpPool
+	if err := mutexServer.router.AddRule("corp.example.", "corp"); err != nil {
+		t.Fatalf("could not add routing rule: %s", err)
+	}
+
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(answerWith(dns.RcodeSuccess), time.Duration(0), nil)
+	for _, pool := range []*MockConnPool{defaultPool, corpPool} {
+		pool.On("Get", mock.Anything).Return(&ConnEntry{Conn: &dns.Conn{}}, Upstream{}, nil)
+		pool.On("Add", mock.Anything).Return(nil)
+	}
+
+	if _, _, err := server.RecursiveQuery("host.corp.example.", dns.TypeA); err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	corpPool.AssertNumberOfCalls(t, "Get", 1)
+	defaultPool.AssertNumberOfCalls(t, "Get", 0)
+
+	if _, _, err := server.RecursiveQuery("example.com.", dns.TypeA); err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	corpPool.AssertNumberOfCalls(t, "Get", 1)
+	defaultPool.AssertNumberOfCalls(t, "Get", 1)
+}
+
+func TestLocalZonesStayLocal(t *testing.T) {
+	cl := new(MockDnsClient)
+	defaultPool := new(MockConnPool)
+	corpPool := new(MockConnPool)
+	server, err := buildTestServer(cl, defaultPool)
+	if err != nil {
+		t.Fatalf("could not build test resources: [%v]: %s", server, err)
+	}
+
+	response, source, err := server.RetrieveRecords("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if source != "local" || response.Entry.Rcode != dns.RcodeNameError {
+		t.Fatalf("RFC 1918 reverse lookup wasn't answered locally, source [%s] response [%v]", source, response.Entry)
+	}
+	defaultPool.AssertNotCalled(t, "Get")
+
+	// explicitly routing the zone to a group sends it upstream
+	mutexServer := server.(*MutexServer)
+	mutexServer.groups["corp"] = corpPool
+	if err := mutexServer.router.AddRule("10.in-addr.arpa.", "corp"); err != nil {
+		t.Fatalf("could not add routing rule: %s", err)
+	}
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(answerWith(dns.RcodeSuccess), time.Duration(0), nil)
+	corpPool.On("Get", mock.Anything).Return(&ConnEntry{Conn: &dns.Conn{}}, Upstream{}, nil)
+	corpPool.On("Add", mock.Anything).Return(nil)
+	if _, source, err = server.RetrieveRecords("2.0.0.10.in-addr.arpa.", dns.TypePTR); err != nil || source == "local" {
+		t.Fatalf("routed reverse lookup wasn't sent upstream, source [%s]: %v", source, err)
+	}
+	corpPool.AssertNumberOfCalls(t, "Get", 1)
+}
+
 /** BENCHMARKS **/
 func BenchmarkServeDNSParallel(b *testing.B) {
 	server, _, err := buildTestResources()
@@ -0,0 +1,188 @@
+package main
+
+// Pipelined upstream connections (RFC 7766 section 6.2.1.1).  Instead of one query at a time,
+// a pipelined connection carries many queries at once on the same TLS stream, and a reader
+// matches the responses to their queries by message ID in whatever order they come back.
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"sync"
+	"time"
+)
+
+type pipelinedConn struct {
+	conn *dns.Conn
+
+	// the upstream's address, for metrics and logging
+	address string
+
+	// how long to wait for a response
+	timeout time.Duration
+
+	// only one query can be written at a time
+	writeLock sync.Mutex
+
+	// guards pending and err
+	lock sync.Mutex
+
+	// queries waiting on responses, keyed by message ID
+	pending map[uint16]chan *dns.Msg
+
+	// set once the connection breaks, every exchange after that fails with it
+	err error
+
+	// closed once the connection breaks
+	done chan struct{}
+}
+
+// wraps a connection and starts reading responses off of it
+func newPipelinedConn(conn *dns.Conn, address string, timeout time.Duration) *pipelinedConn {
+	p := &pipelinedConn{
+		conn:    conn,
+		address: address,
+		timeout: timeout,
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go p.read()
+	return p
+}
+
+// Sends a query and waits for its response.  The query goes out with an ID that's unique on this
+// connection, the response gets the original ID back so callers can't tell the difference.
+func (p *pipelinedConn) Exchange(m *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+	query := m.Copy()
+	response := make(chan *dns.Msg, 1)
+
+	p.lock.Lock()
+	if p.err != nil {
+		p.lock.Unlock()
+		return nil, 0, p.err
+	}
+	query.Id = dns.Id()
+	for _, ok := p.pending[query.Id]; ok; _, ok = p.pending[query.Id] {
+		query.Id = dns.Id()
+	}
+	p.pending[query.Id] = response
+	p.lock.Unlock()
+
+	PipelinedQueriesGauge.WithLabelValues(p.address).Inc()
+	defer func() {
+		p.lock.Lock()
+		delete(p.pending, query.Id)
+		p.lock.Unlock()
+		PipelinedQueriesGauge.WithLabelValues(p.address).Dec()
+	}()
+
+	start := time.Now()
+	p.writeLock.Lock()
+	p.conn.SetWriteDeadline(start.Add(p.timeout))
+	err = p.conn.WriteMsg(query)
+	p.writeLock.Unlock()
+	if err != nil {
+		// a partial write leaves the stream in an unknown state, nobody else can use it
+		p.fail(err)
+		return nil, 0, err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case r = <-response:
+		r.Id = m.Id
+		return r, time.Since(start), nil
+	case <-timer.C:
+		// the response may still show up, the reader will drop it
+		return nil, time.Since(start), fmt.Errorf("timed out after [%s] waiting for response on pipelined connection to [%s]: %w", p.timeout, p.address, os.ErrDeadlineExceeded)
+	case <-p.done:
+		return nil, time.Since(start), p.Err()
+	}
+}
+
+// reads responses until the connection breaks, handing them to whichever query is waiting for them
+func (p *pipelinedConn) read() {
+	for {
+		r, err := p.conn.ReadMsg()
+		if err != nil {
+			p.fail(err)
+			return
+		}
+
+		p.lock.Lock()
+		response, ok := p.pending[r.Id]
+		delete(p.pending, r.Id)
+		p.lock.Unlock()
+
+		if !ok {
+			// most likely the response to a query that timed out
+			PipelineUnmatchedResponsesCounter.WithLabelValues(p.address).Inc()
+			Logger.Log(NewLogMessage(
+				INFO,
+				LogContext{
+					"what":    "dropping response that no query is waiting for",
+					"address": p.address,
+					"id":      fmt.Sprintf("%d", r.Id),
+				},
+				nil,
+			))
+			continue
+		}
+		response <- r
+	}
+}
+
+// breaks the connection, failing everything that's waiting on it
+func (p *pipelinedConn) fail(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return
+	}
+	p.err = fmt.Errorf("pipelined connection to [%s] is broken: %w", p.address, err)
+	close(p.done)
+	p.conn.Close()
+}
+
+// returns why the connection broke, if it did
+func (p *pipelinedConn) Err() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+func (p *pipelinedConn) Close() error {
+	p.fail(fmt.Errorf("connection closed"))
+	return nil
+}
+
+// runs an exchange on a connection, pipelined connections take care of their own exchanges
+func exchangeOn(client Client, ce *ConnEntry, m *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+	query := m
+	if !GetConfiguration().DisableTcpKeepalive {
+		query = withTcpKeepalive(m)
+	}
+
+	if pc, ok := ce.Conn.(*pipelinedConn); ok {
+		r, rtt, err = pc.Exchange(query)
+	} else {
+		r, rtt, err = client.ExchangeWithConn(query, ce.Conn.(*dns.Conn))
+	}
+
+	if err == nil && r != nil {
+		if timeout, ok := takeTcpKeepalive(r, m); ok {
+			ce.keepalive = timeout
+			ce.hasKeepalive = true
+		}
+	}
+	return r, rtt, err
+}
+
+// how long a pipelined exchange waits for its response, matches the client's timeouts
+func pipelineTimeout() time.Duration {
+	if timeout := GetConfiguration().Timeout; timeout != 0 {
+		return timeout * time.Millisecond
+	}
+	// the dns library's default
+	return time.Duration(2000) * time.Millisecond
+}
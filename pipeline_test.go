@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// builds a pipelined connection over a pipe, along with the other end of the pipe
+func buildTestPipelinedConn(timeout time.Duration) (*pipelinedConn, *dns.Conn) {
+	server, client := net.Pipe()
+	return newPipelinedConn(&dns.Conn{Conn: client}, "example.com:853", timeout), &dns.Conn{Conn: server}
+}
+
+func testQuery(name string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return m
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	pc, server := buildTestPipelinedConn(time.Second)
+	defer pc.Close()
+
+	// answer both queries, last one first
+	go func() {
+		first, err := server.ReadMsg()
+		if err != nil {
+			return
+		}
+		second, err := server.ReadMsg()
+		if err != nil {
+			return
+		}
+		for _, query := range []*dns.Msg{second, first} {
+			reply := new(dns.Msg)
+			reply.SetReply(query)
+			server.WriteMsg(reply)
+		}
+	}()
+
+	names := []string{"first.example.com.", "second.example.com."}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			query := testQuery(name)
+			reply, _, err := pc.Exchange(query)
+			if err != nil {
+				t.Errorf("exchange for [%s] failed: %s", name, err)
+				return
+			}
+			if reply.Id != query.Id {
+				t.Errorf("reply for [%s] came back with ID [%d], query had [%d]", name, reply.Id, query.Id)
+			}
+			if reply.Question[0].Name != name {
+				t.Errorf("query for [%s] got the reply for [%s]", name, reply.Question[0].Name)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	pc, server := buildTestPipelinedConn(50 * time.Millisecond)
+	defer pc.Close()
+
+	queries := make(chan *dns.Msg, 1)
+	go func() {
+		query, err := server.ReadMsg()
+		if err != nil {
+			return
+		}
+		queries <- query
+	}()
+
+	if _, _, err := pc.Exchange(testQuery("example.com")); err == nil {
+		t.Fatalf("exchange without a response succeeded")
+	}
+
+	// the late response shouldn't break the connection for anyone else
+	late := new(dns.Msg)
+	late.SetReply(<-queries)
+	if err := server.WriteMsg(late); err != nil {
+		t.Fatalf("could not write late response: %s", err)
+	}
+
+	if err := pc.Err(); err != nil {
+		t.Fatalf("late response broke the connection: %s", err)
+	}
+}
+
+func TestPipelineBrokenConnection(t *testing.T) {
+	pc, server := buildTestPipelinedConn(time.Second)
+
+	go func() {
+		server.ReadMsg()
+		server.Close()
+	}()
+
+	if _, _, err := pc.Exchange(testQuery("example.com")); err == nil {
+		t.Fatalf("exchange on a closed connection succeeded")
+	}
+
+	WaitForCondition(10, func() bool { return pc.Err() != nil })
+	if pc.Err() == nil {
+		t.Fatalf("connection didn't notice it was closed")
+	}
+
+	if _, _, err := pc.Exchange(testQuery("example.com")); err == nil {
+		t.Fatalf("exchange on a broken connection succeeded")
+	}
+}
+
+func TestConnectionPoolPipelineSharing(t *testing.T) {
+	config := GetConfiguration()
+	config.PipelineQueries = 2
+	defer func() { config.PipelineQueries = 0 }()
+
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	ce, err := pool.NewConnection(*upstream, func(string) (*dns.Conn, error) {
+		return &dns.Conn{Conn: client}, nil
+	})
+	if err != nil {
+		t.Fatalf("could not dial connection: %s", err)
+	}
+
+	if _, ok := ce.Conn.(*pipelinedConn); !ok {
+		t.Fatalf("connection wasn't pipelined: [%T]", ce.Conn)
+	}
+	pool.Add(ce)
+
+	var checkouts []*ConnEntry
+	for i := 0; i < 2; i++ {
+		shared, _, err := pool.Get(context.Background())
+		if err != nil {
+			t.Fatalf("could not check out connection: %s", err)
+		}
+		if shared.Conn != ce.Conn {
+			t.Fatalf("checkout [%d] didn't share the pooled connection", i)
+		}
+		checkouts = append(checkouts, shared)
+	}
+
+	// the connection is full, the next query gets a new one
+	_, dial, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("could not check out connection: %s", err)
+	}
+	if dial.GetAddress() != upstream.GetAddress() {
+		t.Fatalf("full connection didn't send the query off to dial")
+	}
+	otherServer, otherClient := net.Pipe()
+	defer otherServer.Close()
+	other, err := pool.NewConnection(dial, func(string) (*dns.Conn, error) {
+		return &dns.Conn{Conn: otherClient}, nil
+	})
+	if err != nil {
+		t.Fatalf("could not dial connection: %s", err)
+	}
+	pool.CloseConnection(other)
+
+	for _, shared := range checkouts {
+		shared.AddExchange(time.Millisecond)
+		pool.Add(shared)
+	}
+
+	if pool.Size() != 1 {
+		t.Fatalf("returning checkouts changed the pool size to [%d]", pool.Size())
+	}
+
+	if ce.queries != 2 {
+		t.Fatalf("pooled connection counted [%d] queries, expected 2", ce.queries)
+	}
+
+	// a failed query leaves the stream to the other queries on it
+	failed, _, _ := pool.Get(context.Background())
+	inflight, _, _ := pool.Get(context.Background())
+	failed.AddError()
+	pool.CloseConnection(failed)
+	if err := ce.Conn.(*pipelinedConn).Err(); err != nil {
+		t.Fatalf("failed query broke the stream for the other queries on it: %s", err)
+	}
+
+	// the error still purges the upstream, the connection just doesn't go until its queries are done
+	if pool.Size() != 0 {
+		t.Fatalf("connection to an upstream that failed stayed in the pool")
+	}
+	inflight.AddExchange(time.Millisecond)
+	pool.Add(inflight)
+
+	// once the stream itself breaks, the checkouts on it can't go back
+	ce, err = pool.NewConnection(*upstream, func(string) (*dns.Conn, error) {
+		_, client := net.Pipe()
+		return &dns.Conn{Conn: client}, nil
+	})
+	if err != nil {
+		t.Fatalf("could not dial connection: %s", err)
+	}
+	pool.Add(ce)
+	broken, _, _ := pool.Get(context.Background())
+	if broken.Conn != ce.Conn {
+		t.Fatalf("checkout didn't share the pooled connection")
+	}
+	ce.Conn.Close()
+	pool.Add(broken)
+	if pool.Size() != 0 {
+		t.Fatalf("broken pipelined connection stayed in the pool")
+	}
+}
+
+/** BENCHMARKS **/
+
+// starts a TLS blackhole server and returns a server that resolves through it
+func buildBlackholeResources(b *testing.B) (Server, func()) {
+	port, stopBlackhole := startTlsBlackhole(b)
+
+	config := GetConfiguration()
+	config.SkipUpstreamVerification = true
+	server, err := NewMutexServer(nil, nil)
+	if err != nil {
+		b.Fatalf("could not build server: %s", err)
+	}
+	server.AddUpstream(&Upstream{Name: "127.0.0.1", Port: port})
+
+	return server, func() {
+		config.SkipUpstreamVerification = false
+		server.GetConnectionPool().CloseAll()
+		stopBlackhole()
+	}
+}
+
+func benchmarkBlackhole(b *testing.B, pipelineQueries int) {
+	config := GetConfiguration()
+	config.PipelineQueries = pipelineQueries
+	defer func() { config.PipelineQueries = 0 }()
+
+	server, shutdown := buildBlackholeResources(b)
+	defer shutdown()
+
+	var lock sync.Mutex
+	var n int
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			lock.Lock()
+			n++
+			// unique names so that the cache doesn't answer
+			name := fmt.Sprintf("%d.example.com.", n)
+			lock.Unlock()
+			if _, _, err := server.RecursiveQuery(name, dns.TypeA); err != nil {
+				b.Fatalf("query for [%s] failed: %s", name, err)
+			}
+		}
+	})
+}
+
+func BenchmarkBlackholeOneQueryPerCheckout(b *testing.B) {
+	benchmarkBlackhole(b, 0)
+}
+
+func BenchmarkBlackholePipelined(b *testing.B) {
+	benchmarkBlackhole(b, 64)
+}
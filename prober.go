@@ -0,0 +1,150 @@
+package main
+
+// Actively checks on upstreams in the background, so that a failing upstream is found
+// before a client query trips over it, and a recovered one gets back into rotation
+// before a client query has to take a chance on it
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+type upstreamProber struct {
+	// used to dial the upstreams and send the canary
+	client Client
+
+	// the pools whose upstreams get probed, keyed by group
+	pools map[string]ConnPool
+
+	// how often to probe
+	interval time.Duration
+
+	// the canary query
+	name  string
+	qtype uint16
+
+	Cancel chan bool
+}
+
+// builds the query used to check whether an upstream can resolve anything:
+// the A record of a given name, or the root zone's NS records if there isn't one
+func canaryQuestion(name string) (string, uint16) {
+	if name == "" {
+		return ".", dns.TypeNS
+	}
+	return dns.Fqdn(name), dns.TypeA
+}
+
+// returns nil if probing is disabled
+func NewUpstreamProber(client Client, pools map[string]ConnPool) *upstreamProber {
+	config := GetConfiguration()
+	interval := time.Duration(10000) * time.Millisecond
+	if config.HealthProbeInterval < 0 {
+		return nil
+	} else if config.HealthProbeInterval != 0 {
+		interval = config.HealthProbeInterval * time.Millisecond
+	}
+
+	name, qtype := canaryQuestion(config.HealthProbeName)
+	return &upstreamProber{
+		client:   client,
+		pools:    pools,
+		interval: interval,
+		name:     name,
+		qtype:    qtype,
+	}
+}
+
+func (p *upstreamProber) Start() {
+	p.Cancel = make(chan bool)
+	go func() {
+		t := time.NewTicker(p.interval)
+		defer t.Stop()
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":     "starting upstream prober",
+				"interval": fmt.Sprintf("%s", p.interval),
+				"canary":   fmt.Sprintf("%s %s", p.name, dns.Type(p.qtype).String()),
+			},
+			nil,
+		))
+		for {
+			select {
+			case _ = <-t.C:
+				p.ProbeAll()
+			case _ = <-p.Cancel:
+				return
+			}
+		}
+	}()
+}
+
+func (p *upstreamProber) Stop() {
+	// closing instead of sending means shutdown doesn't wait for a probe round that's underway
+	close(p.Cancel)
+}
+
+// probes every upstream once, in parallel so that a dead upstream's timeouts don't hold up the rest
+func (p *upstreamProber) ProbeAll() {
+	var wg sync.WaitGroup
+	for _, pool := range p.pools {
+		for _, upstream := range pool.Upstreams() {
+			wg.Add(1)
+			go func(pool ConnPool, upstream Upstream) {
+				defer wg.Done()
+				p.probe(pool, upstream)
+			}(pool, upstream)
+		}
+	}
+	wg.Wait()
+}
+
+// Sends the canary to an upstream over a fresh connection that never goes into the pool.  The
+// result goes through the pool like any other exchange, so that it cools and weights the upstream.
+func (p *upstreamProber) probe(pool ConnPool, upstream Upstream) (err error) {
+	address := upstream.GetAddress()
+	defer func() {
+		result, up := "success", 1.0
+		if err != nil {
+			result, up = "failure", 0
+			Logger.Log(NewLogMessage(
+				WARNING,
+				LogContext{
+					"what":    "upstream failed health probe",
+					"address": address,
+					"error":   err.Error(),
+				},
+				nil,
+			))
+		}
+		UpstreamProbesCounter.WithLabelValues(address, result).Inc()
+		UpstreamProbeUpGauge.WithLabelValues(address).Set(up)
+	}()
+
+	// a failed dial cools the upstream on its own
+	ce, err := pool.NewConnection(upstream, p.client.Dial)
+	if err != nil {
+		return fmt.Errorf("could not connect: %s", err)
+	}
+	// a successful probe can bring a cooling upstream back early
+	ce.probe = true
+
+	m := &dns.Msg{}
+	m.SetQuestion(p.name, p.qtype)
+	m.RecursionDesired = true
+	reply, rtt, err := exchangeOn(p.client, ce, m)
+	if err == nil && (reply.Rcode == dns.RcodeServerFailure || reply.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("canary query answered with [%s]", dns.RcodeToString[reply.Rcode])
+	}
+
+	if err != nil {
+		ce.AddError()
+	} else {
+		ce.AddExchange(rtt)
+		UpstreamProbeTimer.WithLabelValues(address).Observe(rtt.Seconds())
+	}
+	pool.CloseConnection(ce)
+	return err
+}
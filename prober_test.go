@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/mock"
+	"net"
+	"testing"
+	"time"
+)
+
+// builds a prober for a single upstream whose canary gets a given answer
+func buildTestProber(rcode int, exchangeErr error) (*upstreamProber, *MockDnsClient, *Upstream) {
+	upstream := &Upstream{Name: "example.com"}
+	pool := NewConnPool()
+	pool.AddUpstream(upstream)
+
+	server, client := net.Pipe()
+	server.Close()
+	cl := new(MockDnsClient)
+	cl.On("Dial", upstream.GetAddress()).Return(&dns.Conn{Conn: client}, nil)
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}}, 5*time.Millisecond, exchangeErr)
+
+	prober := NewUpstreamProber(cl, map[string]ConnPool{DefaultUpstreamGroup: pool})
+	return prober, cl, upstream
+}
+
+func TestProberSuccess(t *testing.T) {
+	prober, cl, upstream := buildTestProber(dns.RcodeSuccess, nil)
+	prober.ProbeAll()
+	cl.AssertExpectations(t)
+
+	if upstream.GetSamples() != 1 {
+		t.Fatalf("probe RTT didn't make it into the upstream's weight: [%d] samples", upstream.GetSamples())
+	}
+
+	if upstream.BreakerState() != BreakerClosed {
+		t.Fatalf("healthy upstream's breaker was [%s]", upstream.BreakerState())
+	}
+}
+
+func TestProberRecoversCoolingUpstream(t *testing.T) {
+	prober, _, upstream := buildTestProber(dns.RcodeNameError, nil)
+	upstream.Trip(time.Hour, time.Hour)
+	prober.ProbeAll()
+
+	// NXDOMAIN is a perfectly good answer
+	if upstream.IsCooling() || upstream.BreakerState() != BreakerClosed {
+		t.Fatalf("successful probe didn't bring the upstream back: [%s]", upstream.BreakerState())
+	}
+}
+
+func TestProberFailures(t *testing.T) {
+	for _, tc := range []struct {
+		rcode int
+		err   error
+	}{
+		{dns.RcodeServerFailure, nil},
+		{dns.RcodeRefused, nil},
+		{dns.RcodeSuccess, fmt.Errorf("no DNS for you!")},
+	} {
+		prober, _, upstream := buildTestProber(tc.rcode, tc.err)
+		prober.ProbeAll()
+		if !upstream.IsCooling() {
+			t.Fatalf("upstream wasn't cooled after a failed probe with rcode [%d] and error [%v]", tc.rcode, tc.err)
+		}
+	}
+}
+
+func TestProberDialFailure(t *testing.T) {
+	upstream := &Upstream{Name: "example.com"}
+	pool := NewConnPool()
+	pool.AddUpstream(upstream)
+	cl := new(MockDnsClient)
+	cl.On("Dial", upstream.GetAddress()).Return(&dns.Conn{}, fmt.Errorf("no DNS for you!"))
+
+	NewUpstreamProber(cl, map[string]ConnPool{DefaultUpstreamGroup: pool}).ProbeAll()
+	if !upstream.IsCooling() {
+		t.Fatalf("upstream that couldn't be dialed wasn't cooled")
+	}
+	cl.AssertNotCalled(t, "ExchangeWithConn", mock.Anything, mock.Anything)
+}
+
+func TestProberDisabled(t *testing.T) {
+	config := GetConfiguration()
+	oldInterval := config.HealthProbeInterval
+	config.HealthProbeInterval = -1
+	defer func() { config.HealthProbeInterval = oldInterval }()
+
+	if prober := NewUpstreamProber(new(MockDnsClient), map[string]ConnPool{}); prober != nil {
+		t.Fatalf("got a prober with probing disabled: [%v]", prober)
+	}
+}
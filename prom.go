@@ -22,22 +22,82 @@ var (
 	})
 	UpstreamWeightGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "funkyd_upstream_weight_gauge",
-		Help: "the weights of the upstreams in the system, only meaningful when broken down per address",
+		Help: "the weights used to rank the upstreams, with any configured bias applied, only meaningful when broken down per address",
 	},
-		[]string{
-			// the upstream address
-			"address",
-			// if there was cooling, was there an error?
-			"error",
-			// if the upstream is cooling, this will have the time left
-			// in its cooldown period
-			"cooling"},
+		[]string{"address"},
+	)
+	UpstreamBreakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_upstream_breaker_state",
+		Help: "1 for the state each upstream's circuit breaker is in, 0 for the others",
+	},
+		[]string{"destination", "state"},
+	)
+	UpstreamBreakerTransitionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_breaker_transitions_total",
+		Help: "circuit breaker state changes for each upstream",
+	},
+		[]string{"destination", "from", "to"},
+	)
+	UpstreamBreakerOpenDurationGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_upstream_breaker_open_seconds",
+		Help: "how long each upstream's circuit breaker was last opened for, after backoff",
+	},
+		[]string{"destination"},
+	)
+	UpstreamScoreGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_upstream_score",
+		Help: "the moving average of each upstream's RTT in ms, decayed toward the pool's mean while it isn't getting traffic",
+	},
+		[]string{"destination"},
+	)
+	UpstreamRttSamplesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_rtt_samples_total",
+		Help: "RTTs that have gone into each upstream's score",
+	},
+		[]string{"destination"},
+	)
+	UpstreamExplorationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_explorations_total",
+		Help: "queries sent to an upstream only to get a fresh RTT from it",
+	},
+		[]string{"destination"},
 	)
 	ConnPoolSizeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "funkyd_conn_pool_size",
-		Help: "the total size of the connection pool, labelled by destination host",
+		Help: "the total size of the connection pool, labelled by destination host and upstream group",
 	},
-		[]string{"destination"},
+		[]string{"destination", "group"},
+	)
+	ConnPoolWaitingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_conn_pool_waiting",
+		Help: "queries waiting for a connection because the pool is at its limits, by upstream group",
+	},
+		[]string{"group"},
+	)
+	ConnPoolWaitTimer = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "funkyd_conn_pool_wait_time",
+		Help:       "how long queries waited for a connection when the pool was at its limits",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	},
+		[]string{"group"},
+	)
+	ConnPoolWaitTimeoutsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_conn_pool_wait_timeouts_total",
+		Help: "queries that gave up waiting for a connection",
+	},
+		[]string{"group"},
+	)
+	RoutedQueriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_routed_queries_total",
+		Help: "recursive queries sent to each upstream group",
+	},
+		[]string{"group"},
+	)
+	UpstreamGroupFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_group_failures_total",
+		Help: "recursive queries that no upstream in the group could answer",
+	},
+		[]string{"group"},
 	)
 	QueuedQueriesGauge = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "funkyd_queued_queries_total",
@@ -46,6 +106,51 @@ var (
 	FailedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "funkyd_failed_connections_counter",
 		Help: "attempts to connect to an upstream that failed",
+	},
+		[]string{
+			"destination",
+			// why the connection failed, see connectionFailureReason()
+			"reason"},
+	)
+	PipelinedQueriesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_pipelined_queries_in_flight",
+		Help: "queries waiting on responses on a pipelined connection, only meaningful when broken down per address",
+	},
+		[]string{"destination"},
+	)
+	PipelineUnmatchedResponsesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_pipeline_unmatched_responses_total",
+		Help: "responses on pipelined connections that no query was waiting for",
+	},
+		[]string{"destination"},
+	)
+	ClosedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_closed_connections_total",
+		Help: "upstream connections that were closed, by reason, see lifecycle.go",
+	},
+		[]string{"destination", "reason"},
+	)
+	WarmedConnectionsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_warmed_connections_total",
+		Help: "upstream connections that were dialed ahead of time to keep the minimum idle, see warmer.go",
+	},
+		[]string{"destination", "group"},
+	)
+	SpkiPinFailuresCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_spki_pin_failures_total",
+		Help: "handshakes with an upstream that were aborted because its key didn't match the configured pins",
+	},
+		[]string{"destination"},
+	)
+	UpstreamProbesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_probes_total",
+		Help: "background health probes sent to each upstream, by result",
+	},
+		[]string{"destination", "result"},
+	)
+	UpstreamProbeUpGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_upstream_probe_up",
+		Help: "1 if the last health probe to an upstream succeeded, 0 if it failed",
 	},
 		[]string{"destination"},
 	)
@@ -67,8 +172,14 @@ var (
 	})
 	RecursiveQueryCounter = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "funkyd_recursive_queries_total",
-		Help: "The total number of recursive queries run by this server",
+		Help: "The total number of recursive queries run by this server, i.e. queries sent upstream",
 	})
+	LocalZoneAnswersCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_local_zone_answers_total",
+		Help: "queries for locally-served and special-use zones that were answered without going upstream",
+	},
+		[]string{"zone"},
+	)
 	UpstreamErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "funkyd_upstream_errors_total",
 		Help: "The total number of times an upstream upstream had errors. This INCLUDES connection closure",
@@ -95,6 +206,73 @@ var (
 	},
 		[]string{"destination"},
 	)
+	UpstreamProbeTimer = promauto.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "funkyd_upstream_probe_time",
+		Help:       "how long the upstreams took to answer health probes",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	},
+		[]string{"destination"},
+	)
+	UpstreamKeepaliveGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_upstream_keepalive_seconds",
+		Help: "the idle timeout each upstream last sent with the EDNS TCP keepalive option, see keepalive.go",
+	},
+		[]string{"destination"},
+	)
+	RetriesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_retries_total",
+		Help: "queries that were retried against upstreams, by why the attempt before failed, see retry.go",
+	},
+		[]string{"group", "reason"},
+	)
+	RejectedRepliesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_rejected_replies_total",
+		Help: "replies from upstreams that didn't match the query they were for, by what didn't match, see validate.go",
+	},
+		[]string{"destination", "reason"},
+	)
+	OutOfBailiwickRecordsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_upstream_out_of_bailiwick_records_total",
+		Help: "records dropped from upstream replies for having nothing to do with the query, see validate.go",
+	},
+		[]string{"destination"},
+	)
+	HedgesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_hedges_total",
+		Help: "queries that were also sent to another upstream because the first one was slow, see hedge.go",
+	},
+		[]string{"group"},
+	)
+	HedgeWinsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_hedge_wins_total",
+		Help: "hedged queries, by whether the first upstream or the hedge answered first",
+	},
+		[]string{"group", "winner"},
+	)
+	HedgeBudgetExhaustedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_hedge_budget_exhausted_total",
+		Help: "slow queries that weren't hedged because the hedge budget was spent",
+	},
+		[]string{"group"},
+	)
+	BootstrapLookupsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_bootstrap_lookups_total",
+		Help: "lookups of upstream hostnames through the bootstrap resolvers, by result, see bootstrap.go",
+	},
+		[]string{"destination", "result"},
+	)
+	BootstrapAddressesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "funkyd_bootstrap_addresses",
+		Help: "how many addresses each bootstrapped upstream currently resolves to",
+	},
+		[]string{"destination"},
+	)
+	TLSHandshakesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "funkyd_tls_handshakes_total",
+		Help: "TLS handshakes with upstreams, by whether they were full handshakes or resumed an earlier session",
+	},
+		[]string{"destination", "handshake"},
+	)
 	TLSTimer = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Name:       "funkyd_tls_connection_time",
 		Help:       "times the pure connection time of tls",
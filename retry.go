@@ -0,0 +1,182 @@
+package main
+
+// The retry policy for upstream queries.  Each retry goes to an upstream that hasn't been tried
+// yet for the query, and what counts as a failure, and whether the upstream is to blame for it,
+// depends on how the attempt failed.
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Reasons an attempt can fail, as they show up in the RetriesCounter
+const (
+	// no connection could be had
+	RetryReasonConnection = "connection"
+
+	// the upstream didn't answer in time.  This gets the same treatment as RetryReasonError on
+	// purpose, either way the upstream let the query down and the next one gets a go, the
+	// separate reason is there to tell slow upstreams apart from broken ones in the metrics
+	RetryReasonTimeout = "timeout"
+
+	// a pooled connection had been closed by the upstream, this isn't held against the upstream
+	RetryReasonStale = "stale"
+
+	// the upstream's reply wasn't for the query, see validate.go
+	RetryReasonInvalid = "invalid"
+
+	// the exchange failed some other way
+	RetryReasonError = "error"
+
+	// the upstream answered with SERVFAIL
+	RetryReasonServfail = "servfail"
+
+	// the upstream answered with REFUSED
+	RetryReasonRefused = "refused"
+)
+
+// why an attempt failed, and where
+type attemptError struct {
+	reason string
+
+	// the upstream that was tried, empty if no connection was made
+	upstream Upstream
+
+	err error
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+// whether an error means the other end closed the connection
+func connectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// Sorts out why an exchange failed.  A connection that was closed under us only counts as stale
+// if it came out of the pool, a fresh connection getting closed is the upstream's doing.
+func classifyExchangeError(err error, reused bool) string {
+	var invalidErr *invalidReplyError
+	if errors.As(err, &invalidErr) {
+		return RetryReasonInvalid
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return RetryReasonTimeout
+	}
+	if reused && connectionClosed(err) {
+		return RetryReasonStale
+	}
+	return RetryReasonError
+}
+
+// returns why an attempt needs a retry, or an empty string if it doesn't
+func retryReason(reply *dns.Msg, err error) string {
+	if err != nil {
+		var attemptErr *attemptError
+		if errors.As(err, &attemptErr) {
+			return attemptErr.reason
+		}
+		return RetryReasonError
+	}
+	switch reply.Rcode {
+	case dns.RcodeServerFailure:
+		return RetryReasonServfail
+	case dns.RcodeRefused:
+		return RetryReasonRefused
+	}
+	return ""
+}
+
+// Sends a query to a group's upstreams, retrying up to UpstreamRetries times.  Retries skip
+// the upstreams that were already tried, unless they've all been tried.  A stale pooled connection
+// gets one immediate retry on a fresh connection to the same upstream that doesn't count as a retry.
+// If every attempt comes back with SERVFAIL or REFUSED, the last of those is the answer.
+func (s *MutexServer) exchangeWithRetries(pool ConnPool, group string, m *dns.Msg, trace *QueryTrace) (ce *ConnEntry, r *dns.Msg, err error) {
+	config := GetConfiguration()
+	var tried []string
+	retriedStale := false
+	for i := 0; i <= config.UpstreamRetries; i++ {
+		if len(tried) > 0 && len(tried) >= len(pool.Upstreams()) {
+			// going back around beats giving up
+			tried = nil
+		}
+
+		ce, r, err = s.hedgedExchange(pool, group, m, i, trace, tried...)
+		reason := retryReason(r, err)
+		var attemptErr *attemptError
+		if reason == RetryReasonStale && !retriedStale && errors.As(err, &attemptErr) {
+			retriedStale = true
+			RetriesCounter.WithLabelValues(group, reason).Inc()
+			ce, r, err = s.freshExchange(pool, attemptErr.upstream, m, i, trace)
+			reason = retryReason(r, err)
+		}
+
+		if reason == "" {
+			return ce, r, nil
+		}
+
+		failed := ""
+		if err == nil {
+			failed = ce.GetAddress()
+		} else if errors.As(err, &attemptErr) && (attemptErr.upstream != Upstream{}) {
+			failed = attemptErr.upstream.GetAddress()
+		}
+
+		if i == config.UpstreamRetries {
+			break
+		}
+
+		if err == nil {
+			// the upstream answered, the connection is still good
+			pool.Add(ce)
+		}
+		if failed != "" {
+			tried = append(tried, failed)
+		}
+		RetriesCounter.WithLabelValues(group, reason).Inc()
+		Logger.Log(NewLogMessage(
+			WARNING,
+			LogContext{
+				"what":    "failed exchange with upstreams",
+				"reason":  reason,
+				"address": failed,
+				"error":   fmt.Sprintf("%v", err),
+				"next":    fmt.Sprintf("retrying on another upstream until config.UpstreamRetries is met. currently on attempt [%d]/[%d]", i, config.UpstreamRetries),
+			},
+			nil,
+		))
+	}
+	return ce, r, err
+}
+
+// Runs an attempt on a newly dialed connection to a given upstream, the dial still has to wait
+// for the pool's limits so that an upstream closing every pooled connection doesn't set off a burst of dials.
+func (s *MutexServer) freshExchange(pool ConnPool, upstream Upstream, m *dns.Msg, i int, trace *QueryTrace) (ce *ConnEntry, reply *dns.Msg, err error) {
+	attempt := TraceAttempt{Attempt: i, Address: upstream.GetAddress()}
+	defer func() { trace.AddAttempt(attempt) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionWaitTimeout())
+	defer cancel()
+	if err = pool.ReserveDial(ctx, upstream); err != nil {
+		attempt.Error = err.Error()
+		return &ConnEntry{}, nil, &attemptError{reason: RetryReasonConnection, upstream: upstream, err: err}
+	}
+
+	ce, dialTime, err := s.dialConnection(pool, upstream)
+	attempt.DialTime = fmt.Sprintf("%s", dialTime)
+	if err != nil {
+		attempt.Error = err.Error()
+		return ce, nil, &attemptError{reason: RetryReasonConnection, upstream: upstream, err: err}
+	}
+	return s.exchange(pool, ce, m, &attempt)
+}
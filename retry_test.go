@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestClassifyExchangeError(t *testing.T) {
+	timeout := fmt.Errorf("read failed: %w", os.ErrDeadlineExceeded)
+	closed := fmt.Errorf("read failed: %w", io.EOF)
+	tests := []struct {
+		err    error
+		reused bool
+		reason string
+	}{
+		{timeout, true, RetryReasonTimeout},
+		{timeout, false, RetryReasonTimeout},
+		{closed, true, RetryReasonStale},
+		{closed, false, RetryReasonError},
+		{fmt.Errorf("bad message"), true, RetryReasonError},
+	}
+	for _, test := range tests {
+		if reason := classifyExchangeError(test.err, test.reused); reason != test.reason {
+			t.Errorf("expected [%s] for [%s] on a reused connection [%t], got [%s]", test.reason, test.err, test.reused, reason)
+		}
+	}
+}
+
+// builds a server with two upstreams, first.example.com ranks ahead of second.example.com
+func buildRetryTestServer(t *testing.T) (*MutexServer, *connPool, *MockDnsClient, *Upstream, *Upstream) {
+	pool := NewConnPool()
+	first := &Upstream{Name: "first.example.com"}
+	second := &Upstream{Name: "second.example.com"}
+	pool.AddUpstream(first)
+	pool.AddUpstream(second)
+	first.AddSample(time.Millisecond)
+	second.AddSample(50 * time.Millisecond)
+
+	cl := new(MockDnsClient)
+	server, err := NewMutexServer(cl, pool)
+	if err != nil {
+		t.Fatalf("could not build test server: %s", err)
+	}
+	return server.(*MutexServer), pool, cl, first, second
+}
+
+func pipeConn() *dns.Conn {
+	_, client := net.Pipe()
+	return &dns.Conn{Conn: client}
+}
+
+func TestExchangeWithRetriesSkipsTriedUpstreams(t *testing.T) {
+	config := GetConfiguration()
+	oldRetries := config.UpstreamRetries
+	config.UpstreamRetries = 1
+	defer func() { config.UpstreamRetries = oldRetries }()
+
+	server, pool, cl, first, second := buildRetryTestServer(t)
+	firstConn, secondConn := pipeConn(), pipeConn()
+	cl.On("Dial", first.GetAddress()).Return(firstConn, nil)
+	cl.On("Dial", second.GetAddress()).Return(secondConn, nil)
+	cl.On("ExchangeWithConn", mock.Anything, firstConn).Return(answerWith(dns.RcodeRefused), time.Millisecond, nil)
+	cl.On("ExchangeWithConn", mock.Anything, secondConn).Return(answerWith(dns.RcodeSuccess), time.Millisecond, nil)
+
+	retries := testutil.ToFloat64(RetriesCounter.WithLabelValues(DefaultUpstreamGroup, RetryReasonRefused))
+	trace := NewQueryTrace("example.com.", "A", false)
+	ce, r, err := server.exchangeWithRetries(pool, DefaultUpstreamGroup, testQuery("example.com"), trace)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeSuccess || ce.Conn != secondConn {
+		t.Fatalf("expected the retry to go to [%s], got [%s] from [%s]", second.GetAddress(), dns.RcodeToString[r.Rcode], ce.GetAddress())
+	}
+
+	if len(trace.Attempts) != 2 || trace.Attempts[0].Address != first.GetAddress() || trace.Attempts[1].Address != second.GetAddress() {
+		t.Fatalf("expected one attempt on each upstream, got [%v]", trace.Attempts)
+	}
+
+	if after := testutil.ToFloat64(RetriesCounter.WithLabelValues(DefaultUpstreamGroup, RetryReasonRefused)); after != retries+1 {
+		t.Fatalf("retry wasn't counted")
+	}
+
+	// an upstream that answers is still healthy, and so is its connection
+	if first.IsCooling() || pool.Size() != 1 {
+		t.Fatalf("refusing upstream was penalized: cooling [%t], pool size [%d]", first.IsCooling(), pool.Size())
+	}
+}
+
+func TestExchangeWithRetriesLastServfail(t *testing.T) {
+	config := GetConfiguration()
+	oldRetries := config.UpstreamRetries
+	config.UpstreamRetries = 1
+	defer func() { config.UpstreamRetries = oldRetries }()
+
+	server, pool, cl, first, second := buildRetryTestServer(t)
+	cl.On("Dial", first.GetAddress()).Return(pipeConn(), nil)
+	cl.On("Dial", second.GetAddress()).Return(pipeConn(), nil)
+	cl.On("ExchangeWithConn", mock.Anything, mock.Anything).Return(answerWith(dns.RcodeServerFailure), time.Millisecond, nil)
+
+	ce, r, err := server.exchangeWithRetries(pool, DefaultUpstreamGroup, testQuery("example.com"), nil)
+	if err != nil {
+		t.Fatalf("upstreams that all answered SERVFAIL should still produce an answer: %s", err)
+	}
+
+	if r.Rcode != dns.RcodeServerFailure || ce.GetAddress() != second.GetAddress() {
+		t.Fatalf("expected the SERVFAIL from the last upstream tried, got [%s] from [%s]", dns.RcodeToString[r.Rcode], ce.GetAddress())
+	}
+}
+
+func TestExchangeWithRetriesStaleConnection(t *testing.T) {
+	config := GetConfiguration()
+	oldRetries := config.UpstreamRetries
+	config.UpstreamRetries = 0
+	defer func() { config.UpstreamRetries = oldRetries }()
+
+	server, pool, cl, first, _ := buildRetryTestServer(t)
+	staleConn, freshConn := pipeConn(), pipeConn()
+	ce, err := pool.NewConnection(*first, func(addr string) (*dns.Conn, error) { return staleConn, nil })
+	if err != nil {
+		t.Fatalf("could not create connection: %s", err)
+	}
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("could not pool connection: %s", err)
+	}
+
+	cl.On("Dial", first.GetAddress()).Return(freshConn, nil)
+	cl.On("ExchangeWithConn", mock.Anything, staleConn).Return(&dns.Msg{}, time.Duration(0), fmt.Errorf("read failed: %w", io.EOF))
+	cl.On("ExchangeWithConn", mock.Anything, freshConn).Return(answerWith(dns.RcodeSuccess), time.Millisecond, nil)
+
+	stale := testutil.ToFloat64(RetriesCounter.WithLabelValues(DefaultUpstreamGroup, RetryReasonStale))
+	trace := NewQueryTrace("example.com.", "A", false)
+	ce, _, err = server.exchangeWithRetries(pool, DefaultUpstreamGroup, testQuery("example.com"), trace)
+	if err != nil {
+		t.Fatalf("stale connection wasn't replaced with a fresh one, even with no retries configured: %s", err)
+	}
+
+	if ce.Conn != freshConn {
+		t.Fatalf("expected the answer to come over the fresh connection")
+	}
+
+	if len(trace.Attempts) != 2 || !trace.Attempts[0].ReusedConnection || trace.Attempts[1].ReusedConnection {
+		t.Fatalf("expected a reused attempt followed by a fresh one, got [%v]", trace.Attempts)
+	}
+
+	if first.IsCooling() {
+		t.Fatalf("upstream was cooled over a connection it had closed")
+	}
+
+	if pool.dialing[first.GetAddress()] != 0 || pool.open[first.GetAddress()] != 1 {
+		t.Fatalf("fresh dial threw off the pool's counts: [%d] dialing, [%d] open", pool.dialing[first.GetAddress()], pool.open[first.GetAddress()])
+	}
+
+	if after := testutil.ToFloat64(RetriesCounter.WithLabelValues(DefaultUpstreamGroup, RetryReasonStale)); after != stale+1 {
+		t.Fatalf("stale retry wasn't counted")
+	}
+}
+
+func TestReserveDialWaitsForLimits(t *testing.T) {
+	config := GetConfiguration()
+	oldDials := config.MaxConcurrentDials
+	config.MaxConcurrentDials = 1
+	defer func() { config.MaxConcurrentDials = oldDials }()
+
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+
+	if err := pool.ReserveDial(context.Background(), *upstream); err != nil {
+		t.Fatalf("could not reserve a dial: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.ReserveDial(ctx, *upstream); err == nil {
+		t.Fatalf("reserved a dial past the limit")
+	}
+
+	// the reservation is used up by the dial it was made for
+	if _, err := pool.NewConnection(*upstream, UpstreamTestingDialer(*upstream)); err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+	if err := pool.ReserveDial(context.Background(), *upstream); err != nil {
+		t.Fatalf("could not reserve a dial once the last one finished: %s", err)
+	}
+}
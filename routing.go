@@ -0,0 +1,81 @@
+package main
+
+// Routes queries to groups of upstreams based on the domain being queried
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// the group that takes everything that doesn't match a rule, made up of the top level upstreams
+const DefaultUpstreamGroup = "default"
+
+// A named set of upstreams with their own pool, weights and cooldowns
+type UpstreamGroupConfig struct {
+	// How the group is referred to in logs and metrics
+	Name string `json:"name"`
+
+	// Queries for these domains, and anything under them, go to this group
+	Domains []string `json:"domains"`
+
+	// The upstreams in this group, same format as the top level upstreams
+	Upstreams []UpstreamConfig `json:"upstreams"`
+
+	// How long to cool upstreams in this group, in ms, the 0-value uses the global cooldown_period
+	CooldownPeriod time.Duration `json:"cooldown_period"`
+
+	// How this group picks upstreams, the 0-value uses the global upstream_selection
+	UpstreamSelection string `json:"upstream_selection"`
+}
+
+// Picks the upstream group for a domain using longest suffix matching
+type DomainRouter struct {
+	// maps lowercased, fully qualified domains to group names
+	rules map[string]string
+}
+
+func NewDomainRouter() *DomainRouter {
+	return &DomainRouter{
+		rules: make(map[string]string),
+	}
+}
+
+func (r *DomainRouter) AddRule(domain string, group string) error {
+	key := strings.ToLower(dns.Fqdn(domain))
+	if existing, ok := r.rules[key]; ok {
+		return fmt.Errorf("domain [%s] is already routed to group [%s], can't route it to [%s]", key, existing, group)
+	}
+	r.rules[key] = group
+	return nil
+}
+
+// returns the group that should handle a given domain
+func (r *DomainRouter) Route(domain string) string {
+	if _, group, ok := r.Match(domain); ok {
+		return group
+	}
+	return DefaultUpstreamGroup
+}
+
+// returns the most specific rule covering a domain, ok is false if there isn't one
+func (r *DomainRouter) Match(domain string) (suffix string, group string, ok bool) {
+	return longestSuffixMatch(r.rules, domain)
+}
+
+// finds the longest suffix of domain that's a key in rules, the keys
+// need to be lowercased and fully qualified
+func longestSuffixMatch(rules map[string]string, domain string) (suffix string, value string, ok bool) {
+	name := strings.ToLower(dns.Fqdn(domain))
+	// walk from the full name towards the root, the first match is the longest
+	for _, offset := range dns.Split(name) {
+		if value, ok := rules[name[offset:]]; ok {
+			return name[offset:], value, true
+		}
+	}
+	// the root has no labels, so dns.Split won't get to it
+	if value, ok := rules["."]; ok {
+		return ".", value, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDomainRouterLongestSuffix(t *testing.T) {
+	router := NewDomainRouter()
+	for domain, group := range map[string]string{
+		"example.":          "public",
+		"corp.example.":     "corp",
+		"lab.corp.example":  "lab",
+		"other.example.com": "other",
+	} {
+		if err := router.AddRule(domain, group); err != nil {
+			t.Fatalf("could not add rule [%s] -> [%s]: %s", domain, group, err)
+		}
+	}
+
+	cases := map[string]string{
+		"corp.example.":          "corp",
+		"host.corp.example.":     "corp",
+		"HOST.Corp.Example":      "corp",
+		"host.lab.corp.example.": "lab",
+		"www.example.":           "public",
+		"notcorp.example.":       "public",
+		"example.com.":           DefaultUpstreamGroup,
+		"x.other.example.com.":   "other",
+		".":                      DefaultUpstreamGroup,
+	}
+	for domain, expected := range cases {
+		if group := router.Route(domain); group != expected {
+			t.Errorf("[%s] was routed to [%s], expected [%s]", domain, group, expected)
+		}
+	}
+
+	if err := router.AddRule("corp.example", "someoneelse"); err == nil {
+		t.Fatalf("was able to route the same domain to two groups")
+	}
+
+	if err := router.AddRule(".", "catchall"); err != nil {
+		t.Fatalf("could not add root rule: %s", err)
+	}
+	if group := router.Route("example.com."); group != "catchall" {
+		t.Fatalf("root rule didn't catch unmatched domain, got [%s]", group)
+	}
+}
+
+func TestUpstreamGroupValidation(t *testing.T) {
+	for _, groups := range [][]UpstreamGroupConfig{
+		{{Name: DefaultUpstreamGroup, Upstreams: []UpstreamConfig{{Address: "example.com"}}}},
+		{{Name: "empty"}},
+		{
+			{Name: "dupe", Upstreams: []UpstreamConfig{{Address: "example.com"}}},
+			{Name: "dupe", Upstreams: []UpstreamConfig{{Address: "example.com"}}},
+		},
+		{
+			{Name: "a", Domains: []string{"example.com"}, Upstreams: []UpstreamConfig{{Address: "example.com"}}},
+			{Name: "b", Domains: []string{"example.com"}, Upstreams: []UpstreamConfig{{Address: "example.com"}}},
+		},
+	} {
+		server := &MutexServer{groups: make(map[string]ConnPool), router: NewDomainRouter()}
+		if err := server.addUpstreamGroups(groups); err == nil {
+			t.Errorf("invalid upstream groups [%v] were accepted", groups)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+// Strategies for choosing which upstream gets the next query
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Names of the available strategies, as used in the configuration
+const (
+	// prefer the lowest weighted upstream that already has pooled connections
+	LowestWeightSelection = "lowest_weight"
+
+	// pick two upstreams at random and use the lower weighted one
+	PowerOfTwoSelection = "power_of_two"
+
+	// rotate through the upstreams in the order they were configured
+	RoundRobinSelection = "round_robin"
+
+	// always use the first configured upstream that isn't cooling
+	PrioritySelection = "priority"
+)
+
+type UpstreamSelector interface {
+	// Picks an upstream to use.  upstreams is sorted by weight, lowest first, and
+	// pooled returns how many cached connections an upstream has.  This is called
+	// with the connection pool locked.
+	Select(upstreams []*Upstream, pooled func(u *Upstream) int) *Upstream
+}
+
+func NewUpstreamSelector(name string) (UpstreamSelector, error) {
+	switch name {
+	case "", LowestWeightSelection:
+		config := GetConfiguration()
+		explorationInterval := time.Duration(30000) * time.Millisecond
+		if config.UpstreamExplorationInterval != 0 {
+			explorationInterval = config.UpstreamExplorationInterval * time.Millisecond
+		}
+		return &lowestWeightSelector{explorationInterval: explorationInterval}, nil
+	case PowerOfTwoSelection:
+		return &powerOfTwoSelector{}, nil
+	case RoundRobinSelection:
+		return &roundRobinSelector{}, nil
+	case PrioritySelection:
+		return &prioritySelector{}, nil
+	}
+	return nil, fmt.Errorf("unknown upstream selection strategy [%s]", name)
+}
+
+// returns the upstreams that aren't cooling
+func warmUpstreams(upstreams []*Upstream) []*Upstream {
+	ret := make([]*Upstream, 0, len(upstreams))
+	for _, each := range upstreams {
+		if !each.IsCooling() {
+			ret = append(ret, each)
+		}
+	}
+	return ret
+}
+
+// returns a copy of the upstreams in the order they were configured
+func configuredOrder(upstreams []*Upstream) []*Upstream {
+	ret := append([]*Upstream{}, upstreams...)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].order < ret[j].order
+	})
+	return ret
+}
+
+// if everything is cooling, there's nothing to do but abuse the lowest weighted upstream
+func fallbackUpstream(upstreams []*Upstream) *Upstream {
+	if len(upstreams) == 0 {
+		return nil
+	}
+	return upstreams[0]
+}
+
+type lowestWeightSelector struct {
+	// how long an upstream can go without an RTT before it gets a query just to
+	// measure it, 0 or less means never
+	explorationInterval time.Duration
+}
+
+// Will select the lowest weighted upstream with cached connections
+// falling back to the lowest weighted upstream if none exist
+// upstreams that are cooling will be ignored
+func (s *lowestWeightSelector) Select(upstreams []*Upstream, pooled func(u *Upstream) int) *Upstream {
+	warm := warmUpstreams(upstreams)
+	best := s.best(warm, pooled)
+	if best == nil {
+		return fallbackUpstream(upstreams)
+	}
+
+	if explored := s.explore(warm, best); explored != nil {
+		return explored
+	}
+	return best
+}
+
+func (s *lowestWeightSelector) best(warm []*Upstream, pooled func(u *Upstream) int) *Upstream {
+	for _, each := range warm {
+		if pooled(each) > 0 {
+			return each
+		}
+	}
+
+	// no cached connections, the candidate will be the lowest weighted upstream that isn't cooling
+	if len(warm) > 0 {
+		return warm[0]
+	}
+	return nil
+}
+
+// The best upstream takes all the traffic, so every so often one of the others gets a query
+// to keep its weight honest.  Each one gets one query per interval so that a slow upstream doesn't get flooded.
+func (s *lowestWeightSelector) explore(warm []*Upstream, best *Upstream) *Upstream {
+	if s.explorationInterval <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for _, each := range warm {
+		if each == best {
+			continue
+		}
+		lastSeen := each.lastSample
+		if each.lastExplored.After(lastSeen) {
+			lastSeen = each.lastExplored
+		}
+		if now.Sub(lastSeen) > s.explorationInterval {
+			each.lastExplored = now
+			UpstreamExplorationsCounter.WithLabelValues(each.GetAddress()).Inc()
+			return each
+		}
+	}
+	return nil
+}
+
+// Samples two upstreams and takes the lower weighted one, which spreads traffic
+// around so that every upstream keeps getting fresh weights while still favoring the fast ones
+type powerOfTwoSelector struct{}
+
+func (s *powerOfTwoSelector) Select(upstreams []*Upstream, pooled func(u *Upstream) int) *Upstream {
+	warm := warmUpstreams(upstreams)
+	switch len(warm) {
+	case 0:
+		return fallbackUpstream(upstreams)
+	case 1:
+		return warm[0]
+	}
+
+	i := rand.Intn(len(warm))
+	// pick a second, distinct index
+	j := rand.Intn(len(warm) - 1)
+	if j >= i {
+		j++
+	}
+
+	if warm[j].GetBiasedWeight() < warm[i].GetBiasedWeight() {
+		return warm[j]
+	}
+	return warm[i]
+}
+
+type roundRobinSelector struct {
+	// how many selections have been made, only touched with the pool locked
+	next int
+}
+
+func (s *roundRobinSelector) Select(upstreams []*Upstream, pooled func(u *Upstream) int) *Upstream {
+	warm := configuredOrder(warmUpstreams(upstreams))
+	if len(warm) == 0 {
+		return fallbackUpstream(upstreams)
+	}
+	upstream := warm[s.next%len(warm)]
+	s.next++
+	return upstream
+}
+
+// Strict failover, the upstreams are used in the order they're configured and
+// later ones only get traffic while the earlier ones are cooling
+type prioritySelector struct{}
+
+func (s *prioritySelector) Select(upstreams []*Upstream, pooled func(u *Upstream) int) *Upstream {
+	ordered := configuredOrder(upstreams)
+	for _, each := range ordered {
+		if !each.IsCooling() {
+			return each
+		}
+	}
+	// everything is cooling, stick to the priorities
+	return fallbackUpstream(ordered)
+}
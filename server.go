@@ -2,6 +2,7 @@ package main
 
 // Generic functions and types for servers
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/miekg/dns"
@@ -43,6 +44,9 @@ type Server interface {
 	// Retrieves records from cache or an upstream
 	RetrieveRecords(domain string, rrtype uint16) (Response, string, error)
 
+	// Same as RetrieveRecords, but records every step along the way, optionally skipping the lookup cache
+	RetrieveRecordsWithTrace(domain string, rrtype uint16, skipCache bool) (Response, *QueryTrace, error)
+
 	// Retrieve the server's outbound client
 	GetDnsClient() Client
 
@@ -54,6 +58,13 @@ type Server interface {
 
 	// Get a copy of the connection pool for this server
 	GetConnectionPool() ConnPool
+
+	// Get the connection pools for every upstream group, keyed by group name, including the default group
+	GetUpstreamGroups() map[string]ConnPool
+
+	// Stops taking new queries, waits for in-flight queries to finish (or for the context
+	// to expire) and tears down background workers and pooled connections
+	Shutdown(ctx context.Context) error
 }
 
 func processResults(r dns.Msg, domain string, rrtype uint16) (Response, error) {
@@ -112,23 +123,182 @@ func buildDialer(timeout time.Duration) (dialer *net.Dialer) {
 		Timeout: timeout,
 	}
 }
-func BuildClient() (*dns.Client, error) {
+
+// Dials each upstream with its own TLS configuration
+type tlsClient struct {
+	// per-upstream clients, keyed by upstream address
+	clients map[string]*dns.Client
+
+	// used for exchanges and for any address that isn't a configured upstream
+	defaultClient *dns.Client
+
+	// where to connect for upstreams that are configured by hostname, keyed by upstream address, see bootstrap.go
+	bootstraps map[string]*upstreamBootstrap
+}
+
+func (c *tlsClient) Dial(address string) (*dns.Conn, error) {
+	cl := c.defaultClient
+	if each, ok := c.clients[address]; ok {
+		cl = each
+	}
+
+	bootstrap, ok := c.bootstraps[address]
+	if !ok {
+		// nothing to bootstrap with, the system resolver takes it from here
+		return cl.Dial(address)
+	}
+
+	targets := bootstrap.Targets()
+	if len(targets) == 0 {
+		// looking the upstream up through the system resolver could end up asking funkyd itself
+		if !GetConfiguration().BootstrapFallback {
+			return nil, fmt.Errorf("no addresses for [%s] yet, the bootstrap resolvers haven't found any", address)
+		}
+		return cl.Dial(address)
+	}
+	return dialStaggered(cl, address, targets)
+}
+
+// Dials an upstream's addresses Happy Eyeballs style (RFC 8305): each address gets a head start
+// before the next one is dialed alongside it, and the first connection wins.  An address that
+// doesn't answer only costs the stagger, not the whole dial timeout.
+func dialStaggered(cl *dns.Client, address string, targets []string) (*dns.Conn, error) {
+	type attempt struct {
+		conn   *dns.Conn
+		target string
+		err    error
+	}
+	attempts := make(chan attempt, len(targets))
+
+	next, pending := 0, 0
+	var stagger <-chan time.Time
+	dialNext := func() {
+		target := targets[next]
+		next++
+		pending++
+		go func() {
+			conn, err := cl.Dial(target)
+			attempts <- attempt{conn: conn, target: target, err: err}
+		}()
+		stagger = time.After(bootstrapDialStagger)
+	}
+
+	dialNext()
+	var err error
+	for pending > 0 {
+		select {
+		case a := <-attempts:
+			pending--
+			if a.err == nil {
+				// the losers still get to finish, but their connections aren't needed
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-attempts; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			err = a.err
+			Logger.Log(NewLogMessage(
+				WARNING,
+				LogContext{
+					"what":    "could not connect to upstream address",
+					"address": address,
+					"target":  a.target,
+					"error":   a.err.Error(),
+					"next":    "trying the upstream's other addresses",
+				},
+				nil,
+			))
+			// no sense waiting out the stagger for an address that already failed
+			if next < len(targets) {
+				dialNext()
+			}
+		case <-stagger:
+			if next < len(targets) {
+				dialNext()
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not connect to any of the addresses for [%s], last error: %w", address, err)
+}
+
+// the TLS configuration only matters when dialing, the connection carries it from there
+func (c *tlsClient) ExchangeWithConn(s *dns.Msg, conn *dns.Conn) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.defaultClient.ExchangeWithConn(s, conn)
+}
+
+func newDnsClient(tlsConf *tls.Config) *dns.Client {
 	config := GetConfiguration()
 	timeout := config.Timeout * time.Millisecond
-	cl := &dns.Client{
+	return &dns.Client{
 		SingleInflight: true,
 		Dialer:         buildDialer(timeout),
 		Timeout:        timeout,
 		Net:            "tcp-tls",
-		TLSConfig: &tls.Config{
-			InsecureSkipVerify: config.SkipUpstreamVerification,
-		},
+		TLSConfig:      tlsConf,
+	}
+}
+
+func BuildClient() (Client, error) {
+	config := GetConfiguration()
+	// the clients and bootstraps are keyed by address, conflicting settings would overwrite each other
+	if err := checkUpstreamConflicts(config); err != nil {
+		return nil, err
 	}
+	// an upstream with nothing configured gets the global settings
+	defaultTls, err := UpstreamConfig{}.TlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	cl := &tlsClient{
+		clients:       make(map[string]*dns.Client),
+		defaultClient: newDnsClient(defaultTls),
+		bootstraps:    make(map[string]*upstreamBootstrap),
+	}
+
+	upstreamConfigs := append([]UpstreamConfig{}, config.Upstreams...)
+	for _, group := range config.UpstreamGroups {
+		upstreamConfigs = append(upstreamConfigs, group.Upstreams...)
+	}
+	for _, upstreamConfig := range upstreamConfigs {
+		tlsConf, err := upstreamConfig.TlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		upstream := upstreamConfig.Upstream()
+		cl.clients[upstream.GetAddress()] = newDnsClient(tlsConf)
+
+		bootstrap, err := newUpstreamBootstrap(upstreamConfig)
+		if err != nil {
+			return nil, err
+		}
+		if bootstrap != nil {
+			// the first lookup can't wait for the interval, the upstream is needed right away
+			if err := bootstrap.Resolve(); err != nil {
+				Logger.Log(NewLogMessage(
+					ERROR,
+					LogContext{
+						"what":    "could not look up upstream with the bootstrap resolvers",
+						"address": upstream.GetAddress(),
+						"error":   err.Error(),
+						"next":    "using the bootstrap IPs, dials fail until a lookup succeeds if there aren't any",
+					},
+					nil,
+				))
+			}
+			cl.bootstraps[upstream.GetAddress()] = bootstrap
+		}
+	}
+
 	Logger.Log(LogMessage{
 		Level: CRITICAL,
 		Context: LogContext{
-			"what": "instantiated new dns client in TLS mode",
-			"next": "returning for use",
+			"what":      "instantiated new dns client in TLS mode",
+			"upstreams": fmt.Sprintf("%d", len(cl.clients)),
+			"next":      "returning for use",
 		},
 	})
 	return cl, nil
@@ -0,0 +1,88 @@
+package main
+
+// SPKI pinning for upstream certificates, see https://tools.ietf.org/html/rfc7858#section-4.2
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// returned from the handshake when an upstream's key doesn't match its pins
+type SpkiPinError struct {
+	Address string
+	Reason  string
+}
+
+func (e *SpkiPinError) Error() string {
+	return fmt.Sprintf("SPKI pin check failed for upstream [%s]: %s", e.Address, e.Reason)
+}
+
+// the base64 encoded SHA-256 of a certificate's SubjectPublicKeyInfo, as used in pin sets
+func SpkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validates a configured pin set
+func parseSpkiPins(pins []string) (map[string]bool, error) {
+	ret := make(map[string]bool)
+	for _, pin := range pins {
+		decoded, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return nil, fmt.Errorf("SPKI pin [%s] is not valid base64: %s", pin, err)
+		}
+		if len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("SPKI pin [%s] is not a SHA-256 hash", pin)
+		}
+		ret[pin] = true
+	}
+	return ret, nil
+}
+
+// builds a function for tls.Config.VerifyPeerCertificate that checks the upstream's certificates
+// against its pin set.  In pin-only mode there's no validated chain, so only the leaf (whose key
+// the handshake proves possession of) can match.  Otherwise, any key in a validated chain will do.
+func spkiVerifier(address string, pins map[string]bool, pinOnly bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) (err error) {
+		defer func() {
+			if err != nil {
+				SpkiPinFailuresCounter.WithLabelValues(address).Inc()
+				Logger.Log(NewLogMessage(
+					ERROR,
+					LogContext{
+						"what":    "upstream failed SPKI pin check",
+						"address": address,
+						"reason":  err.Error(),
+						"next":    "aborting handshake",
+					},
+					nil,
+				))
+			}
+		}()
+
+		// verified chains will be empty if verification is being skipped
+		if pinOnly || len(verifiedChains) == 0 {
+			if len(rawCerts) == 0 {
+				return &SpkiPinError{Address: address, Reason: "no certificate presented"}
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return &SpkiPinError{Address: address, Reason: fmt.Sprintf("could not parse certificate: %s", err)}
+			}
+			if pin := SpkiPin(leaf); !pins[pin] {
+				return &SpkiPinError{Address: address, Reason: fmt.Sprintf("certificate key [%s] is not in the pin set", pin)}
+			}
+			return nil
+		}
+
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pins[SpkiPin(cert)] {
+					return nil
+				}
+			}
+		}
+		return &SpkiPinError{Address: address, Reason: "no key in the verified chain is in the pin set"}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func loadTestCert(t *testing.T) *x509.Certificate {
+	data, err := ioutil.ReadFile("testdata/cert")
+	if err != nil {
+		t.Fatalf("could not read test certificate: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("could not parse test certificate: %s", err)
+	}
+	return cert
+}
+
+// a pin that is valid, but won't match anything
+func bogusPin() string {
+	sum := sha256.Sum256([]byte("bogus"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// runs a TLS handshake against a server using the test certificate
+func handshake(t *testing.T, clientConf *tls.Config) error {
+	cert, err := tls.LoadX509KeyPair("testdata/cert", "testdata/priv")
+	if err != nil {
+		t.Fatalf("could not load test key pair: %s", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		server := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		server.Handshake()
+		server.Close()
+	}()
+	return tls.Client(clientConn, clientConf).Handshake()
+}
+
+func TestSpkiPinOnlyHandshake(t *testing.T) {
+	pin := SpkiPin(loadTestCert(t))
+	u := UpstreamConfig{Address: "example.com", SpkiPins: []string{bogusPin(), pin}, SpkiPinOnly: true}
+	tlsConf, err := u.TlsConfig()
+	if err != nil {
+		t.Fatalf("could not build TLS config for [%v]: %s", u, err)
+	}
+	if err := handshake(t, tlsConf); err != nil {
+		t.Fatalf("handshake failed with a matching backup pin: %s", err)
+	}
+
+	u.SpkiPins = []string{bogusPin()}
+	if tlsConf, err = u.TlsConfig(); err != nil {
+		t.Fatalf("could not build TLS config for [%v]: %s", u, err)
+	}
+	address := u.Upstream().GetAddress()
+	before := testutil.ToFloat64(SpkiPinFailuresCounter.WithLabelValues(address))
+	if err := handshake(t, tlsConf); err == nil {
+		t.Fatalf("handshake succeeded with no matching pins")
+	}
+	if after := testutil.ToFloat64(SpkiPinFailuresCounter.WithLabelValues(address)); after != before+1 {
+		t.Fatalf("pin failure wasn't counted: [%f] -> [%f]", before, after)
+	}
+}
+
+func TestSpkiPinVerifiedChain(t *testing.T) {
+	cert := loadTestCert(t)
+	pins, err := parseSpkiPins([]string{SpkiPin(cert)})
+	if err != nil {
+		t.Fatalf("could not parse pins: %s", err)
+	}
+
+	verify := spkiVerifier("example.com:853", pins, false)
+	if err := verify([][]byte{cert.Raw}, [][]*x509.Certificate{{cert}}); err != nil {
+		t.Fatalf("matching key in the verified chain was rejected: %s", err)
+	}
+
+	pins, _ = parseSpkiPins([]string{bogusPin()})
+	verify = spkiVerifier("example.com:853", pins, false)
+	err = verify([][]byte{cert.Raw}, [][]*x509.Certificate{{cert}})
+	if _, ok := err.(*SpkiPinError); !ok {
+		t.Fatalf("expected a pin error for a chain with no matching keys, got [%v]", err)
+	}
+}
+
+func TestSpkiPinConfigErrors(t *testing.T) {
+	for _, bad := range []UpstreamConfig{
+		{Address: "example.com", SpkiPinOnly: true},
+		{Address: "example.com", SpkiPins: []string{"not base64!"}},
+		{Address: "example.com", SpkiPins: []string{base64.StdEncoding.EncodeToString([]byte("short"))}},
+	} {
+		if _, err := bad.TlsConfig(); err == nil {
+			t.Errorf("invalid pin configuration [%v] produced a TLS config", bad)
+		}
+	}
+}
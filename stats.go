@@ -0,0 +1,169 @@
+package main
+
+// Statistics on upstreams for the admin API, for a quick look at how they're doing without
+// having to piece it together from the prometheus metrics
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// how many of the most recent latencies are kept around for percentiles
+const rttWindow = 100
+
+// percentiles of fewer latencies than this aren't worth much
+const minPercentileSamples = 10
+
+// how finely the exchanges and errors are bucketed over time
+const outcomeBucketWidth = time.Duration(10) * time.Second
+
+// enough buckets to cover the longest error rate window, 15 minutes
+const outcomeBuckets = 90
+
+// The most recent latencies of something, this is an array so that upstreams stay comparable
+type latencyWindow struct {
+	latencies [rttWindow]time.Duration
+
+	// how many latencies have been added
+	count int
+}
+
+func (w *latencyWindow) Add(latency time.Duration) {
+	w.latencies[w.count%rttWindow] = latency
+	w.count++
+}
+
+// Returns a percentile (0-100) of the latencies, ok is false if there aren't enough of them to go on
+func (w *latencyWindow) Percentile(percentile float64) (latency time.Duration, ok bool) {
+	filled := w.count
+	if filled > rttWindow {
+		filled = rttWindow
+	}
+	if filled < minPercentileSamples {
+		return 0, false
+	}
+	sorted := append([]time.Duration{}, w.latencies[:filled]...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// the exchanges and errors in one slice of time
+type outcomeBucket struct {
+	// which slice of time this is, in bucket widths since the epoch
+	slot int64
+
+	exchanges int
+	errors    int
+}
+
+// Everything the pool keeps on an upstream for its stats
+type upstreamStats struct {
+	handshakes latencyWindow
+
+	// a ring of buckets, old ones get reused as time moves on
+	outcomes [outcomeBuckets]outcomeBucket
+
+	// how many connections have been closed, and how many queries they carried between them
+	closedConnections int
+	closedQueries     int
+}
+
+// returns the bucket for a given time, emptying it out if it was last used for an older slice of time
+func (s *upstreamStats) bucket(now time.Time) *outcomeBucket {
+	slot := now.UnixNano() / int64(outcomeBucketWidth)
+	b := &s.outcomes[slot%outcomeBuckets]
+	if b.slot != slot {
+		*b = outcomeBucket{slot: slot}
+	}
+	return b
+}
+
+func (s *upstreamStats) AddExchanges(now time.Time, exchanges int) {
+	s.bucket(now).exchanges += exchanges
+}
+
+func (s *upstreamStats) AddError(now time.Time) {
+	s.bucket(now).errors++
+}
+
+// Returns the fraction of attempts that failed over a given window, 0 if there weren't any
+func (s *upstreamStats) ErrorRate(now time.Time, window time.Duration) float64 {
+	slot := now.UnixNano() / int64(outcomeBucketWidth)
+	oldest := slot - int64(window/outcomeBucketWidth) + 1
+	exchanges, errors := 0, 0
+	for _, b := range s.outcomes {
+		if b.slot >= oldest && b.slot <= slot {
+			exchanges += b.exchanges
+			errors += b.errors
+		}
+	}
+	if exchanges+errors == 0 {
+		return 0
+	}
+	return float64(errors) / float64(exchanges+errors)
+}
+
+// p50, p90 and p99 of some latencies, left out when there aren't enough latencies to go on
+type LatencyPercentiles struct {
+	P50 string `json:"p50,omitempty"`
+	P90 string `json:"p90,omitempty"`
+	P99 string `json:"p99,omitempty"`
+}
+
+func newLatencyPercentiles(w latencyWindow) LatencyPercentiles {
+	percentile := func(p float64) string {
+		if latency, ok := w.Percentile(p); ok {
+			return fmt.Sprintf("%s", latency)
+		}
+		return ""
+	}
+	return LatencyPercentiles{
+		P50: percentile(50),
+		P90: percentile(90),
+		P99: percentile(99),
+	}
+}
+
+// The fraction of exchanges with an upstream that failed over the last 1, 5 and 15 minutes
+type ErrorRates struct {
+	OneMinute      float64 `json:"1m"`
+	FiveMinutes    float64 `json:"5m"`
+	FifteenMinutes float64 `json:"15m"`
+}
+
+// A snapshot of how an upstream is doing
+type UpstreamStats struct {
+	// The upstream group the upstream is in
+	Group string `json:"group"`
+
+	Address string `json:"address"`
+
+	// The weight used for ranking, with the bias applied
+	Weight UpstreamWeight `json:"weight"`
+
+	// Whether the breaker is keeping traffic away from the upstream, and the breaker's state
+	Cooling bool   `json:"cooling"`
+	Breaker string `json:"breaker"`
+
+	ExchangeLatency LatencyPercentiles `json:"exchange_latency"`
+
+	// Dial times, including the TLS handshake
+	HandshakeLatency LatencyPercentiles `json:"handshake_latency"`
+
+	ErrorRates ErrorRates `json:"error_rates"`
+
+	// Open connections include the idle ones
+	OpenConnections int `json:"open_connections"`
+	IdleConnections int `json:"idle_connections"`
+
+	// Averaged over the connections that have been closed and the idle ones
+	QueriesPerConnection float64 `json:"queries_per_connection"`
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpstreamStatsErrorRates(t *testing.T) {
+	stats := &upstreamStats{}
+	now := time.Now()
+
+	if rate := stats.ErrorRate(now, time.Minute); rate != 0 {
+		t.Fatalf("got an error rate of [%f] with no traffic", rate)
+	}
+
+	// an old burst of errors, followed by a quiet stretch of successes
+	for i := 0; i < 3; i++ {
+		stats.AddError(now.Add(-10 * time.Minute))
+	}
+	stats.AddExchanges(now.Add(-10*time.Minute), 1)
+	stats.AddExchanges(now, 4)
+
+	if rate := stats.ErrorRate(now, time.Minute); rate != 0 {
+		t.Fatalf("errors from 10 minutes ago showed up in the 1 minute rate [%f]", rate)
+	}
+
+	if rate := stats.ErrorRate(now, 15*time.Minute); rate != 3.0/8.0 {
+		t.Fatalf("expected a 15 minute error rate of [%f], got [%f]", 3.0/8.0, rate)
+	}
+
+	// once the ring comes back around, the old buckets get reused
+	later := now.Add(outcomeBucketWidth * outcomeBuckets)
+	stats.AddExchanges(later, 1)
+	if rate := stats.ErrorRate(later, 15*time.Minute); rate != 0 {
+		t.Fatalf("errors from more than 15 minutes ago are still counted, got [%f]", rate)
+	}
+}
+
+func TestConnectionPoolStats(t *testing.T) {
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "stats.example.com"}
+	pool.AddUpstream(upstream)
+
+	var entries []*ConnEntry
+	for i := 0; i < minPercentileSamples; i++ {
+		ce, err := pool.NewConnection(*upstream, UpstreamTestingDialer(*upstream))
+		if err != nil {
+			t.Fatalf("could not make connection: %s", err)
+		}
+		ce.AddExchange(time.Millisecond)
+		entries = append(entries, ce)
+	}
+
+	// half of them fail, the other half go back to the pool, in that order so
+	// that the failures don't purge the pool
+	for _, ce := range entries[:5] {
+		ce.AddError()
+		pool.CloseConnection(ce)
+	}
+	for _, ce := range entries[5:] {
+		if err := pool.Add(ce); err != nil {
+			t.Fatalf("could not add connection to pool: %s", err)
+		}
+	}
+
+	stats := pool.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("expected stats for one upstream, got [%v]", stats)
+	}
+	s := stats[0]
+
+	if s.Address != upstream.GetAddress() || s.Group != DefaultUpstreamGroup {
+		t.Fatalf("stats are for the wrong upstream: [%v]", s)
+	}
+
+	if s.OpenConnections != 5 || s.IdleConnections != 5 {
+		t.Fatalf("expected 5 open and idle connections, got [%d] open and [%d] idle", s.OpenConnections, s.IdleConnections)
+	}
+
+	if s.QueriesPerConnection != 1 {
+		t.Fatalf("expected 1 query per connection, got [%f]", s.QueriesPerConnection)
+	}
+
+	// the errored connections' exchanges still went through
+	if s.ErrorRates.OneMinute != 5.0/15.0 || s.ErrorRates.FifteenMinutes != 5.0/15.0 {
+		t.Fatalf("expected an error rate of [%f], got [%v]", 5.0/15.0, s.ErrorRates)
+	}
+
+	if s.HandshakeLatency.P50 == "" || s.ExchangeLatency.P99 == "" {
+		t.Fatalf("expected latency percentiles, got handshakes [%v] exchanges [%v]", s.HandshakeLatency, s.ExchangeLatency)
+	}
+
+	if !s.Cooling || s.Breaker != BreakerOpen.String() {
+		t.Fatalf("errors didn't show up in the breaker state: cooling [%t] breaker [%s]", s.Cooling, s.Breaker)
+	}
+}
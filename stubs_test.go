@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/mock"
 	"net"
@@ -10,7 +11,7 @@ import (
 type StubConnPool struct {
 	mock.Mock
 }
-func (s *StubConnPool) Get() (ce *ConnEntry, upstream Upstream, err error) {
+func (s *StubConnPool) Get(ctx context.Context, exclude ...string) (ce *ConnEntry, upstream Upstream, err error) {
 	server, c := net.Pipe()
 	server.Close()
 	ce = &ConnEntry{Conn: &dns.Conn{Conn: c}}
@@ -31,6 +32,12 @@ func (s *StubConnPool) AddUpstream(r *Upstream) {
 
 func (s *StubConnPool) CloseConnection(ce *ConnEntry) {}
 
+func (s *StubConnPool) CloseAll() {}
+
+func (s *StubConnPool) Upstreams() []Upstream {
+	return []Upstream{}
+}
+
 func (s *StubConnPool) Lock(){}
 
 func (s *StubConnPool) Unlock(){}
@@ -42,6 +49,22 @@ func (s *StubConnPool) NewConnection(upstream Upstream, dialFunc func(address st
 	return
 }
 
+func (s *StubConnPool) Reap() {}
+
+func (s *StubConnPool) ReserveDial(ctx context.Context, upstream Upstream) error {
+	return nil
+}
+
+func (s *StubConnPool) RttPercentile(address string, percentile float64) (time.Duration, bool) {
+	return 0, false
+}
+
+func (s *StubConnPool) Stats() []UpstreamStats {
+	return []UpstreamStats{}
+}
+
+func (s *StubConnPool) Warm(dialFunc func(address string) (*dns.Conn, error)) {}
+
 	// Returns the number of open connections in the pool
 func (s *StubConnPool) Size() int {
 	return 0
@@ -71,7 +94,9 @@ type StubDnsClient struct {
 }
 
 func (m *StubDnsClient) ExchangeWithConn(s *dns.Msg, conn *dns.Conn) (r *dns.Msg, rtt time.Duration, err error) {
-	return &dns.Msg{}, time.Duration(0), nil
+	r = &dns.Msg{}
+	r.SetReply(s)
+	return r, time.Duration(0), nil
 }
 
 func (m *StubDnsClient) Dial(address string) (conn *dns.Conn, err error) {
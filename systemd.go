@@ -0,0 +1,207 @@
+package main
+
+// Integration with systemd.  Sockets that systemd opened on funkyd's behalf (socket activation)
+// are handed to the listeners with the same name, so funkyd can serve port 53 without being
+// root if the service runs it as another user.  funkyd also tells systemd when it's ready, when
+// it's stopping and, if the unit has a watchdog, that it's still alive.
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the first file descriptor systemd passes in, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// sockets passed in by systemd that haven't been claimed by a listener yet, keyed by name
+var activatedSockets map[string][]*os.File
+
+// Takes the sockets systemd passed in and clears the environment variables describing them,
+// so that they don't get passed on to anything else
+func takeActivatedSockets() (sockets map[string][]*os.File, err error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid := os.Getenv("LISTEN_PID")
+	if pid == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// these were meant for some other process
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse LISTEN_FDS [%s]: %s", os.Getenv("LISTEN_FDS"), err)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	sockets = map[string][]*os.File{}
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		sockets[name] = append(sockets[name], os.NewFile(uintptr(fd), name))
+	}
+	return sockets, nil
+}
+
+// claims the activated sockets with a given name, returns nil if there aren't any
+func claimActivatedSockets(name string) []*os.File {
+	if name == "" {
+		return nil
+	}
+	files := activatedSockets[name]
+	delete(activatedSockets, name)
+	return files
+}
+
+// Closes the activated sockets that no listener claimed and fails if there were any.  systemd
+// keeps holding their addresses, so carrying on would leave funkyd failing to bind them itself.
+func closeUnclaimedSockets() error {
+	var names []string
+	for name, files := range activatedSockets {
+		names = append(names, name)
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	activatedSockets = nil
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("no listener claimed the sockets systemd passed in as [%s], give a listener the same name to use them", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// whether a socket is a datagram socket (true) or a stream socket (false)
+func isDatagramSocket(f *os.File) (bool, error) {
+	sotype, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return false, fmt.Errorf("could not get type of socket [%s]: %s", f.Name(), err)
+	}
+	switch sotype {
+	case syscall.SOCK_DGRAM:
+		return true, nil
+	case syscall.SOCK_STREAM:
+		return false, nil
+	}
+	return false, fmt.Errorf("socket [%s] is neither a stream nor a datagram socket", f.Name())
+}
+
+// Sends a state change to systemd, see sd_notify(3).  This does nothing if funkyd
+// wasn't started by systemd with a notify socket.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// a leading @ is an abstract socket, the net package takes care of that
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("could not connect to notify socket [%s]: %s", socket, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("could not send [%s] to notify socket [%s]: %s", state, socket, err)
+	}
+	return nil
+}
+
+// sends a state change to systemd, logging instead of failing if it doesn't go through
+func notifySystemd(state string) {
+	if err := sdNotify(state); err != nil {
+		Logger.Log(NewLogMessage(
+			ERROR,
+			LogContext{
+				"what":  "could not notify systemd",
+				"state": state,
+				"error": err.Error(),
+			},
+			nil,
+		))
+	}
+}
+
+// Keeps systemd's watchdog from restarting funkyd for as long as the server stays responsive
+type systemdWatchdog struct {
+	server Server
+
+	// how often systemd expects to hear from us
+	timeout time.Duration
+
+	Cancel chan bool
+}
+
+// builds a watchdog if systemd asked for one, returns nil otherwise
+func NewSystemdWatchdog(server Server) *systemdWatchdog {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// the watchdog is for some other process
+		return nil
+	}
+	return &systemdWatchdog{server: server, timeout: time.Duration(usec) * time.Microsecond}
+}
+
+// sends a keepalive if the server is responsive
+func (w *systemdWatchdog) Check() {
+	// the check gets half of the time until the next keepalive is due
+	check := checkResponsive(w.server, w.timeout/4)
+	if !check.Ok {
+		Logger.Log(NewLogMessage(
+			ERROR,
+			LogContext{
+				"what":  "server failed watchdog health check",
+				"error": check.Message,
+				"next":  "skipping the watchdog keepalive, systemd will restart the server if this keeps up",
+			},
+			nil,
+		))
+		return
+	}
+	notifySystemd("WATCHDOG=1")
+}
+
+func (w *systemdWatchdog) Start() {
+	w.Cancel = make(chan bool)
+	go func() {
+		// systemd recommends keepalives at half the timeout
+		t := time.NewTicker(w.timeout / 2)
+		defer t.Stop()
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":    "starting systemd watchdog",
+				"timeout": fmt.Sprintf("%s", w.timeout),
+			},
+			nil,
+		))
+		for {
+			select {
+			case _ = <-t.C:
+				w.Check()
+			case _ = <-w.Cancel:
+				return
+			}
+		}
+	}()
+}
+
+func (w *systemdWatchdog) Stop() {
+	close(w.Cancel)
+}
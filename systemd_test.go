@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listens on a notify socket and points NOTIFY_SOCKET at it, returns what the socket gets sent
+func startNotifySocket(t *testing.T) (messages chan string, shutdown func()) {
+	dir, err := ioutil.TempDir("", "funkyd-notify")
+	if err != nil {
+		t.Fatalf("could not make directory for notify socket: %s", err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("could not listen on notify socket: %s", err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+
+	messages = make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	return messages, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("notifying without a notify socket should do nothing, got: %s", err)
+	}
+
+	messages, shutdown := startNotifySocket(t)
+	defer shutdown()
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("could not notify: %s", err)
+	}
+
+	select {
+	case message := <-messages:
+		if message != "READY=1" {
+			t.Fatalf("expected [READY=1], got [%s]", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("notify socket never got the message")
+	}
+}
+
+func TestTakeActivatedSocketsOtherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "dns")
+
+	sockets, err := takeActivatedSockets()
+	if err != nil || sockets != nil {
+		t.Fatalf("took sockets meant for another process: [%v] [%v]", sockets, err)
+	}
+
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(env); ok {
+			t.Fatalf("[%s] was left set to [%s]", env, value)
+		}
+	}
+}
+
+// opens a UDP and a TCP socket on the same port, the way systemd would for a socket unit
+func activatedTestSockets(t *testing.T) (files []*os.File, port int) {
+	port = freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("could not open UDP socket: %s", err)
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("could not open TCP socket: %s", err)
+	}
+	defer l.Close()
+
+	udp, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatalf("could not get UDP socket: %s", err)
+	}
+	tcp, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("could not get TCP socket: %s", err)
+	}
+	return []*os.File{udp, tcp}, port
+}
+
+func TestBuildDnsServersActivated(t *testing.T) {
+	files, port := activatedTestSockets(t)
+	unclaimed, _ := activatedTestSockets(t)
+	activatedSockets = map[string][]*os.File{"dns": files, "other": unclaimed}
+	defer func() { activatedSockets = nil }()
+
+	srvs, err := buildDnsServers([]ListenerConfig{{Name: "dns", Address: "192.0.2.1"}}, &BlackholeServer{})
+	if err != nil {
+		t.Fatalf("could not build servers on activated sockets: %s", err)
+	}
+
+	if len(srvs) != 2 || srvs[0].Net != "udp" || srvs[1].Net != "tcp" {
+		t.Fatalf("expected a UDP and a TCP server, got [%v]", srvs)
+	}
+
+	for _, srv := range srvs {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go srv.ActivateAndServe()
+		<-started
+		defer srv.ShutdownContext(context.Background())
+	}
+
+	for _, protocol := range []string{"udp", "tcp"} {
+		client := &dns.Client{Net: protocol, Timeout: time.Second}
+		if _, _, err := client.Exchange(testQuery("example.com"), net.JoinHostPort("127.0.0.1", strconv.Itoa(port))); err != nil {
+			t.Errorf("could not query the [%s] server: %s", protocol, err)
+		}
+	}
+
+	if err := closeUnclaimedSockets(); err == nil {
+		t.Fatalf("unclaimed sockets didn't fail startup")
+	}
+	if activatedSockets != nil {
+		t.Fatalf("unclaimed sockets were left around: [%v]", activatedSockets)
+	}
+	if _, err := unclaimed[0].Stat(); err == nil {
+		t.Fatalf("unclaimed socket was left open")
+	}
+}
+
+func TestBuildDnsServersActivatedProtocolMismatch(t *testing.T) {
+	files, _ := activatedTestSockets(t)
+	activatedSockets = map[string][]*os.File{"dns": files}
+	defer func() { activatedSockets = nil }()
+
+	if _, err := buildDnsServers([]ListenerConfig{{Name: "dns", Protocol: "udp"}}, &BlackholeServer{}); err == nil {
+		t.Fatalf("UDP listener took a TCP socket")
+	}
+}
+
+func buildWatchdogTestServer(t *testing.T, delay time.Duration) *MockServer {
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatalf("could not build cache: %s", err)
+	}
+	pool := new(MockConnPool)
+	pool.On("Upstreams").After(delay).Return([]Upstream{})
+
+	server := new(MockServer)
+	server.On("GetHostedCache").Return(cache)
+	server.On("GetUpstreamGroups").Return(map[string]ConnPool{DefaultUpstreamGroup: pool})
+	return server
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	if watchdog := NewSystemdWatchdog(new(MockServer)); watchdog != nil {
+		t.Fatalf("built a watchdog without systemd asking for one")
+	}
+
+	os.Setenv("WATCHDOG_USEC", "400000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	messages, shutdown := startNotifySocket(t)
+	defer shutdown()
+
+	watchdog := NewSystemdWatchdog(buildWatchdogTestServer(t, 0))
+	if watchdog == nil || watchdog.timeout != 400*time.Millisecond {
+		t.Fatalf("expected a watchdog with a 400ms timeout, got [%v]", watchdog)
+	}
+
+	watchdog.Check()
+	select {
+	case message := <-messages:
+		if message != "WATCHDOG=1" {
+			t.Fatalf("expected [WATCHDOG=1], got [%s]", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("responsive server didn't send a keepalive")
+	}
+
+	// a pool that takes longer than the check allows is wedged
+	watchdog.server = buildWatchdogTestServer(t, time.Second)
+	watchdog.Check()
+	select {
+	case message := <-messages:
+		t.Fatalf("wedged server sent [%s]", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// while the last check is stuck, the next one fails without piling another goroutine on
+	start := time.Now()
+	if check := checkResponsive(watchdog.server, time.Second); check.Ok || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("check ran while the last one was still stuck: [%v] after [%s]", check, time.Since(start))
+	}
+
+	// the stuck check lets go once the server comes back
+	if !WaitForCondition(30, func() bool {
+		time.Sleep(100 * time.Millisecond)
+		return len(responsiveCheck) == 0
+	}) {
+		t.Fatalf("stuck check never finished")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+// Records what the server did while resolving a query, used for debugging over the admin API
+import (
+	"fmt"
+	"time"
+)
+
+// A single check of one of the local caches
+type TraceLookup struct {
+	// Which cache was checked
+	Cache string `json:"cache"`
+
+	// Whether it had the answer
+	Hit bool `json:"hit"`
+}
+
+// A single attempt at an exchange with an upstream
+type TraceAttempt struct {
+	// Which attempt this was, starting at 0, anything past 0 is a retry
+	Attempt int `json:"attempt"`
+
+	// The upstream that was used
+	Address string `json:"address"`
+
+	// Whether the connection came out of the pool or was freshly dialed
+	ReusedConnection bool `json:"reused_connection"`
+
+	// How long dialing took, if there was a dial
+	DialTime string `json:"dial_time,omitempty"`
+
+	// How long the exchange took
+	Rtt string `json:"rtt,omitempty"`
+
+	// What went wrong, if anything
+	Error string `json:"error,omitempty"`
+
+	// Whether this was a hedge sent because the attempt before it was slow, see hedge.go
+	Hedge bool `json:"hedge,omitempty"`
+}
+
+// The full record of a resolution.  All methods are safe to call on a nil trace
+// so that the normal query path doesn't need to care whether it's being traced.
+type QueryTrace struct {
+	Name string `json:"name"`
+
+	Type string `json:"type"`
+
+	// Whether the lookup cache was bypassed
+	SkipCache bool `json:"skip_cache"`
+
+	// The upstream group the query was routed to, if it went upstream
+	Group string `json:"group,omitempty"`
+
+	Lookups []TraceLookup `json:"lookups"`
+
+	Attempts []TraceAttempt `json:"attempts"`
+
+	// How many times the query was retried against upstreams
+	Retries int `json:"retries"`
+
+	// Where the answer finally came from
+	Source string `json:"source"`
+
+	// The total time spent resolving
+	Duration string `json:"duration"`
+
+	start time.Time
+}
+
+func NewQueryTrace(name string, typeString string, skipCache bool) *QueryTrace {
+	return &QueryTrace{
+		Name:      name,
+		Type:      typeString,
+		SkipCache: skipCache,
+		Lookups:   []TraceLookup{},
+		Attempts:  []TraceAttempt{},
+		start:     time.Now(),
+	}
+}
+
+func (t *QueryTrace) AddLookup(cache string, hit bool) {
+	if t == nil {
+		return
+	}
+	t.Lookups = append(t.Lookups, TraceLookup{Cache: cache, Hit: hit})
+}
+
+func (t *QueryTrace) SetGroup(group string) {
+	if t == nil {
+		return
+	}
+	t.Group = group
+}
+
+func (t *QueryTrace) AddAttempt(attempt TraceAttempt) {
+	if t == nil {
+		return
+	}
+	t.Attempts = append(t.Attempts, attempt)
+	// hedges and redials share their attempt's number, so they don't count as retries
+	if attempt.Attempt > t.Retries {
+		t.Retries = attempt.Attempt
+	}
+}
+
+// marks the trace as complete
+func (t *QueryTrace) Finish(source string) {
+	if t == nil {
+		return
+	}
+	t.Source = source
+	t.Duration = fmt.Sprintf("%s", time.Now().Sub(t.start))
+}
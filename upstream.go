@@ -3,12 +3,23 @@ package main
 // Manages information about upstream servers
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type UpstreamName string
 type UpstreamWeight float64
+
 type Upstream struct {
 	// The hostname of the upstream
 	Name UpstreamName
@@ -16,11 +27,264 @@ type Upstream struct {
 	// The port to connect to
 	Port int
 
-	// The current weight score of this upstream
+	// Added to the measured weight when ranking upstreams, negative values
+	// make an upstream more attractive, positive values less so
+	WeightBias UpstreamWeight
+
+	// The current weight score of this upstream, an exponentially weighted moving
+	// average of its RTTs in ms as of lastSample
 	weight UpstreamWeight
 
+	// how many RTTs have gone into the weight
+	samples int
+
+	// when the weight was last updated with an RTT, the weight decays from here
+	lastSample time.Time
+
+	// what the weight decays toward, the mean weight of the upstreams in the pool
+	neutralWeight UpstreamWeight
+
+	// when this upstream was last picked just to get a fresh RTT out of it
+	lastExplored time.Time
+
 	// if set and in the future, wait for this time before making connections
 	wakeupTime time.Time
+
+	// the circuit breaker guarding this upstream, see breaker.go
+	breakerState BreakerState
+
+	// how many times in a row the breaker has opened, drives the backoff
+	trips int
+
+	// how many probe queries have been let through while half-open
+	probes int
+
+	// where this upstream was in the configuration, for selectors that care about that
+	order int
+
+	// the most recent RTTs, for percentiles
+	recentRtts latencyWindow
+
+	// the idle timeout the upstream last sent with the EDNS TCP keepalive option, see keepalive.go
+	keepalive    time.Duration
+	hasKeepalive bool
+}
+
+// The configuration for a single upstream.  For backwards compatibility, this can be
+// given as a bare hostname string instead of an object.
+type UpstreamConfig struct {
+	// Hostname or IP (v4 or v6) of the upstream
+	Address UpstreamName `json:"address"`
+
+	// The port to connect to, the 0-value equates to 853
+	Port int `json:"port"`
+
+	// The name to send in SNI and to verify the certificate against, defaults to the address
+	TlsServerName string `json:"tls_server_name"`
+
+	// PEM bundle of CAs to verify this upstream with instead of the system roots
+	CaFile string `json:"ca_file"`
+
+	// The minimum TLS version to accept: "1.0", "1.1", "1.2" or "1.3"
+	MinTlsVersion string `json:"min_tls_version"`
+
+	// IANA names of the cipher suites to allow, empty means the go defaults
+	// (this has no effect on TLS 1.3)
+	CipherSuites []string `json:"cipher_suites"`
+
+	// See Upstream.WeightBias, in ms
+	WeightBias UpstreamWeight `json:"weight_bias"`
+
+	// Base64 encoded SHA-256 hashes of the upstream's SubjectPublicKeyInfo (RFC 7858),
+	// the handshake fails unless one of them matches.  Include a backup pin so that the
+	// upstream's key can be rotated without an outage.
+	SpkiPins []string `json:"spki_pins"`
+
+	// Trust the pins alone and skip CA verification, requires spki_pins
+	SpkiPinOnly bool `json:"spki_pin_only"`
+
+	// Client certificate to present to this upstream, overrides upstream_client_tls
+	ClientTls tlsConfig `json:"client_tls"`
+
+	// IPs to connect to instead of looking the address up, see bootstrap.go
+	BootstrapIps []string `json:"bootstrap_ips"`
+
+	// Plain DNS resolvers (ip or ip:port) to look the address up with, overrides the global bootstrap_resolvers
+	BootstrapResolvers []string `json:"bootstrap_resolvers"`
+}
+
+func (u *UpstreamConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*u = UpstreamConfig{Address: UpstreamName(name)}
+		return nil
+	}
+
+	// the alias drops this method so the decoder doesn't recurse back in here
+	type upstreamConfigAlias UpstreamConfig
+	var alias upstreamConfigAlias
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&alias); err != nil {
+		return fmt.Errorf("could not parse upstream [%s]: %s", string(data), err)
+	}
+	if alias.Address == "" {
+		return fmt.Errorf("upstream [%s] has no address", string(data))
+	}
+	*u = UpstreamConfig(alias)
+	return nil
+}
+
+// builds the upstream described by this configuration
+func (u UpstreamConfig) Upstream() *Upstream {
+	return &Upstream{
+		Name:       u.Address,
+		Port:       u.Port,
+		WeightBias: u.WeightBias,
+	}
+}
+
+// The client dials upstreams by address, so every upstream with the same address has to connect
+// the same way, whichever groups it's in.  Only the weight bias can differ, that's kept per pool.
+func checkUpstreamConflicts(c *Configuration) error {
+	type placed struct {
+		group  string
+		config UpstreamConfig
+	}
+	seen := map[string]placed{}
+	check := func(group string, upstreams []UpstreamConfig) error {
+		for _, u := range upstreams {
+			upstream := u.Upstream()
+			address := upstream.GetAddress()
+			// the same upstream can be written down differently, compare what actually gets dialed
+			u.WeightBias = 0
+			u.Address = UpstreamName(upstream.host())
+			if u.Port == 0 {
+				u.Port = 853
+			}
+			if other, ok := seen[address]; ok && !reflect.DeepEqual(other.config, u) {
+				return fmt.Errorf("upstream [%s] is configured in groups [%s] and [%s] with different TLS or bootstrap settings", address, other.group, group)
+			}
+			seen[address] = placed{group: group, config: u}
+		}
+		return nil
+	}
+
+	if err := check(DefaultUpstreamGroup, c.Upstreams); err != nil {
+		return err
+	}
+	for _, group := range c.UpstreamGroups {
+		if err := check(group.Name, group.Upstreams); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// builds the TLS configuration for connecting to this upstream
+func (u UpstreamConfig) TlsConfig() (*tls.Config, error) {
+	config := GetConfiguration()
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: config.SkipUpstreamVerification,
+		ServerName:         u.TlsServerName,
+	}
+	if tlsConf.ServerName == "" && u.needsBootstrap() {
+		// the connections go to IPs, but the certificate still has to match the name
+		tlsConf.ServerName = string(u.Address)
+	}
+
+	if config.DisableTlsResumption {
+		tlsConf.SessionTicketsDisabled = true
+	} else {
+		// each upstream gets its own cache so that a busy upstream can't push out everyone else's sessions,
+		// resumed sessions skip certificate verification, but they only come from handshakes that passed it
+		cacheSize := 8
+		if config.TlsSessionCacheSize != 0 {
+			cacheSize = config.TlsSessionCacheSize
+		}
+		tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(cacheSize)
+	}
+
+	clientTls := config.UpstreamClientTls
+	if (u.ClientTls != tlsConfig{}) {
+		clientTls = u.ClientTls
+	}
+	if (clientTls != tlsConfig{}) {
+		reloader, err := NewCertReloader(clientTls)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up client certificate for upstream [%s]: %s", u.Address, err)
+		}
+		tlsConf.GetClientCertificate = reloader.GetClientCertificate
+	}
+
+	if u.CaFile != "" {
+		pem, err := ioutil.ReadFile(u.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file [%s] for upstream [%s]: %s", u.CaFile, u.Address, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file [%s] for upstream [%s]", u.CaFile, u.Address)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	if u.MinTlsVersion != "" {
+		version, ok := tlsVersions[u.MinTlsVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version [%s] for upstream [%s]", u.MinTlsVersion, u.Address)
+		}
+		tlsConf.MinVersion = version
+	}
+
+	if len(u.CipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range u.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite [%s] for upstream [%s]", name, u.Address)
+			}
+			tlsConf.CipherSuites = append(tlsConf.CipherSuites, id)
+		}
+	}
+
+	if u.SpkiPinOnly && len(u.SpkiPins) == 0 {
+		return nil, fmt.Errorf("upstream [%s] is set to pin-only mode, but has no pins", u.Address)
+	}
+
+	if len(u.SpkiPins) > 0 {
+		pins, err := parseSpkiPins(u.SpkiPins)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pins for upstream [%s]: %s", u.Address, err)
+		}
+		if len(pins) < 2 {
+			Logger.Log(NewLogMessage(
+				WARNING,
+				LogContext{
+					"what":    "upstream has no backup SPKI pin",
+					"address": string(u.Address),
+					"why":     "the upstream will be unreachable if it rotates its key",
+				},
+				nil,
+			))
+		}
+		if u.SpkiPinOnly {
+			// the pins are doing the verification
+			tlsConf.InsecureSkipVerify = true
+		}
+		tlsConf.VerifyPeerCertificate = spkiVerifier(u.Upstream().GetAddress(), pins, u.SpkiPinOnly)
+	}
+	return tlsConf, nil
 }
 
 func (u *Upstream) GetAddress() string {
@@ -28,29 +292,84 @@ func (u *Upstream) GetAddress() string {
 	if port == 0 {
 		port = 853
 	}
-	return fmt.Sprintf("%s:%d", u.Name, port)
+	return net.JoinHostPort(u.host(), strconv.Itoa(port))
+}
+
+// the hostname or IP of the upstream, without the brackets an IPv6 literal may have been configured with
+func (u *Upstream) host() string {
+	return strings.TrimSuffix(strings.TrimPrefix(string(u.Name), "["), "]")
 }
 
+// The weight decays toward the neutral weight while there are no new samples.  This way an upstream
+// that was slow once will eventually get another chance, without an idle upstream becoming the
+// best one just because nothing has been heard from it.
 func (u *Upstream) GetWeight() UpstreamWeight {
-	return u.weight
+	if u.lastSample.IsZero() {
+		return u.weight
+	}
+	config := GetConfiguration()
+	halfLife := time.Duration(60000) * time.Millisecond
+	if config.UpstreamWeightHalfLife != 0 {
+		halfLife = config.UpstreamWeightHalfLife * time.Millisecond
+	}
+	elapsed := time.Since(u.lastSample)
+	remaining := UpstreamWeight(math.Pow(0.5, float64(elapsed)/float64(halfLife)))
+	return u.neutralWeight + (u.weight-u.neutralWeight)*remaining
 }
 
-func (u *Upstream) SetWeight(w UpstreamWeight) {
-	u.weight = w
+// Folds the RTT of an exchange into the weight
+func (u *Upstream) AddSample(rtt time.Duration) {
+	config := GetConfiguration()
+	smoothing := 0.3
+	if config.UpstreamRttSmoothing != 0 {
+		smoothing = config.UpstreamRttSmoothing
+	}
+
+	sample := UpstreamWeight(rtt) / UpstreamWeight(time.Millisecond)
+	if u.samples == 0 {
+		u.weight = sample
+	} else {
+		u.weight = UpstreamWeight(smoothing)*sample + UpstreamWeight(1-smoothing)*u.GetWeight()
+	}
+	u.samples++
+	u.lastSample = time.Now()
+	UpstreamRttSamplesCounter.WithLabelValues(u.GetAddress()).Inc()
+	u.recentRtts.Add(rtt)
 }
 
-// Sets a wakeup time until which no connections should be made
-func (u *Upstream) Cooldown(t time.Duration) {
-	u.wakeupTime = time.Now().Add(t)
+// Returns a percentile (0-100) of the upstream's recent RTTs, ok is false if there
+// aren't enough of them to go on
+func (u *Upstream) RttPercentile(percentile float64) (rtt time.Duration, ok bool) {
+	return u.recentRtts.Percentile(percentile)
 }
 
-// returns whether or not the wakeupTime is after the current time
-// if so, this upstream shouldn't get more connections
-func (u *Upstream) IsCooling() (ret bool) {
-	return u.wakeupTime.After(time.Now())
+// how many RTTs have gone into the weight
+func (u *Upstream) GetSamples() int {
+	return u.samples
+}
+
+// records the idle timeout the upstream negotiated for its connections
+func (u *Upstream) SetKeepalive(timeout time.Duration) {
+	u.keepalive = timeout
+	u.hasKeepalive = true
+	UpstreamKeepaliveGauge.WithLabelValues(u.GetAddress()).Set(timeout.Seconds())
+}
+
+// returns the idle timeout the upstream last sent, ok is false if it never sent one
+func (u *Upstream) GetKeepalive() (timeout time.Duration, ok bool) {
+	return u.keepalive, u.hasKeepalive
+}
+
+// the weight used for ranking, with the configured bias applied
+func (u *Upstream) GetBiasedWeight() UpstreamWeight {
+	return u.GetWeight() + u.WeightBias
+}
+
+func (u *Upstream) SetWeight(w UpstreamWeight) {
+	u.weight = w
 }
 
-// returns the actual time when this upstream will be ready for connections
-func (u *Upstream) WakeupTime() (wakeupTime time.Time) {
-	return u.wakeupTime
+// sets what the weight decays toward
+func (u *Upstream) SetNeutralWeight(w UpstreamWeight) {
+	u.neutralWeight = w
 }
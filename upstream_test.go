@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestUpstreamConfigParsing(t *testing.T) {
+	var upstreams []UpstreamConfig
+	data := `["dns.quad9.net", {"address": "2620:fe::fe", "port": 8853, "tls_server_name": "dns.quad9.net", "weight_bias": 10}]`
+	if err := json.Unmarshal([]byte(data), &upstreams); err != nil {
+		t.Fatalf("could not parse upstreams [%s]: %s", data, err)
+	}
+
+	if len(upstreams) != 2 {
+		t.Fatalf("expected 2 upstreams, got [%v]", upstreams)
+	}
+
+	if upstreams[0].Address != "dns.quad9.net" || upstreams[0].Port != 0 {
+		t.Fatalf("bare string upstream was parsed incorrectly: [%v]", upstreams[0])
+	}
+
+	u := upstreams[1]
+	if u.Address != "2620:fe::fe" || u.Port != 8853 || u.TlsServerName != "dns.quad9.net" || u.WeightBias != 10 {
+		t.Fatalf("upstream object was parsed incorrectly: [%v]", u)
+	}
+
+	for _, bad := range []string{`[{"address": "example.com", "bogus": true}]`, `[{"port": 853}]`} {
+		if err := json.Unmarshal([]byte(bad), &upstreams); err == nil {
+			t.Fatalf("invalid upstream configuration [%s] was accepted", bad)
+		}
+	}
+}
+
+func TestUpstreamAddress(t *testing.T) {
+	cases := map[string]Upstream{
+		"example.com:853":   {Name: "example.com"},
+		"192.0.2.1:8853":    {Name: "192.0.2.1", Port: 8853},
+		"[2620:fe::fe]:853": {Name: "2620:fe::fe"},
+		"[::1]:853":         {Name: "[::1]"},
+	}
+	for expected, upstream := range cases {
+		if address := upstream.GetAddress(); address != expected {
+			t.Errorf("upstream [%v] had address [%s], expected [%s]", upstream, address, expected)
+		}
+	}
+}
+
+func TestUpstreamTlsConfig(t *testing.T) {
+	u := UpstreamConfig{
+		Address:       "example.com",
+		TlsServerName: "dns.example.com",
+		CaFile:        "testdata/cert",
+		MinTlsVersion: "1.2",
+		CipherSuites:  []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}
+	tlsConf, err := u.TlsConfig()
+	if err != nil {
+		t.Fatalf("could not build TLS config for [%v]: %s", u, err)
+	}
+
+	if tlsConf.ServerName != "dns.example.com" || tlsConf.MinVersion != tls.VersionTLS12 || tlsConf.RootCAs == nil {
+		t.Fatalf("TLS config [%v] did not match upstream config [%v]", tlsConf, u)
+	}
+
+	if len(tlsConf.CipherSuites) != 1 || tlsConf.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("cipher suites weren't set correctly: [%v]", tlsConf.CipherSuites)
+	}
+
+	for _, bad := range []UpstreamConfig{
+		{Address: "example.com", CaFile: "testdata/doesntexist"},
+		{Address: "example.com", MinTlsVersion: "4.0"},
+		{Address: "example.com", CipherSuites: []string{"TLS_BOGUS"}},
+	} {
+		if _, err := bad.TlsConfig(); err == nil {
+			t.Errorf("invalid upstream config [%v] produced a TLS config", bad)
+		}
+	}
+}
+
+// dials an upstream twice with the same TLS config, returns whether the second handshake resumed the first session
+func resumedHandshake(t *testing.T) bool {
+	port, shutdown := startTlsBlackhole(t)
+	defer shutdown()
+
+	u := UpstreamConfig{Address: "127.0.0.1", Port: port}
+	tlsConf, err := u.TlsConfig()
+	if err != nil {
+		t.Fatalf("could not build TLS config for [%v]: %s", u, err)
+	}
+	client := newDnsClient(tlsConf)
+
+	var resumed bool
+	for i := 0; i < 2; i++ {
+		conn, err := client.Dial(u.Upstream().GetAddress())
+		if err != nil {
+			t.Fatalf("could not dial [%v]: %s", u, err)
+		}
+		resumed = conn.Conn.(*tls.Conn).ConnectionState().DidResume
+		// the session ticket comes in after the handshake, it takes an exchange to pick it up
+		if _, _, err := client.ExchangeWithConn(testQuery("example.com"), conn); err != nil {
+			t.Fatalf("could not exchange with [%v]: %s", u, err)
+		}
+		conn.Close()
+	}
+	return resumed
+}
+
+func TestUpstreamTlsResumption(t *testing.T) {
+	config := GetConfiguration()
+	config.SkipUpstreamVerification = true
+	defer func() { config.SkipUpstreamVerification = false }()
+
+	if !resumedHandshake(t) {
+		t.Fatalf("second connection to the upstream didn't resume the first one's session")
+	}
+
+	config.DisableTlsResumption = true
+	defer func() { config.DisableTlsResumption = false }()
+	if resumedHandshake(t) {
+		t.Fatalf("resumed a session with resumption turned off")
+	}
+}
+
+func TestUpstreamRttAverage(t *testing.T) {
+	u := &Upstream{Name: "example.com"}
+	u.AddSample(100 * time.Millisecond)
+	if w := u.GetWeight(); math.Abs(float64(w-100)) > 0.1 {
+		t.Fatalf("first sample should set the weight, got [%f]", w)
+	}
+
+	// the default smoothing is 0.3: 0.3 * 200 + 0.7 * 100
+	u.AddSample(200 * time.Millisecond)
+	if w := u.GetWeight(); math.Abs(float64(w-130)) > 0.1 {
+		t.Fatalf("expected a weight of 130, got [%f]", w)
+	}
+
+	if u.GetSamples() != 2 {
+		t.Fatalf("expected 2 samples, got [%d]", u.GetSamples())
+	}
+}
+
+func TestUpstreamWeightDecay(t *testing.T) {
+	u := &Upstream{Name: "example.com"}
+	u.AddSample(100 * time.Millisecond)
+	u.SetNeutralWeight(40)
+
+	// pretend the default half life has passed without any traffic
+	u.lastSample = time.Now().Add(-60 * time.Second)
+	if w := u.GetWeight(); math.Abs(float64(w-70)) > 0.1 {
+		t.Fatalf("weight should have decayed halfway to the neutral weight, got [%f]", w)
+	}
+
+	u.lastSample = time.Now().Add(-24 * time.Hour)
+	if w := u.GetWeight(); math.Abs(float64(w-40)) > 0.1 {
+		t.Fatalf("weight should have decayed to the neutral weight, got [%f]", w)
+	}
+
+	// manually set weights don't decay
+	u = &Upstream{Name: "example.com"}
+	u.SetWeight(100)
+	if w := u.GetWeight(); w != 100 {
+		t.Fatalf("manually set weight changed to [%f]", w)
+	}
+}
+
+func TestUpstreamRttPercentile(t *testing.T) {
+	u := &Upstream{Name: "example.com"}
+	for i := 1; i < minPercentileSamples; i++ {
+		u.AddSample(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := u.RttPercentile(50); ok {
+		t.Fatalf("got a percentile out of [%d] samples", minPercentileSamples-1)
+	}
+
+	for i := minPercentileSamples; i <= 20; i++ {
+		u.AddSample(time.Duration(i) * time.Millisecond)
+	}
+	if rtt, ok := u.RttPercentile(50); !ok || rtt != 10*time.Millisecond {
+		t.Fatalf("expected a median of 10ms, got [%s]", rtt)
+	}
+	if rtt, _ := u.RttPercentile(95); rtt != 19*time.Millisecond {
+		t.Fatalf("expected a 95th percentile of 19ms, got [%s]", rtt)
+	}
+
+	// old RTTs fall out of the window
+	for i := 0; i < rttWindow; i++ {
+		u.AddSample(time.Second)
+	}
+	if rtt, _ := u.RttPercentile(0); rtt != time.Second {
+		t.Fatalf("RTTs from before the window are still counted, got [%s]", rtt)
+	}
+}
+
+func TestCheckUpstreamConflicts(t *testing.T) {
+	c := &Configuration{
+		Upstreams: []UpstreamConfig{{Address: "dns.example.com", WeightBias: 10}},
+		UpstreamGroups: []UpstreamGroupConfig{
+			{Name: "internal", Upstreams: []UpstreamConfig{{Address: "dns.example.com"}}},
+		},
+	}
+	if err := checkUpstreamConflicts(c); err != nil {
+		t.Fatalf("upstream that only differs by weight bias was rejected: %s", err)
+	}
+
+	// the same address and port, written differently
+	c.Upstreams = append(c.Upstreams, UpstreamConfig{Address: "[2001:db8::1]"})
+	c.UpstreamGroups[0].Upstreams = append(c.UpstreamGroups[0].Upstreams, UpstreamConfig{Address: "2001:db8::1", Port: 853})
+	if err := checkUpstreamConflicts(c); err != nil {
+		t.Fatalf("upstream written with and without the default port and brackets was rejected: %s", err)
+	}
+
+	c.UpstreamGroups[0].Upstreams[0].CaFile = "internal-ca.pem"
+	if err := checkUpstreamConflicts(c); err == nil {
+		t.Fatalf("upstream with conflicting TLS settings was accepted")
+	}
+
+	// a different port is a different upstream
+	c.UpstreamGroups[0].Upstreams[0].Port = 8853
+	if err := checkUpstreamConflicts(c); err != nil {
+		t.Fatalf("upstreams on different ports were rejected: %s", err)
+	}
+}
+
+func TestIdleUpstreamDecaysTowardPoolMean(t *testing.T) {
+	pool := NewConnPool()
+	fast := &Upstream{Name: "fast.example.com"}
+	slow := &Upstream{Name: "slow.example.com"}
+	pool.AddUpstream(fast)
+	pool.AddUpstream(slow)
+	fast.AddSample(10 * time.Millisecond)
+	slow.AddSample(50 * time.Millisecond)
+	pool.updateNeutralWeight()
+
+	// a long idle upstream drifts back into contention, it doesn't get better than anything measured
+	fast.lastSample = time.Now().Add(-24 * time.Hour)
+	if w := fast.GetWeight(); math.Abs(float64(w-30)) > 0.1 {
+		t.Fatalf("idle upstream should have decayed to the pool's mean weight, got [%f]", w)
+	}
+	slow.lastSample = time.Now().Add(-24 * time.Hour)
+	if w := slow.GetWeight(); math.Abs(float64(w-30)) > 0.1 {
+		t.Fatalf("idle upstream should have decayed to the pool's mean weight, got [%f]", w)
+	}
+}
@@ -2,12 +2,39 @@ package main
 
 // General utilites
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/miekg/dns"
 	"net"
+	"testing"
 	"time"
 )
 
+// starts a blackhole server that speaks DNS over TLS with the test certificate on a local port
+func startTlsBlackhole(t testing.TB) (port int, shutdown func()) {
+	cert, err := tls.LoadX509KeyPair("testdata/cert", "testdata/priv")
+	if err != nil {
+		t.Fatalf("could not load test certificate: %s", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	started := make(chan struct{})
+	blackhole := &dns.Server{
+		Net:               "tcp-tls",
+		Listener:          listener,
+		Handler:           &BlackholeServer{},
+		MaxTCPQueries:     -1,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go blackhole.ActivateAndServe()
+	<-started
+	return listener.Addr().(*net.TCPAddr).Port, func() { blackhole.Shutdown() }
+}
+
 func UpstreamTestingDialer(upstream Upstream) func(addr string) (conn *dns.Conn, err error) {
 	expectedAddress := upstream.GetAddress()
 	return func(addr string) (conn *dns.Conn, err error) {
@@ -0,0 +1,144 @@
+package main
+
+// Checks on what upstreams send back.  A reply has to be for the query that was sent, and only
+// the records that have something to do with the query make it into the cache.
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Reasons a reply can be rejected, as they show up in the RejectedRepliesCounter
+const (
+	RejectReasonId       = "id"
+	RejectReasonQuestion = "question"
+)
+
+// why a reply was rejected
+type invalidReplyError struct {
+	reason string
+	err    error
+}
+
+func (e *invalidReplyError) Error() string {
+	return e.err.Error()
+}
+
+// Makes sure a reply answers the query that was sent.  Upstreams are allowed to leave the question
+// out of errors other than NXDOMAIN, some of them do that when they can't parse the query.
+func validateReply(query *dns.Msg, reply *dns.Msg) error {
+	if reply.Id != query.Id {
+		return &invalidReplyError{
+			reason: RejectReasonId,
+			err:    fmt.Errorf("reply has ID [%d], query had [%d]", reply.Id, query.Id),
+		}
+	}
+
+	if len(reply.Question) == 0 && reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+		return nil
+	}
+	if len(reply.Question) != len(query.Question) {
+		return &invalidReplyError{
+			reason: RejectReasonQuestion,
+			err:    fmt.Errorf("reply has [%d] questions, query had [%d]", len(reply.Question), len(query.Question)),
+		}
+	}
+	for i, q := range query.Question {
+		r := reply.Question[i]
+		// names are case insensitive, upstreams don't always keep the case they were sent
+		if !strings.EqualFold(r.Name, q.Name) || r.Qtype != q.Qtype || r.Qclass != q.Qclass {
+			return &invalidReplyError{
+				reason: RejectReasonQuestion,
+				err:    fmt.Errorf("reply is for [%s], query was for [%s]", r.String(), q.String()),
+			}
+		}
+	}
+	return nil
+}
+
+// Follows the CNAMEs in an answer from the name that was asked for, returning every name
+// along the way.  DNAMEs come with synthesized CNAMEs, so those get followed too.
+func answerChain(qname string, answer []dns.RR) map[string]bool {
+	chain := map[string]bool{strings.ToLower(qname): true}
+	// the records aren't guaranteed to be in order, keep going until nothing new turns up
+	for grew := true; grew; {
+		grew = false
+		for _, rr := range answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !chain[strings.ToLower(cname.Hdr.Name)] {
+				continue
+			}
+			if target := strings.ToLower(cname.Target); !chain[target] {
+				chain[target] = true
+				grew = true
+			}
+		}
+	}
+	return chain
+}
+
+// whether a name is in a zone that's an ancestor of (or the same as) a name in the chain
+func coversChain(zone string, chain map[string]bool) bool {
+	for name := range chain {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether a name is in any of the zones
+func inZones(name string, zones []string) bool {
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drops the records in a reply that are out of bailiwick for the query, returning how many were
+// dropped.  Answers have to be for the name that was asked for or somewhere its CNAMEs lead,
+// authority records have to be for one of those names or the zones above them, and additional
+// records have to be in one of those names or in an authority record's zone.
+func trimBailiwick(reply *dns.Msg) (dropped int) {
+	if len(reply.Question) == 0 {
+		return 0
+	}
+	chain := answerChain(reply.Question[0].Name, reply.Answer)
+
+	var answer []dns.RR
+	for _, rr := range reply.Answer {
+		name := strings.ToLower(rr.Header().Name)
+		// a DNAME sits above the name it rewrites
+		if _, ok := rr.(*dns.DNAME); (ok && coversChain(name, chain)) || chain[name] {
+			answer = append(answer, rr)
+		} else {
+			dropped++
+		}
+	}
+
+	var ns []dns.RR
+	var zones []string
+	for _, rr := range reply.Ns {
+		if name := rr.Header().Name; coversChain(name, chain) {
+			ns = append(ns, rr)
+			zones = append(zones, name)
+		} else {
+			dropped++
+		}
+	}
+
+	var extra []dns.RR
+	for _, rr := range reply.Extra {
+		name := rr.Header().Name
+		if _, ok := rr.(*dns.OPT); ok || chain[strings.ToLower(name)] || inZones(name, zones) {
+			extra = append(extra, rr)
+		} else {
+			dropped++
+		}
+	}
+
+	reply.Answer, reply.Ns, reply.Extra = answer, ns, extra
+	return dropped
+}
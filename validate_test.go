@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestValidateReply(t *testing.T) {
+	query := testQuery("example.com")
+	tests := []struct {
+		name   string
+		change func(r *dns.Msg)
+		reason string
+	}{
+		{"matching reply", func(r *dns.Msg) {}, ""},
+		{"name in another case", func(r *dns.Msg) { r.Question[0].Name = "ExAmPlE.cOm." }, ""},
+		{"SERVFAIL without a question", func(r *dns.Msg) { r.Rcode, r.Question = dns.RcodeServerFailure, nil }, ""},
+		{"wrong ID", func(r *dns.Msg) { r.Id++ }, RejectReasonId},
+		{"wrong name", func(r *dns.Msg) { r.Question[0].Name = "example.net." }, RejectReasonQuestion},
+		{"wrong type", func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeAAAA }, RejectReasonQuestion},
+		{"wrong class", func(r *dns.Msg) { r.Question[0].Qclass = dns.ClassCHAOS }, RejectReasonQuestion},
+		{"NOERROR without a question", func(r *dns.Msg) { r.Question = nil }, RejectReasonQuestion},
+	}
+	for _, test := range tests {
+		reply := new(dns.Msg)
+		reply.SetReply(query)
+		test.change(reply)
+
+		err := validateReply(query, reply)
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%s: reply was rejected: %s", test.name, err)
+			}
+			continue
+		}
+		if invalid, ok := err.(*invalidReplyError); !ok || invalid.reason != test.reason {
+			t.Errorf("%s: expected the reply to be rejected for [%s], got [%v]", test.name, test.reason, err)
+		}
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("could not parse record [%s]: %s", s, err)
+	}
+	return rr
+}
+
+func TestTrimBailiwick(t *testing.T) {
+	reply := new(dns.Msg)
+	reply.SetReply(testQuery("www.example.com"))
+	reply.Answer = []dns.RR{
+		// out of order on purpose
+		mustRR(t, "cdn.example.net. 300 IN A 192.0.2.1"),
+		mustRR(t, "WWW.example.com. 300 IN CNAME cdn.example.net."),
+		mustRR(t, "bank.example.org. 300 IN A 192.0.2.66"),
+	}
+	reply.Ns = []dns.RR{
+		mustRR(t, "example.net. 300 IN NS ns.example.net."),
+		mustRR(t, "example.org. 300 IN NS ns.example.org."),
+	}
+	reply.Extra = []dns.RR{
+		mustRR(t, "ns.example.net. 300 IN A 192.0.2.53"),
+		mustRR(t, "ns.example.org. 300 IN A 192.0.2.66"),
+	}
+	reply.SetEdns0(4096, false)
+
+	if dropped := trimBailiwick(reply); dropped != 3 {
+		t.Fatalf("expected 3 records to be dropped, [%d] were: [%v]", dropped, reply)
+	}
+
+	if len(reply.Answer) != 2 || reply.Answer[0].Header().Name != "cdn.example.net." || reply.Answer[1].Header().Name != "WWW.example.com." {
+		t.Fatalf("expected the CNAME chain to be kept, got [%v]", reply.Answer)
+	}
+
+	if len(reply.Ns) != 1 || reply.Ns[0].Header().Name != "example.net." {
+		t.Fatalf("expected only the authority for the CNAME target to be kept, got [%v]", reply.Ns)
+	}
+
+	if len(reply.Extra) != 2 || reply.Extra[0].Header().Name != "ns.example.net." || reply.IsEdns0() == nil {
+		t.Fatalf("expected the glue for the kept authority and the OPT record to be kept, got [%v]", reply.Extra)
+	}
+}
+
+func TestExchangeRejectsMismatchedReply(t *testing.T) {
+	config := GetConfiguration()
+	oldRetries := config.UpstreamRetries
+	config.UpstreamRetries = 1
+	defer func() { config.UpstreamRetries = oldRetries }()
+
+	server, pool, cl, first, second := buildRetryTestServer(t)
+	firstConn, secondConn := pipeConn(), pipeConn()
+	cl.On("Dial", first.GetAddress()).Return(firstConn, nil)
+	cl.On("Dial", second.GetAddress()).Return(secondConn, nil)
+	cl.On("ExchangeWithConn", mock.Anything, firstConn).Return(func(s *dns.Msg, conn *dns.Conn) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(testQuery("poisoned.example.com"))
+		r.Id = s.Id
+		return r
+	}, time.Millisecond, nil)
+	cl.On("ExchangeWithConn", mock.Anything, secondConn).Return(answerWith(dns.RcodeSuccess), time.Millisecond, nil)
+
+	rejected := testutil.ToFloat64(RejectedRepliesCounter.WithLabelValues(first.GetAddress(), RejectReasonQuestion))
+	errors := testutil.ToFloat64(UpstreamErrorsCounter.WithLabelValues(first.GetAddress()))
+	ce, _, err := server.exchangeWithRetries(pool, DefaultUpstreamGroup, testQuery("example.com"), nil)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+
+	if ce.Conn != secondConn {
+		t.Fatalf("expected the mismatched reply to be retried on another upstream, got an answer from [%s]", ce.GetAddress())
+	}
+
+	if after := testutil.ToFloat64(RejectedRepliesCounter.WithLabelValues(first.GetAddress(), RejectReasonQuestion)); after != rejected+1 {
+		t.Fatalf("rejected reply wasn't counted")
+	}
+
+	if after := testutil.ToFloat64(UpstreamErrorsCounter.WithLabelValues(first.GetAddress())); after != errors+1 {
+		t.Fatalf("rejected reply wasn't counted as an upstream error")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+// Keeps a minimum number of idle connections open to each upstream so that queries don't
+// pay for a full handshake after startup or after an upstream gets purged
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how often to top the pools back up
+const warmInterval = time.Duration(1000) * time.Millisecond
+
+type connWarmer struct {
+	// used to dial the connections
+	client Client
+
+	// the pools to keep warm, keyed by group
+	pools map[string]ConnPool
+
+	Cancel chan bool
+}
+
+// builds a warmer for a set of pools, returns nil if there's no minimum to keep
+func NewConnWarmer(client Client, pools map[string]ConnPool) *connWarmer {
+	if GetConfiguration().MinIdleConnections <= 0 {
+		return nil
+	}
+	return &connWarmer{client: client, pools: pools}
+}
+
+// dials whatever's missing in every pool at once
+func (w *connWarmer) WarmAll() {
+	var wg sync.WaitGroup
+	for _, pool := range w.pools {
+		wg.Add(1)
+		go func(pool ConnPool) {
+			defer wg.Done()
+			pool.Warm(w.client.Dial)
+		}(pool)
+	}
+	wg.Wait()
+}
+
+func (w *connWarmer) Start() {
+	w.Cancel = make(chan bool)
+	go func() {
+		Logger.Log(NewLogMessage(
+			INFO,
+			LogContext{
+				"what":     "starting connection warmer",
+				"minimum":  fmt.Sprintf("%d", GetConfiguration().MinIdleConnections),
+				"interval": fmt.Sprintf("%s", warmInterval),
+			},
+			nil,
+		))
+		// don't make the first queries wait on the first tick
+		w.WarmAll()
+
+		t := time.NewTicker(warmInterval)
+		defer t.Stop()
+		for {
+			select {
+			case _ = <-t.C:
+				w.WarmAll()
+			case _ = <-w.Cancel:
+				return
+			}
+		}
+	}()
+}
+
+func (w *connWarmer) Stop() {
+	close(w.Cancel)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dials pipes and keeps track of how many times it was called
+type countingDialer struct {
+	lock  sync.Mutex
+	dials map[string]int
+}
+
+func (d *countingDialer) Dial(address string) (*dns.Conn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dials[address]++
+	_, client := net.Pipe()
+	return &dns.Conn{Conn: client}, nil
+}
+
+func TestConnectionPoolWarm(t *testing.T) {
+	config := GetConfiguration()
+	config.MinIdleConnections = 2
+	defer func() { config.MinIdleConnections = 0 }()
+
+	pool := NewConnPool()
+	healthy := &Upstream{Name: "example.com"}
+	cooling := &Upstream{Name: "example.net"}
+	cooling.Cooldown(time.Minute)
+	pool.AddUpstream(healthy)
+	pool.AddUpstream(cooling)
+
+	dialer := &countingDialer{dials: make(map[string]int)}
+	pool.Warm(dialer.Dial)
+	defer pool.CloseAll()
+
+	if dialer.dials[healthy.GetAddress()] != 2 || pool.Size() != 2 {
+		t.Fatalf("expected 2 warm connections to [%s], dialed [%d] and pooled [%d]", healthy.GetAddress(), dialer.dials[healthy.GetAddress()], pool.Size())
+	}
+
+	if dialer.dials[cooling.GetAddress()] != 0 {
+		t.Fatalf("warmed a cooling upstream")
+	}
+
+	if healthy.GetSamples() != 1 {
+		t.Fatalf("warming didn't give the upstream an initial weight, it has [%d] samples", healthy.GetSamples())
+	}
+
+	// already at the minimum, nothing to do
+	pool.Warm(dialer.Dial)
+	if dialer.dials[healthy.GetAddress()] != 2 {
+		t.Fatalf("warmed a pool that was already at the minimum")
+	}
+}
+
+func TestConnectionPoolReapKeepsMinimum(t *testing.T) {
+	config := GetConfiguration()
+	config.MinIdleConnections = 1
+	defer func() { config.MinIdleConnections = 0 }()
+
+	pool := NewConnPool()
+	upstream := &Upstream{Name: "example.com"}
+	pool.AddUpstream(upstream)
+	defer pool.CloseAll()
+
+	for i := 0; i < 2; i++ {
+		ce, server := addLiveConnection(t, pool, upstream)
+		defer server.Close()
+		ce.lastUsed = time.Now().Add(-time.Hour)
+	}
+
+	// closing the last idle connection would only make the warmer dial a new one
+	pool.Reap()
+	if pool.Size() != 1 {
+		t.Fatalf("expected the reaper to keep one idle connection for the minimum, kept [%d]", pool.Size())
+	}
+
+	dialer := &countingDialer{dials: make(map[string]int)}
+	pool.Warm(dialer.Dial)
+	if len(dialer.dials) != 0 {
+		t.Fatalf("warmer replaced a connection the pool still had")
+	}
+	ce, upstreamToDial, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("could not check out connection: %s", err)
+	}
+	if ce == nil {
+		t.Fatalf("checkout refused the idle connection kept for the minimum and had to dial [%s]", upstreamToDial.GetAddress())
+	}
+	if err := pool.Add(ce); err != nil {
+		t.Fatalf("could not return connection: %s", err)
+	}
+	if pool.Size() != 1 {
+		t.Fatalf("connection kept for the minimum was closed when it came back")
+	}
+
+	// the minimum doesn't save connections from the other limits
+	config.ConnectionMaxAge = 1
+	defer func() { config.ConnectionMaxAge = 0 }()
+	time.Sleep(5 * time.Millisecond)
+	pool.Reap()
+	if pool.Size() != 0 {
+		t.Fatalf("reaper kept a connection past its max age for the minimum")
+	}
+}
+
+func TestConnWarmerDisabled(t *testing.T) {
+	if NewConnWarmer(new(MockDnsClient), map[string]ConnPool{}) != nil {
+		t.Fatalf("built a warmer without a minimum")
+	}
+}